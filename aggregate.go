@@ -0,0 +1,128 @@
+package clickhouse
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"math"
+	"sort"
+	"time"
+)
+
+// client-side aggregate of the values of a series within an interval
+type aggregate struct {
+	name  string
+	tags  string
+	ts    time.Time
+	min   float64
+	max   float64
+	sum   float64
+	count uint64
+}
+
+// columns of the table of the aggregated stream
+func (c *ClickhouseClient) aggregateColumns() []columnDef {
+	columns := []columnDef{
+		{name: "date", typ: "Date", defaultExpr: "toDate(ts)"},
+		{name: "name", typ: c.stringType()},
+	}
+	columns = append(columns, c.tagsColumnDefs()...)
+	return append(columns, []columnDef{
+		{name: "ts", typ: c.dateTimeType()},
+		{name: "min", typ: "Float64"},
+		{name: "max", typ: "Float64"},
+		{name: "avg", typ: "Float64"},
+		{name: "sum", typ: "Float64"},
+		{name: "count", typ: "UInt64"},
+	}...)
+}
+
+// create the table of the aggregated stream.
+func (c *ClickhouseClient) createAggregateTable() error {
+	return c.createShardedTable(c.AggregateTable, c.aggregateColumns(), c.mergeTreeEngine(c.metricsSortKey()))
+}
+
+// insert the aggregates of the batch into the table of the aggregated
+// stream. The raw rows are committed already and a retry of the flush
+// would insert them twice, so failures are only logged, the aggregates
+// spooled if spool_dir is set.
+func (c *ClickhouseClient) writeAggregates(ctx context.Context, batchMetrics []clickhouseMetrics, stats *writeStats) {
+	columns, rows := c.aggregateRows(batchMetrics)
+	_, err := c.insertWithFailover(ctx, c.AggregateTable, columns, rows, stats)
+	if err == nil {
+		return
+	}
+	// the table may have been dropped underneath us
+	c.schemaReady = false
+	if c.SpoolDir != "" {
+		path, spoolErr := c.spool(c.AggregateTable, c.aggregateColumns(), columns, rows)
+		if spoolErr == nil {
+			log.Printf("W! [outputs.clickhouse] Aggregate insert failed, spooled %d rows to %s: %s", len(rows), path, err.Error())
+			stats.addSpooled(len(rows))
+			c.health.recordSpool(c.SpoolDir)
+			return
+		}
+		log.Printf("E! [outputs.clickhouse] Unable to spool %d aggregate rows: %s", len(rows), spoolErr.Error())
+	}
+	log.Printf("E! [outputs.clickhouse] Unable to write aggregates to %s: %s", c.qualifiedTable(c.AggregateTable), err.Error())
+}
+
+// rows of the aggregated stream, one per series and aggregate_interval
+// of the batch. Flushes overlapping an interval each add a row for it,
+// readers combine them with min(min), max(max), sum(sum) and sum(count).
+func (c *ClickhouseClient) aggregateRows(batchMetrics []clickhouseMetrics) ([]string, []insertRow) {
+	interval := time.Duration(c.AggregateInterval)
+	if interval <= 0 {
+		interval = time.Minute
+	}
+
+	type key struct {
+		name string
+		tags string
+		ts   int64
+	}
+	aggregates := make(map[key]*aggregate)
+	var keys []key
+	for _, metrs := range batchMetrics {
+		for _, metr := range metrs {
+			if math.IsNaN(metr.Val) || math.IsInf(metr.Val, 0) {
+				continue
+			}
+			tags, _ := json.Marshal(metr.Tags)
+			ts := metr.Ts.Truncate(interval)
+			k := key{name: metr.Name, tags: string(tags), ts: ts.Unix()}
+
+			agg, ok := aggregates[k]
+			if !ok {
+				agg = &aggregate{name: metr.Name, tags: string(tags), ts: ts, min: metr.Val, max: metr.Val}
+				aggregates[k] = agg
+				keys = append(keys, k)
+			}
+			agg.min = math.Min(agg.min, metr.Val)
+			agg.max = math.Max(agg.max, metr.Val)
+			agg.sum += metr.Val
+			agg.count++
+		}
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].name != keys[j].name {
+			return keys[i].name < keys[j].name
+		}
+		if keys[i].tags != keys[j].tags {
+			return keys[i].tags < keys[j].tags
+		}
+		return keys[i].ts < keys[j].ts
+	})
+
+	rows := make([]insertRow, 0, len(keys))
+	for _, k := range keys {
+		agg := aggregates[k]
+		rows = append(rows, insertRow{
+			values: []interface{}{agg.name, agg.tags, agg.ts, agg.min, agg.max, agg.sum / float64(agg.count), agg.sum, agg.count},
+			// name + tags + ts(DateTime) + 4 * Float64 + count(UInt64)
+			size: len(agg.name) + len(agg.tags) + 4 + 4*8 + 8,
+		})
+	}
+	return []string{"name", c.tagsInsertColumn(), "ts", "min", "max", "avg", "sum", "count"}, rows
+}
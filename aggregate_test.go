@@ -0,0 +1,84 @@
+package clickhouse
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/metric"
+)
+
+func TestWriteAggregates(t *testing.T) {
+	db := newMockDatabase()
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.AggregateTable = "metrics_1m"
+	})
+
+	start := time.Unix(1600000020, 0)
+	var metrics []telegraf.Metric
+	for i, v := range []float64{4, 1, 7, 2} {
+		metrics = append(metrics, metric.New("cpu",
+			map[string]string{"host": "a"},
+			map[string]interface{}{"usage": v},
+			start.Add(time.Duration(i)*20*time.Second)))
+	}
+
+	if err := c.Write(metrics); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	if n := len(db.execsWithPrefix("CREATE TABLE IF NOT EXISTS telegraf.metrics_1m(")); n != 1 {
+		t.Errorf("expected aggregate table created, got %d", n)
+	}
+	if n := len(db.sentBatches("telegraf.metrics")); n != 1 {
+		t.Errorf("expected 1 raw batch, got %d", n)
+	}
+
+	batches := db.sentBatches("telegraf.metrics_1m")
+	if len(batches) != 1 {
+		t.Fatalf("expected 1 aggregate batch, got %d", len(batches))
+	}
+	rows := batches[0].rows
+	if len(rows) != 2 {
+		t.Fatalf("expected 2 minutes, got %v", rows)
+	}
+
+	// start is at the beginning of a minute, the last sample in the next
+	expected := [][]interface{}{
+		{"cpu_usage", `{"host":"a"}`, start, 1.0, 7.0, 4.0, 12.0, uint64(3)},
+		{"cpu_usage", `{"host":"a"}`, start.Add(time.Minute), 2.0, 2.0, 2.0, 2.0, uint64(1)},
+	}
+	for i := range expected {
+		for j := range expected[i] {
+			if ts, ok := expected[i][j].(time.Time); ok {
+				if !rows[i][j].(time.Time).Equal(ts) {
+					t.Errorf("row %d: expected ts %v, got %v", i, ts, rows[i][j])
+				}
+				continue
+			}
+			if rows[i][j] != expected[i][j] {
+				t.Errorf("row %d column %d: expected %v, got %v", i, j, expected[i][j], rows[i][j])
+			}
+		}
+	}
+}
+
+func TestWriteAggregatesFailureKeepsFlush(t *testing.T) {
+	db := newMockDatabase()
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.AggregateTable = "metrics_1m"
+	})
+
+	// the raw rows are committed, the aggregates fail
+	db.sendErrs = []error{nil, errors.New("table is read only")}
+	if err := c.Write(testBatch()); err != nil {
+		t.Fatalf("expected the flush to succeed without the aggregates, got %v", err)
+	}
+	if n := len(db.sentBatches("telegraf.metrics")); n != 1 {
+		t.Errorf("expected the raw rows inserted once, got %d batches", n)
+	}
+	if n := len(db.sentBatches("telegraf.metrics_1m")); n != 0 {
+		t.Errorf("expected no aggregate batch, got %d", n)
+	}
+}
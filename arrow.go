@@ -0,0 +1,450 @@
+package clickhouse
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+)
+
+// ids of the Arrow IPC metadata, see Message.fbs and Schema.fbs of the
+// Arrow format
+const (
+	arrowMetadataV5 = 4
+
+	arrowHeaderSchema      = 1
+	arrowHeaderRecordBatch = 3
+
+	arrowTypeInt           = 2
+	arrowTypeFloatingPoint = 3
+	arrowTypeUtf8          = 5
+	arrowTypeBool          = 6
+	arrowTypeTimestamp     = 10
+
+	arrowPrecisionDouble = 2
+)
+
+// the continuation marker preceding each message of a stream
+const arrowContinuation = 0xFFFFFFFF
+
+// type of an Arrow column, the bit width and signedness of integers and
+// the time unit of timestamps
+type arrowType struct {
+	id       byte
+	bitWidth int
+	signed   bool
+	unit     int
+}
+
+var (
+	arrowUtf8    = arrowType{id: arrowTypeUtf8}
+	arrowFloat64 = arrowType{id: arrowTypeFloatingPoint, bitWidth: 64}
+	arrowInt64   = arrowType{id: arrowTypeInt, bitWidth: 64, signed: true}
+	arrowUInt64  = arrowType{id: arrowTypeInt, bitWidth: 64}
+	arrowUInt32  = arrowType{id: arrowTypeInt, bitWidth: 32}
+	arrowUInt8   = arrowType{id: arrowTypeInt, bitWidth: 8}
+	arrowBool    = arrowType{id: arrowTypeBool}
+)
+
+// timestamp type of the unit of precision digits, the next finer unit
+// for precisions between seconds, milli-, micro- and nanoseconds
+func arrowTimestamp(precision int) arrowType {
+	unit := (precision + 2) / 3
+	if unit > 3 {
+		unit = 3
+	}
+	return arrowType{id: arrowTypeTimestamp, bitWidth: 64, unit: unit}
+}
+
+// Arrow type of value and the value as a string or as the bits of a fixed
+// width value, the zero type for nil
+func arrowValue(value interface{}) (arrowType, interface{}, error) {
+	switch v := value.(type) {
+	case nil:
+		return arrowType{}, nil, nil
+	case string:
+		return arrowUtf8, v, nil
+	case float64:
+		return arrowFloat64, math.Float64bits(v), nil
+	case float32:
+		return arrowFloat64, math.Float64bits(float64(v)), nil
+	case int:
+		return arrowInt64, uint64(v), nil
+	case int8:
+		return arrowInt64, uint64(v), nil
+	case int16:
+		return arrowInt64, uint64(v), nil
+	case int32:
+		return arrowInt64, uint64(v), nil
+	case int64:
+		return arrowInt64, uint64(v), nil
+	case uint:
+		return arrowUInt64, uint64(v), nil
+	case uint16:
+		return arrowUInt64, uint64(v), nil
+	case uint64:
+		return arrowUInt64, v, nil
+	case uint32:
+		return arrowUInt32, uint64(v), nil
+	case uint8:
+		return arrowUInt8, uint64(v), nil
+	case bool:
+		if v {
+			return arrowBool, uint64(1), nil
+		}
+		return arrowBool, uint64(0), nil
+	case time.Time:
+		return arrowTimestamp(0), uint64(v.Unix()), nil
+	case dateTime64:
+		t := arrowTimestamp(v.precision)
+		return t, uint64(v.UnixNano() / int64(math.Pow10(9-3*t.unit))), nil
+	}
+	return arrowType{}, nil, fmt.Errorf("unsupported value %T", value)
+}
+
+// a column of an ArrowStream insert, its values kept until the batch is
+// encoded
+type arrowColumn struct {
+	name  string
+	typ   arrowType
+	valid []bool
+	// strings of Utf8 columns, the bits of the values otherwise
+	strings []string
+	fixed   []uint64
+	nulls   int
+}
+
+// rows of an INSERT kept by column and encoded as an ArrowStream of a
+// schema and a single record batch
+type arrowBatch struct {
+	columns []arrowColumn
+	rows    int
+}
+
+func newArrowBatch(columns []string) *arrowBatch {
+	a := &arrowBatch{columns: make([]arrowColumn, len(columns))}
+	for i, name := range columns {
+		a.columns[i].name = name
+	}
+	return a
+}
+
+// add a row, rejecting it unless every value matches the type of its
+// column
+func (a *arrowBatch) append(values []interface{}) error {
+	types := make([]arrowType, len(values))
+	converted := make([]interface{}, len(values))
+	for i, value := range values {
+		typ, v, err := arrowValue(value)
+		if err != nil {
+			return fmt.Errorf("column %s: %s", a.columns[i].name, err.Error())
+		}
+		if col := a.columns[i]; v != nil && col.typ != (arrowType{}) && col.typ != typ {
+			return fmt.Errorf("column %s: value %T does not match the earlier values", col.name, value)
+		}
+		types[i], converted[i] = typ, v
+	}
+
+	for i := range a.columns {
+		col := &a.columns[i]
+		col.valid = append(col.valid, converted[i] != nil)
+		switch v := converted[i].(type) {
+		case nil:
+			col.nulls++
+			col.strings = append(col.strings, "")
+			col.fixed = append(col.fixed, 0)
+			continue
+		case string:
+			col.strings = append(col.strings, v)
+			col.fixed = append(col.fixed, 0)
+		case uint64:
+			col.strings = append(col.strings, "")
+			col.fixed = append(col.fixed, v)
+		}
+		col.typ = types[i]
+	}
+	a.rows++
+	return nil
+}
+
+// the stream of the schema and the record batch of the rows
+func (a *arrowBatch) encode() []byte {
+	// columns only holding NULLs are sent as strings
+	for i := range a.columns {
+		if a.columns[i].typ == (arrowType{}) {
+			a.columns[i].typ = arrowUtf8
+		}
+	}
+
+	var body bytes.Buffer
+	var nodes, buffers [][2]int64
+	buffer := func(data []byte) {
+		buffers = append(buffers, [2]int64{int64(body.Len()), int64(len(data))})
+		body.Write(data)
+		for body.Len()%8 != 0 {
+			body.WriteByte(0)
+		}
+	}
+	for _, col := range a.columns {
+		nodes = append(nodes, [2]int64{int64(a.rows), int64(col.nulls)})
+		if col.nulls > 0 {
+			buffer(arrowBitmap(col.valid))
+		} else {
+			buffer(nil)
+		}
+		switch col.typ.id {
+		case arrowTypeUtf8:
+			offsets := make([]byte, 4*(len(col.strings)+1))
+			var data []byte
+			for i, s := range col.strings {
+				data = append(data, s...)
+				binary.LittleEndian.PutUint32(offsets[4*(i+1):], uint32(len(data)))
+			}
+			buffer(offsets)
+			buffer(data)
+		case arrowTypeBool:
+			bits := make([]bool, len(col.fixed))
+			for i, v := range col.fixed {
+				bits[i] = v != 0
+			}
+			buffer(arrowBitmap(bits))
+		default:
+			width := col.typ.bitWidth / 8
+			data := make([]byte, width*len(col.fixed))
+			for i, v := range col.fixed {
+				switch width {
+				case 8:
+					binary.LittleEndian.PutUint64(data[8*i:], v)
+				case 4:
+					binary.LittleEndian.PutUint32(data[4*i:], uint32(v))
+				default:
+					data[i] = byte(v)
+				}
+			}
+			buffer(data)
+		}
+	}
+
+	var out bytes.Buffer
+	out.Write(arrowMessage(arrowHeaderSchema, a.schema, 0))
+	out.Write(arrowMessage(arrowHeaderRecordBatch, func(b *flatBuilder) int {
+		return b.table([]flatField{
+			{size: 8, value: uint64(a.rows)},
+			{size: 4, ref: func(b *flatBuilder) int { return b.pairVector(nodes) }},
+			{size: 4, ref: func(b *flatBuilder) int { return b.pairVector(buffers) }},
+		})
+	}, int64(body.Len())))
+	out.Write(body.Bytes())
+	// end of stream
+	binary.Write(&out, binary.LittleEndian, [2]uint32{arrowContinuation, 0})
+	return out.Bytes()
+}
+
+// Schema table of the columns, nullable if holding NULLs
+func (a *arrowBatch) schema(b *flatBuilder) int {
+	return b.table([]flatField{
+		// little endian
+		{size: 2, value: 0},
+		{size: 4, ref: func(b *flatBuilder) int {
+			return b.tableVector(len(a.columns), func(b *flatBuilder, i int) int {
+				col := a.columns[i]
+				var nullable uint64
+				if col.nulls > 0 {
+					nullable = 1
+				}
+				return b.table([]flatField{
+					{size: 4, ref: func(b *flatBuilder) int { return b.string(col.name) }},
+					{size: 1, value: nullable},
+					{size: 1, value: uint64(col.typ.id)},
+					{size: 4, ref: col.typ.table},
+					{},
+					{size: 4, ref: func(b *flatBuilder) int { return b.tableVector(0, nil) }},
+				})
+			})
+		}},
+	})
+}
+
+// type table of t
+func (t arrowType) table(b *flatBuilder) int {
+	switch t.id {
+	case arrowTypeInt:
+		var signed uint64
+		if t.signed {
+			signed = 1
+		}
+		return b.table([]flatField{{size: 4, value: uint64(t.bitWidth)}, {size: 1, value: signed}})
+	case arrowTypeFloatingPoint:
+		return b.table([]flatField{{size: 2, value: arrowPrecisionDouble}})
+	case arrowTypeTimestamp:
+		return b.table([]flatField{
+			{size: 2, value: uint64(t.unit)},
+			{size: 4, ref: func(b *flatBuilder) int { return b.string("UTC") }},
+		})
+	}
+	// Utf8 and Bool have no fields
+	return b.table(nil)
+}
+
+// bitmap of bits, least significant bit first
+func arrowBitmap(bits []bool) []byte {
+	bitmap := make([]byte, (len(bits)+7)/8)
+	for i, bit := range bits {
+		if bit {
+			bitmap[i/8] |= 1 << uint(i%8)
+		}
+	}
+	return bitmap
+}
+
+// encapsulated message of the header written by header, followed by a
+// body of bodyLength bytes
+func arrowMessage(headerType byte, header func(b *flatBuilder) int, bodyLength int64) []byte {
+	metadata := finishFlatBuffer(func(b *flatBuilder) int {
+		return b.table([]flatField{
+			{size: 2, value: arrowMetadataV5},
+			{size: 1, value: uint64(headerType)},
+			{size: 4, ref: header},
+			{size: 8, value: uint64(bodyLength)},
+		})
+	})
+
+	message := make([]byte, 8, 8+len(metadata))
+	binary.LittleEndian.PutUint32(message, arrowContinuation)
+	binary.LittleEndian.PutUint32(message[4:], uint32(len(metadata)))
+	return append(message, metadata...)
+}
+
+// FlatBuffers builder of the Arrow IPC metadata. Objects are laid out
+// front to back, each table preceded by its vtable and followed by the
+// objects it refers to, as offsets only point forward.
+type flatBuilder struct {
+	buf []byte
+}
+
+// a field of a table, an inline scalar of size bytes or the offset of the
+// object written by ref. Fields of size zero are absent.
+type flatField struct {
+	size  int
+	value uint64
+	ref   func(b *flatBuilder) int
+}
+
+// buffer of the root table written by root, padded to 8 bytes
+func finishFlatBuffer(root func(b *flatBuilder) int) []byte {
+	b := &flatBuilder{buf: make([]byte, 4)}
+	binary.LittleEndian.PutUint32(b.buf, uint32(root(b)))
+	b.align(8)
+	return b.buf
+}
+
+func (b *flatBuilder) align(n int) {
+	for len(b.buf)%n != 0 {
+		b.buf = append(b.buf, 0)
+	}
+}
+
+func (b *flatBuilder) uint32At(pos int, v uint32) {
+	binary.LittleEndian.PutUint32(b.buf[pos:], v)
+}
+
+// write a table of fields by their ids, returning its position
+func (b *flatBuilder) table(fields []flatField) int {
+	// each field aligned to its size, the table to 8 bytes
+	offsets := make([]int, len(fields))
+	size := 4
+	for i, f := range fields {
+		if f.size == 0 {
+			continue
+		}
+		for size%f.size != 0 {
+			size++
+		}
+		offsets[i] = size
+		size += f.size
+	}
+
+	b.align(2)
+	vtable := len(b.buf)
+	entries := make([]byte, 4+2*len(fields))
+	binary.LittleEndian.PutUint16(entries, uint16(len(entries)))
+	binary.LittleEndian.PutUint16(entries[2:], uint16(size))
+	for i, offset := range offsets {
+		binary.LittleEndian.PutUint16(entries[4+2*i:], uint16(offset))
+	}
+	b.buf = append(b.buf, entries...)
+
+	b.align(8)
+	table := len(b.buf)
+	b.buf = append(b.buf, make([]byte, size)...)
+	b.uint32At(table, uint32(table-vtable))
+	for i, f := range fields {
+		if f.size == 0 || f.ref != nil {
+			continue
+		}
+		pos := table + offsets[i]
+		switch f.size {
+		case 8:
+			binary.LittleEndian.PutUint64(b.buf[pos:], f.value)
+		case 4:
+			binary.LittleEndian.PutUint32(b.buf[pos:], uint32(f.value))
+		case 2:
+			binary.LittleEndian.PutUint16(b.buf[pos:], uint16(f.value))
+		default:
+			b.buf[pos] = byte(f.value)
+		}
+	}
+	for i, f := range fields {
+		if f.ref != nil {
+			pos := table + offsets[i]
+			b.uint32At(pos, uint32(f.ref(b)-pos))
+		}
+	}
+	return table
+}
+
+// write a vector of n tables written by item, returning its position
+func (b *flatBuilder) tableVector(n int, item func(b *flatBuilder, i int) int) int {
+	b.align(4)
+	vector := len(b.buf)
+	b.buf = append(b.buf, make([]byte, 4+4*n)...)
+	b.uint32At(vector, uint32(n))
+	for i := 0; i < n; i++ {
+		slot := vector + 4 + 4*i
+		b.uint32At(slot, uint32(item(b, i)-slot))
+	}
+	return vector
+}
+
+// write a vector of structs of two longs, e.g. FieldNode and Buffer,
+// returning its position
+func (b *flatBuilder) pairVector(pairs [][2]int64) int {
+	// the structs are aligned to 8 bytes, after the length
+	b.align(4)
+	if len(b.buf)%8 == 0 {
+		b.buf = append(b.buf, 0, 0, 0, 0)
+	}
+	vector := len(b.buf)
+	b.buf = append(b.buf, 0, 0, 0, 0)
+	b.uint32At(vector, uint32(len(pairs)))
+	for _, pair := range pairs {
+		for _, v := range pair {
+			var long [8]byte
+			binary.LittleEndian.PutUint64(long[:], uint64(v))
+			b.buf = append(b.buf, long[:]...)
+		}
+	}
+	return vector
+}
+
+// write a string, returning its position
+func (b *flatBuilder) string(s string) int {
+	b.align(4)
+	pos := len(b.buf)
+	b.buf = append(b.buf, 0, 0, 0, 0)
+	b.uint32At(pos, uint32(len(s)))
+	b.buf = append(b.buf, s...)
+	b.buf = append(b.buf, 0)
+	return pos
+}
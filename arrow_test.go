@@ -0,0 +1,254 @@
+package clickhouse
+
+import (
+	"context"
+	"encoding/binary"
+	"math"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// a column of a decoded ArrowStream
+type arrowTestColumn struct {
+	name     string
+	typ      byte
+	nullable bool
+	nulls    int64
+	buffers  [][]byte
+}
+
+// position of field id of the table at pos, 0 if absent, failing on
+// misaligned tables
+func testFlatField(t *testing.T, buf []byte, table int, id int) int {
+	t.Helper()
+	if table%4 != 0 {
+		t.Fatalf("table at %d is not aligned", table)
+	}
+	vtable := table - int(int32(binary.LittleEndian.Uint32(buf[table:])))
+	if vtable%2 != 0 || 4+2*id >= int(binary.LittleEndian.Uint16(buf[vtable:])) {
+		return 0
+	}
+	offset := int(binary.LittleEndian.Uint16(buf[vtable+4+2*id:]))
+	if offset == 0 {
+		return 0
+	}
+	return table + offset
+}
+
+// object the offset at pos refers to
+func testFlatRef(buf []byte, pos int) int {
+	return pos + int(binary.LittleEndian.Uint32(buf[pos:]))
+}
+
+// the row count and columns of an ArrowStream of a schema and a single
+// record batch
+func readArrowStream(t *testing.T, data []byte) (int64, []arrowTestColumn) {
+	t.Helper()
+	le := binary.LittleEndian
+	message := func(headerType byte) ([]byte, int, []byte) {
+		if le.Uint32(data) != arrowContinuation {
+			t.Fatalf("expected a continuation marker, got %x", data[:4])
+		}
+		size := int(le.Uint32(data[4:]))
+		if size%8 != 0 {
+			t.Fatalf("expected the metadata padded to 8 bytes, got %d", size)
+		}
+		meta := data[8 : 8+size]
+		root := testFlatRef(meta, 0)
+		if v := le.Uint16(meta[testFlatField(t, meta, root, 0):]); v != arrowMetadataV5 {
+			t.Fatalf("expected metadata version V5, got %d", v)
+		}
+		if typ := meta[testFlatField(t, meta, root, 1)]; typ != headerType {
+			t.Fatalf("expected header %d, got %d", headerType, typ)
+		}
+		length := testFlatField(t, meta, root, 3)
+		if length%8 != 0 {
+			t.Fatalf("bodyLength at %d is not aligned", length)
+		}
+		bodyLength := int(le.Uint64(meta[length:]))
+		body := data[8+size : 8+size+bodyLength]
+		data = data[8+size+bodyLength:]
+		return meta, testFlatRef(meta, testFlatField(t, meta, root, 2)), body
+	}
+
+	meta, schema, _ := message(arrowHeaderSchema)
+	fields := testFlatRef(meta, testFlatField(t, meta, schema, 1))
+	columns := make([]arrowTestColumn, le.Uint32(meta[fields:]))
+	for i := range columns {
+		field := testFlatRef(meta, fields+4+4*i)
+		name := testFlatRef(meta, testFlatField(t, meta, field, 0))
+		columns[i].name = string(meta[name+4 : name+4+int(le.Uint32(meta[name:]))])
+		if pos := testFlatField(t, meta, field, 1); pos != 0 {
+			columns[i].nullable = meta[pos] != 0
+		}
+		columns[i].typ = meta[testFlatField(t, meta, field, 2)]
+		if testFlatField(t, meta, field, 3) == 0 || testFlatField(t, meta, field, 5) == 0 {
+			t.Fatalf("expected the type and children of field %s", columns[i].name)
+		}
+	}
+
+	meta, batch, body := message(arrowHeaderRecordBatch)
+	rows := int64(le.Uint64(meta[testFlatField(t, meta, batch, 0):]))
+	nodes := testFlatRef(meta, testFlatField(t, meta, batch, 1))
+	buffers := testFlatRef(meta, testFlatField(t, meta, batch, 2))
+	if (nodes+4)%8 != 0 || (buffers+4)%8 != 0 {
+		t.Fatalf("expected the structs aligned, got nodes at %d and buffers at %d", nodes, buffers)
+	}
+	next := 0
+	for i := range columns {
+		node := nodes + 4 + 16*i
+		if length := int64(le.Uint64(meta[node:])); length != rows {
+			t.Errorf("expected %d values of %s, got %d", rows, columns[i].name, length)
+		}
+		columns[i].nulls = int64(le.Uint64(meta[node+8:]))
+		count := 2
+		if columns[i].typ == arrowTypeUtf8 {
+			count = 3
+		}
+		for j := 0; j < count; j++ {
+			buffer := buffers + 4 + 16*next
+			offset, length := le.Uint64(meta[buffer:]), le.Uint64(meta[buffer+8:])
+			if offset%8 != 0 {
+				t.Errorf("buffer %d at %d is not aligned", next, offset)
+			}
+			columns[i].buffers = append(columns[i].buffers, body[offset:offset+length])
+			next++
+		}
+	}
+	if n := le.Uint32(meta[buffers:]); int(n) != next {
+		t.Errorf("expected %d buffers, got %d", next, n)
+	}
+
+	if len(data) != 8 || le.Uint32(data) != arrowContinuation || le.Uint32(data[4:]) != 0 {
+		t.Errorf("expected the end of stream, got %x", data)
+	}
+	return rows, columns
+}
+
+func TestHTTPBatchArrowStream(t *testing.T) {
+	s := newHTTPServer(t)
+	d := openTestHTTPDatabase(t, strings.TrimPrefix(s.URL, "http://"))
+	d.insertFormat = insertFormatArrow
+
+	b, err := d.Batch(context.Background(), "INSERT INTO telegraf.metrics(name,val,ts,used,note) VALUES(?,?,?,?,?)")
+	if err != nil {
+		t.Fatalf("batch: %v", err)
+	}
+	ts := time.Unix(1600000000, 0)
+	if err := b.Append("cpu", 1.5, ts, int64(-3), nil); err != nil {
+		t.Fatalf("append: %v", err)
+	}
+	if err := b.Append("mem", math.NaN(), ts.Add(time.Second), int64(1024), "low"); err != nil {
+		t.Fatalf("append: %v", err)
+	}
+	if err := b.Append("disk", "high", ts, int64(1), nil); err == nil {
+		t.Error("expected a string into the float column to fail")
+	}
+	if err := b.Send(); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+
+	r := s.requests[len(s.requests)-1]
+	if query := r.URL.Query().Get("query"); query != "INSERT INTO telegraf.metrics(name,val,ts,used,note) FORMAT ArrowStream" {
+		t.Errorf("unexpected query %q", query)
+	}
+	rows, columns := readArrowStream(t, []byte(s.bodies[len(s.bodies)-1]))
+	if rows != 2 || len(columns) != 5 {
+		t.Fatalf("expected 2 rows of 5 columns, got %d rows of %d", rows, len(columns))
+	}
+
+	le := binary.LittleEndian
+	for i, expected := range []struct {
+		name string
+		typ  byte
+	}{
+		{"name", arrowTypeUtf8}, {"val", arrowTypeFloatingPoint}, {"ts", arrowTypeTimestamp},
+		{"used", arrowTypeInt}, {"note", arrowTypeUtf8},
+	} {
+		col := columns[i]
+		if col.name != expected.name || col.typ != expected.typ {
+			t.Errorf("expected column %s of type %d, got %s of %d", expected.name, expected.typ, col.name, col.typ)
+		}
+		if col.nullable != (col.name == "note") {
+			t.Errorf("expected only note nullable, got %s nullable %v", col.name, col.nullable)
+		}
+	}
+	if name := columns[0]; string(name.buffers[2]) != "cpumem" || le.Uint32(name.buffers[1][4:]) != 3 {
+		t.Errorf("expected the names cpu and mem, got %q", name.buffers[2])
+	}
+	if val := columns[1].buffers[1]; math.Float64frombits(le.Uint64(val)) != 1.5 || !math.IsNaN(math.Float64frombits(le.Uint64(val[8:]))) {
+		t.Errorf("expected 1.5 and NaN, got %x", val)
+	}
+	if ts := columns[2].buffers[1]; le.Uint64(ts) != 1600000000 || le.Uint64(ts[8:]) != 1600000001 {
+		t.Errorf("expected the times in seconds, got %x", ts)
+	}
+	if used := columns[3].buffers[1]; int64(le.Uint64(used)) != -3 || le.Uint64(used[8:]) != 1024 {
+		t.Errorf("expected -3 and 1024, got %x", used)
+	}
+	note := columns[4]
+	if note.nulls != 1 || note.buffers[0][0] != 0x2 || string(note.buffers[2]) != "low" {
+		t.Errorf("expected a NULL and low, got %d NULLs of %x and %q", note.nulls, note.buffers[0], note.buffers[2])
+	}
+}
+
+func TestArrowValue(t *testing.T) {
+	ts := time.Unix(1600000000, 5000000)
+	for _, test := range []struct {
+		value    interface{}
+		typ      arrowType
+		expected interface{}
+	}{
+		{"cpu", arrowUtf8, "cpu"},
+		{uint32(7), arrowUInt32, uint64(7)},
+		{uint8(1), arrowUInt8, uint64(1)},
+		{true, arrowBool, uint64(1)},
+		{ts, arrowTimestamp(0), uint64(1600000000)},
+		{dateTime64{Time: ts, precision: 3}, arrowTimestamp(3), uint64(1600000000005)},
+		// no unit of centiseconds, sent in milliseconds
+		{dateTime64{Time: ts, precision: 2}, arrowTimestamp(3), uint64(1600000000005)},
+		{dateTime64{Time: ts, precision: 9}, arrowTimestamp(9), uint64(1600000000005000000)},
+	} {
+		typ, v, err := arrowValue(test.value)
+		if err != nil || typ != test.typ || v != test.expected {
+			t.Errorf("expected %v as %v %v, got %v %v (%v)", test.value, test.typ, test.expected, typ, v, err)
+		}
+	}
+	if _, _, err := arrowValue([]string{"a"}); err == nil {
+		t.Error("expected a slice to be unsupported")
+	}
+}
+
+func TestBuildDsnInsertFormat(t *testing.T) {
+	c := newClickhouse()
+	c.Hosts = []string{"a:8123"}
+	c.Protocol = "http"
+	c.InsertFormat = insertFormatArrow
+
+	dsn, err := buildDsn(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(dsn)
+	if u.Query().Get("insert_format") != "ArrowStream" {
+		t.Errorf("expected the insert format in %s", dsn)
+	}
+	d, err := openHTTPDatabase(dsn, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := d.(*httpDatabase); d.insertFormat != insertFormatArrow || d.params.Get("insert_format") != "" {
+		t.Errorf("expected the insert format not sent as a setting, got %v", d.params)
+	}
+
+	c.Protocol = "native"
+	if _, err := buildDsn(c); err == nil {
+		t.Error("expected ArrowStream over the native protocol to fail")
+	}
+	c.Protocol = "http"
+	c.InsertFormat = "Parquet"
+	if _, err := buildDsn(c); err == nil {
+		t.Error("expected an unknown insert format to fail")
+	}
+}
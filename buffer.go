@@ -0,0 +1,41 @@
+package clickhouse
+
+import (
+	"fmt"
+	"time"
+)
+
+// table the rows of the metrics table are inserted into, its Buffer table
+// if enabled
+func (c *ClickhouseClient) bufferTable(table string) string {
+	if !c.UseBufferTable {
+		return table
+	}
+	return table + "_buffer"
+}
+
+// create the Buffer table in front of the metrics table, flushing into it
+// once all of the minimum or any of the maximum thresholds are reached.
+func (c *ClickhouseClient) createBufferTable(table string) error {
+	if !c.UseBufferTable {
+		return nil
+	}
+	buffer := c.bufferTable(table)
+	database, name := c.splitTable(table)
+	stmt := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s%s AS %s ENGINE=Buffer(%s,%s,%d,%d,%d,%d,%d,%d,%d)",
+		c.qualifiedTable(buffer), c.onCluster(), c.qualifiedTable(table),
+		quoteString(database), quoteString(name), c.BufferLayers,
+		int64(time.Duration(c.BufferMinTime).Seconds()), int64(time.Duration(c.BufferMaxTime).Seconds()),
+		c.BufferMinRows, c.BufferMaxRows, int64(c.BufferMinBytes), int64(c.BufferMaxBytes))
+	return c.execDDL(c.qualifiedTable(buffer), stmt)
+}
+
+// add col to the Buffer table of table, which the server flushes first
+func (c *ClickhouseClient) alterBufferTable(table string, col columnDef) error {
+	if !c.UseBufferTable {
+		return nil
+	}
+	buffer := c.bufferTable(table)
+	stmt := fmt.Sprintf("ALTER TABLE %s%s ADD COLUMN IF NOT EXISTS %s", c.qualifiedTable(buffer), c.onCluster(), c.columnDDL(col))
+	return c.execDDL(c.qualifiedTable(buffer), stmt)
+}
@@ -0,0 +1,149 @@
+package clickhouse
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/influxdata/telegraf"
+)
+
+// number of hashes kept by a cardinality sketch
+const sketchSize = 256
+
+// k-minimum-values sketch estimating the number of distinct hashes added
+type cardinalitySketch struct {
+	// the smallest distinct hashes seen, sorted ascending
+	mins []uint64
+}
+
+func (s *cardinalitySketch) add(hash uint64) {
+	i := sort.Search(len(s.mins), func(i int) bool { return s.mins[i] >= hash })
+	if i < len(s.mins) && s.mins[i] == hash {
+		return
+	}
+	if len(s.mins) == sketchSize {
+		if i == sketchSize {
+			return
+		}
+		s.mins = s.mins[:sketchSize-1]
+	}
+	s.mins = append(s.mins, 0)
+	copy(s.mins[i+1:], s.mins[i:])
+	s.mins[i] = hash
+}
+
+func (s *cardinalitySketch) estimate() uint64 {
+	if len(s.mins) < sketchSize {
+		return uint64(len(s.mins))
+	}
+	kth := float64(s.mins[sketchSize-1]) / math.MaxUint64
+	return uint64(float64(sketchSize-1) / kth)
+}
+
+type catalogKey struct {
+	measurement string
+	field       string
+}
+
+type catalogEntry struct {
+	lastSeen time.Time
+	series   cardinalitySketch
+	dirty    bool
+}
+
+// known measurements and fields with last-seen time and series cardinality
+type catalog struct {
+	entries   map[catalogKey]*catalogEntry
+	lastWrite time.Time
+}
+
+func newCatalog() *catalog {
+	return &catalog{
+		entries: make(map[catalogKey]*catalogEntry),
+	}
+}
+
+// update the catalog with the measurements and fields of metrics
+func (cat *catalog) observe(metrics []telegraf.Metric) {
+	for _, metric := range metrics {
+		series := metric.HashID()
+		for _, field := range metric.FieldList() {
+			key := catalogKey{measurement: metric.Name(), field: field.Key}
+			entry, ok := cat.entries[key]
+			if !ok {
+				entry = &catalogEntry{}
+				cat.entries[key] = entry
+			}
+			if metric.Time().After(entry.lastSeen) {
+				entry.lastSeen = metric.Time()
+			}
+			entry.series.add(series)
+			entry.dirty = true
+		}
+	}
+}
+
+// create the catalog table if it does not exist.
+func (c *ClickhouseClient) createCatalogTable() error {
+	stmt := fmt.Sprintf(`
+	CREATE TABLE IF NOT EXISTS %s.%s%s(
+		date Date DEFAULT toDate(updated),
+		host String,
+		measurement String,
+		field String,
+		last_seen DateTime,
+		series UInt64,
+		updated DateTime
+	) ENGINE=%s
+	`, c.Database, c.CatalogTable, c.onCluster(), c.replacingMergeTreeEngine("host,measurement,field", "updated"))
+
+	return c.execDDL(fmt.Sprintf("%s.%s", c.Database, c.CatalogTable), stmt)
+}
+
+// write the catalog entries changed since the last write, at most once per
+// catalog_interval. Failures are only logged and retried later.
+func (c *ClickhouseClient) writeCatalog() {
+	now := time.Now()
+	if now.Sub(c.catalog.lastWrite) < time.Duration(c.CatalogInterval) {
+		return
+	}
+
+	var rows [][]interface{}
+	for key, entry := range c.catalog.entries {
+		if entry.dirty {
+			rows = append(rows, []interface{}{
+				c.hostname,
+				key.measurement,
+				key.field,
+				entry.lastSeen,
+				entry.series.estimate(),
+				now,
+			})
+		}
+	}
+	if len(rows) == 0 {
+		return
+	}
+
+	if !c.catalogReady {
+		if err := c.createCatalogTable(); err != nil {
+			return
+		}
+		c.catalogReady = true
+	}
+
+	if err := c.insertRows(c.CatalogTable,
+		[]string{"host", "measurement", "field", "last_seen", "series", "updated"}, rows); err != nil {
+		c.catalogReady = false
+		log.Printf("E! [outputs.clickhouse] Unable to write catalog: %s", err.Error())
+		return
+	}
+
+	for _, entry := range c.catalog.entries {
+		entry.dirty = false
+	}
+	c.catalog.lastWrite = now
+}
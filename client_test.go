@@ -0,0 +1,1877 @@
+package clickhouse
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go"
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/config"
+	"github.com/influxdata/telegraf/metric"
+)
+
+// client connected to db
+func newTestClient(t *testing.T, db *mockDatabase, configure func(c *ClickhouseClient)) *ClickhouseClient {
+	c := newClickhouse()
+	c.Hosts = []string{"127.0.0.1:9000"}
+	c.Database = "telegraf"
+	c.TableName = "metrics"
+	c.openDatabase = func(string, string) (database, error) { return db, nil }
+	if configure != nil {
+		configure(c)
+	}
+
+	if err := c.Connect(); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func testBatch() []telegraf.Metric {
+	now := time.Unix(1600000000, 0)
+	return []telegraf.Metric{
+		metric.New("cpu",
+			map[string]string{"host": "a", "cpu": "cpu0"},
+			map[string]interface{}{"usage_idle": 99.5, "usage_user": 0.5},
+			now),
+		metric.New("mem",
+			map[string]string{"host": "a"},
+			map[string]interface{}{"used": int64(1024)},
+			now),
+	}
+}
+
+func TestWriteNarrow(t *testing.T) {
+	db := newMockDatabase()
+	c := newTestClient(t, db, nil)
+
+	if err := c.Write(testBatch()); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	if n := len(db.execsWithPrefix("CREATE DATABASE IF NOT EXISTS telegraf")); n != 1 {
+		t.Errorf("expected 1 CREATE DATABASE, got %d", n)
+	}
+	if n := len(db.execsWithPrefix("CREATE TABLE IF NOT EXISTS telegraf.metrics(")); n != 1 {
+		t.Errorf("expected 1 CREATE TABLE, got %d", n)
+	}
+
+	batches := db.sentBatches("telegraf.metrics")
+	if len(batches) != 1 {
+		t.Fatalf("expected 1 batch, got %d", len(batches))
+	}
+	if !strings.HasPrefix(batches[0].query, "INSERT INTO telegraf.metrics(name,tags,val,ts) VALUES(") {
+		t.Errorf("unexpected insert %q", batches[0].query)
+	}
+	if len(batches[0].rows) != 3 {
+		t.Fatalf("expected 3 rows, got %d", len(batches[0].rows))
+	}
+
+	// the fields of a metric are not ordered, find the row by name
+	var row []interface{}
+	for _, r := range batches[0].rows {
+		if r[0] == "cpu_usage_idle" {
+			row = r
+		}
+	}
+	if row == nil || row[1] != `{"cpu":"cpu0","host":"a"}` || row[2] != 99.5 {
+		t.Errorf("unexpected rows %v", batches[0].rows)
+	}
+}
+
+func TestWriteCreatesSchemaOnce(t *testing.T) {
+	db := newMockDatabase()
+	c := newTestClient(t, db, nil)
+
+	for i := 0; i < 3; i++ {
+		if err := c.Write(testBatch()); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+
+	if n := len(db.execsWithPrefix("CREATE TABLE")); n != 1 {
+		t.Errorf("expected 1 CREATE TABLE, got %d", n)
+	}
+	if n := len(db.sentBatches("telegraf.metrics")); n != 3 {
+		t.Errorf("expected 3 batches, got %d", n)
+	}
+}
+
+func TestWriteRecreatesSchemaAfterFailedInsert(t *testing.T) {
+	db := newMockDatabase()
+	c := newTestClient(t, db, nil)
+
+	db.sendErr = errors.New("table dropped")
+	if err := c.Write(testBatch()); err == nil {
+		t.Fatal("expected write to fail")
+	}
+
+	db.sendErr = nil
+	if err := c.Write(testBatch()); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if n := len(db.execsWithPrefix("CREATE TABLE")); n != 2 {
+		t.Errorf("expected 2 CREATE TABLE, got %d", n)
+	}
+}
+
+func TestWriteWithoutCreateDatabase(t *testing.T) {
+	db := newMockDatabase()
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.CreateDatabase = false
+	})
+
+	if err := c.Write(testBatch()); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if n := len(db.execsWithPrefix("CREATE DATABASE")); n != 0 {
+		t.Errorf("expected no CREATE DATABASE, got %d", n)
+	}
+	if n := len(db.execsWithPrefix("CREATE TABLE IF NOT EXISTS telegraf.metrics(")); n != 1 {
+		t.Errorf("expected 1 CREATE TABLE, got %d", n)
+	}
+}
+
+func TestWriteWithoutCreateSchema(t *testing.T) {
+	db := newMockDatabase()
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.CreateSchema = false
+		c.TTL = "ts + INTERVAL 30 DAY"
+	})
+
+	if err := c.Write(testBatch()); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if ddl := append(db.execsWithPrefix("CREATE"), db.execsWithPrefix("ALTER")...); len(ddl) != 0 {
+		t.Errorf("expected no DDL, got %q", ddl)
+	}
+	if n := len(db.sentBatches("telegraf.metrics")); n != 1 {
+		t.Errorf("expected 1 batch, got %d", n)
+	}
+}
+
+func TestWriteFallsBackOnIncompatibleSchema(t *testing.T) {
+	db := newMockDatabase()
+	db.results["table = 'metrics'"] = [][]interface{}{
+		{"name", "String"}, {"tags", "String"}, {"val", "Float32"}, {"ts", "DateTime"},
+	}
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.SchemaFallback = true
+	})
+
+	if err := c.Write(testBatch()); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	if n := len(db.execsWithPrefix("CREATE TABLE IF NOT EXISTS telegraf.metrics_v2(")); n != 1 {
+		t.Errorf("expected successor table created, got %d", n)
+	}
+	if n := len(db.sentBatches("telegraf.metrics_v2")); n != 1 {
+		t.Errorf("expected 1 batch into the successor table, got %d", n)
+	}
+	if n := len(db.sentBatches("telegraf.metrics")); n != 0 {
+		t.Errorf("expected no batch into the incompatible table, got %d", n)
+	}
+
+	// a reconnect resolves the table from tablename again
+	c.Close()
+	if err := c.Connect(); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	if err := c.Write(testBatch()); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if c.TableName != "metrics" || c.metricsTable() != "metrics_v2" {
+		t.Errorf("expected tablename kept and metrics_v2 resolved again, got %s and %s", c.TableName, c.metricsTable())
+	}
+	if n := len(db.execsWithPrefix("CREATE TABLE IF NOT EXISTS telegraf.metrics_v3(")); n != 0 {
+		t.Errorf("expected no further successor table, got %d", n)
+	}
+}
+
+// run with -race: the background tasks read the table the fallback
+// switches
+func TestWriteFallbackAlongsidePartsCheck(t *testing.T) {
+	db := newMockDatabase()
+	db.results["table = 'metrics'"] = [][]interface{}{
+		{"name", "String"}, {"tags", "String"}, {"val", "Float32"}, {"ts", "DateTime"},
+	}
+	db.results["parts_to_throw_insert"] = [][]interface{}{{uint64(300)}}
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.SchemaFallback = true
+		c.PartsCheckInterval = config.Duration(time.Millisecond)
+	})
+
+	// the tables the parts check, retention and purge go through, read
+	// without touching the database
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			c.managedTables()
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		// reconnected, the table is resolved again
+		c.schemaReady = false
+		if err := c.Write(testBatch()); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	<-done
+	if table := c.metricsTable(); table != "metrics_v2" {
+		t.Errorf("expected metrics_v2 written to, got %s", table)
+	}
+}
+
+func TestWriteAddsMissingColumnsBeforeFallback(t *testing.T) {
+	db := newMockDatabase()
+	db.results["table = 'metrics'"] = [][]interface{}{
+		{"name", "String"}, {"tags", "String"}, {"val", "Float64"}, {"ts", "DateTime"},
+	}
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.SchemaFallback = true
+	})
+
+	if err := c.Write(testBatch()); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	if alters := db.execsWithPrefix("ALTER TABLE telegraf.metrics ADD COLUMN IF NOT EXISTS date Date"); len(alters) != 1 {
+		t.Errorf("expected the missing date column added, got %q", db.execsWithPrefix("ALTER TABLE"))
+	}
+	if n := len(db.execsWithPrefix("CREATE TABLE IF NOT EXISTS telegraf.metrics_v2(")); n != 0 {
+		t.Errorf("expected no successor table, got %d", n)
+	}
+	if n := len(db.sentBatches("telegraf.metrics")); n != 1 {
+		t.Errorf("expected 1 batch into the completed table, got %d", n)
+	}
+}
+
+func TestWriteFallsBackOnDeniedMissingColumns(t *testing.T) {
+	db := newMockDatabase()
+	db.results["table = 'metrics'"] = [][]interface{}{
+		{"name", "String"}, {"tags", "String"}, {"val", "Float64"}, {"ts", "DateTime"},
+	}
+	db.execErrs["ALTER TABLE"] = &clickhouse.Exception{Code: accessDenied, Message: "Not enough privileges"}
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.SchemaFallback = true
+	})
+
+	if err := c.Write(testBatch()); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if c.metricsTable() != "metrics_v2" || c.TableName != "metrics" {
+		t.Errorf("expected the successor table without the missing columns and tablename kept, got %s and %s", c.metricsTable(), c.TableName)
+	}
+}
+
+func TestWritePingFailure(t *testing.T) {
+	db := newMockDatabase()
+	c := newTestClient(t, db, nil)
+
+	db.pingErr = errors.New("connection refused")
+	if err := c.Write(testBatch()); err != db.pingErr {
+		t.Fatalf("expected ping error, got %v", err)
+	}
+	if len(db.batches) != 0 {
+		t.Errorf("expected no batches, got %d", len(db.batches))
+	}
+}
+
+func TestWriteSplitsOversizedBatches(t *testing.T) {
+	db := newMockDatabase()
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.MaxInsertBytes = 50
+	})
+
+	if err := c.Write(testBatch()); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	batches := db.sentBatches("telegraf.metrics")
+	if len(batches) != 3 {
+		t.Fatalf("expected 3 batches, got %d", len(batches))
+	}
+	for _, b := range batches {
+		if len(b.rows) != 1 {
+			t.Errorf("expected 1 row per batch, got %d", len(b.rows))
+		}
+	}
+}
+
+func TestWriteRejectsOversizedBatches(t *testing.T) {
+	db := newMockDatabase()
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.MaxInsertBytes = 50
+		c.OversizePolicy = "reject"
+	})
+
+	if err := c.Write(testBatch()); err == nil {
+		t.Fatal("expected write to fail")
+	}
+	if len(db.batches) != 0 {
+		t.Errorf("expected no batches, got %d", len(db.batches))
+	}
+}
+
+func TestWriteSamplesRejectedRows(t *testing.T) {
+	db := newMockDatabase()
+	db.appendErr = func(values []interface{}) error {
+		if values[0] == "mem_used" {
+			return errors.New("bad value")
+		}
+		return nil
+	}
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.RejectedRows = true
+	})
+
+	if err := c.Write(testBatch()); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	if rows := db.sentBatches("telegraf.metrics")[0].rows; len(rows) != 2 {
+		t.Errorf("expected 2 accepted rows, got %d", len(rows))
+	}
+
+	rejected := db.sentBatches("telegraf.telegraf_errors")
+	if len(rejected) != 1 || len(rejected[0].rows) != 1 {
+		t.Fatalf("expected 1 rejected row, got %v", rejected)
+	}
+	if msg := rejected[0].rows[0][3]; msg != "bad value" {
+		t.Errorf("unexpected error %v", msg)
+	}
+}
+
+func TestWriteInsertOnlyWhenDDLDenied(t *testing.T) {
+	db := newMockDatabase()
+	db.execErrs["CREATE"] = &clickhouse.Exception{Code: accessDenied, Message: "Not enough privileges"}
+	c := newTestClient(t, db, nil)
+
+	for i := 0; i < 2; i++ {
+		if err := c.Write(testBatch()); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+
+	if n := len(db.execsWithPrefix("CREATE")); n != 1 {
+		t.Errorf("expected DDL to stop after the first denial, got %d statements", n)
+	}
+	if n := len(db.sentBatches("telegraf.metrics")); n != 2 {
+		t.Errorf("expected 2 batches, got %d", n)
+	}
+}
+
+func TestWritePausesOnQuotaExceeded(t *testing.T) {
+	db := newMockDatabase()
+	c := newTestClient(t, db, nil)
+
+	db.sendErr = &clickhouse.Exception{
+		Code:    quotaExceeded,
+		Message: "Quota for user `telegraf` for 3600s has been exceeded: inserts: 101/100.",
+	}
+	if err := c.Write(testBatch()); err == nil {
+		t.Fatal("expected write to fail")
+	}
+	if until := time.Until(c.quotaUntil); until < 59*time.Minute || until > time.Hour {
+		t.Errorf("expected writes paused for an hour, got %s", until)
+	}
+
+	db.sendErr = nil
+	batches := len(db.batches)
+	if err := c.Write(testBatch()); err == nil {
+		t.Fatal("expected write to be paused")
+	}
+	if len(db.batches) != batches {
+		t.Error("expected no insert while paused")
+	}
+}
+
+func TestWriteSeriesLayout(t *testing.T) {
+	db := newMockDatabase()
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.TableLayout = layoutSeries
+	})
+
+	for i := 0; i < 2; i++ {
+		if err := c.Write(testBatch()); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+
+	series := db.sentBatches("telegraf.series")
+	if len(series) != 1 || len(series[0].rows) != 3 {
+		t.Fatalf("expected 3 series written once, got %v", series)
+	}
+
+	samples := db.sentBatches("telegraf.metrics")
+	if len(samples) != 2 {
+		t.Fatalf("expected 2 sample batches, got %d", len(samples))
+	}
+	if samples[0].rows[0][0] != series[0].rows[0][0] {
+		t.Errorf("sample series_id %v does not reference series %v", samples[0].rows[0][0], series[0].rows[0][0])
+	}
+}
+
+func TestWriteWideLayout(t *testing.T) {
+	db := newMockDatabase()
+	// the table as it existed, without usage_user
+	db.results["system.columns"] = [][]interface{}{
+		{"name", "String"}, {"tags", "String"}, {"ts", "DateTime"},
+		{"usage_idle", "Float64"}, {"used", "Int64"},
+	}
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.TableLayout = layoutWide
+	})
+
+	for i := 0; i < 2; i++ {
+		if err := c.Write(testBatch()); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+
+	creates := db.execsWithPrefix("CREATE TABLE IF NOT EXISTS telegraf.metrics(")
+	if len(creates) != 1 || !strings.Contains(creates[0], "usage_idle Float64") || !strings.Contains(creates[0], "used Int64") || strings.Contains(creates[0], "val Float64") {
+		t.Errorf("expected a column per field in %q", creates)
+	}
+	alters := db.execsWithPrefix("ALTER TABLE telegraf.metrics ADD COLUMN IF NOT EXISTS")
+	if len(alters) != 1 || !strings.Contains(alters[0], "usage_user Float64") {
+		t.Errorf("expected the missing column added once, got %q", alters)
+	}
+
+	batches := db.sentBatches("telegraf.metrics")
+	if len(batches) != 2 {
+		t.Fatalf("expected 2 batches, got %d", len(batches))
+	}
+	if !strings.HasPrefix(batches[0].query, "INSERT INTO telegraf.metrics(name,tags,ts,usage_idle,usage_user,used) VALUES(") {
+		t.Errorf("unexpected insert %q", batches[0].query)
+	}
+	rows := batches[0].rows
+	if len(rows) != 2 {
+		t.Fatalf("expected a row per metric, got %d", len(rows))
+	}
+	if rows[0][0] != "cpu" || rows[0][3] != 99.5 || rows[0][4] != 0.5 || rows[0][5] != int64(0) {
+		t.Errorf("unexpected cpu row %v", rows[0])
+	}
+	if rows[1][0] != "mem" || rows[1][3] != float64(0) || rows[1][5] != int64(1024) {
+		t.Errorf("unexpected mem row %v", rows[1])
+	}
+}
+
+func TestWriteWideLayoutKeepsColumnNames(t *testing.T) {
+	db := newMockDatabase()
+	// a_b was named before a-b by an earlier run
+	db.results["system.columns"] = [][]interface{}{
+		{"name", "String"}, {"tags", "String"}, {"ts", "DateTime"}, {"a_b", "Float64"}, {"a_b_2", "Float64"},
+	}
+	db.results["SELECT name, comment FROM system.columns"] = [][]interface{}{
+		{"a_b", fieldComment("a_b")}, {"a_b_2", fieldComment("a-b")},
+	}
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.TableLayout = layoutWide
+	})
+
+	batch := []telegraf.Metric{metric.New("m", nil, map[string]interface{}{"a-b": 1.0, "a_b": 2.0}, time.Unix(1600000000, 0))}
+	if err := c.Write(batch); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	batches := db.sentBatches("telegraf.metrics")
+	if len(batches) != 1 || !strings.HasPrefix(batches[0].query, "INSERT INTO telegraf.metrics(name,tags,ts,a_b,a_b_2)") {
+		t.Fatalf("unexpected inserts %v", batches)
+	}
+	if row := batches[0].rows[0]; row[3] != 2.0 || row[4] != 1.0 {
+		t.Errorf("expected a_b in a_b and a-b in a_b_2, got %v", row)
+	}
+	if alters := db.execsWithPrefix("ALTER TABLE"); len(alters) != 0 {
+		t.Errorf("expected the existing columns used, got %q", alters)
+	}
+}
+
+func TestWriteWideLayoutNullableFields(t *testing.T) {
+	db := newMockDatabase()
+	db.results["system.columns"] = [][]interface{}{{"name", "String"}, {"tags", "String"}, {"ts", "DateTime"}}
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.TableLayout = layoutWide
+		c.NullableFields = true
+	})
+	if err := c.Write(testBatch()); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	alters := strings.Join(db.execsWithPrefix("ALTER TABLE telegraf.metrics ADD COLUMN IF NOT EXISTS"), "\n")
+	if !strings.Contains(alters, "usage_idle Nullable(Float64)") || !strings.Contains(alters, "used Nullable(Int64)") {
+		t.Errorf("expected Nullable field columns, got %q", alters)
+	}
+	batches := db.sentBatches("telegraf.metrics")
+	if len(batches) != 1 || len(batches[0].rows) != 2 {
+		t.Fatalf("expected 1 batch of 2 rows, got %d batches", len(batches))
+	}
+	rows := batches[0].rows
+	if rows[0][3] != 99.5 || rows[0][5] != nil {
+		t.Errorf("expected NULL for the missing used field, got %v", rows[0])
+	}
+	if rows[1][3] != nil || rows[1][5] != int64(1024) {
+		t.Errorf("expected NULL for the missing usage_idle field, got %v", rows[1])
+	}
+}
+
+func TestWideValueKeepsIntegers(t *testing.T) {
+	for _, test := range []struct {
+		value    interface{}
+		typ      string
+		expected interface{}
+		ok       bool
+	}{
+		{int64(1<<62 + 1), "UInt64", uint64(1<<62 + 1), true},
+		{int64(-1), "UInt64", uint64(0), false},
+		{uint64(1<<62 + 1), "Int64", int64(1<<62 + 1), true},
+		{uint64(1 << 63), "Int64", int64(0), false},
+		{1.5, "Int64", int64(0), false},
+		{2.0, "Int64", int64(2), true},
+		{1e19, "Int64", int64(0), false},
+		{-1.0, "UInt64", uint64(0), false},
+		{true, "UInt8", int64(1), true},
+		{255.0, "UInt8", int64(255), true},
+		{256.0, "UInt8", int64(0), false},
+		{"high", "Float64", float64(0), false},
+		{nil, "Float64", float64(0), true},
+		{1.5, "String", "", false},
+	} {
+		if v, ok := wideValue(test.value, test.typ); v != test.expected || ok != test.ok {
+			t.Errorf("expected %v as %s to be %v (%v), got %v (%v)", test.value, test.typ, test.expected, test.ok, v, ok)
+		}
+	}
+}
+
+func TestWriteWideLayoutRejectsMismatch(t *testing.T) {
+	db := newMockDatabase()
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.TableLayout = layoutWide
+	})
+	now := time.Unix(1600000000, 0)
+	batch := []telegraf.Metric{
+		metric.New("cpu", map[string]string{"host": "a"}, map[string]interface{}{"state": 1.5}, now),
+		metric.New("cpu", map[string]string{"host": "b"}, map[string]interface{}{"state": "high"}, now),
+	}
+	if err := c.Write(batch); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	batches := db.sentBatches("telegraf.metrics")
+	if len(batches) != 1 || len(batches[0].rows) != 1 {
+		t.Fatalf("expected 1 batch of 1 row, got %d batches", len(batches))
+	}
+	if row := batches[0].rows[0]; row[1] != `{"host":"a"}` || row[3] != 1.5 {
+		t.Errorf("expected the row of the converting metric, got %v", row)
+	}
+}
+
+func TestWideFieldsPerTable(t *testing.T) {
+	db := newMockDatabase()
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.TableLayout = layoutWide
+		c.TablePerMeasurement = true
+	})
+	now := time.Unix(1600000000, 0)
+	batch := []telegraf.Metric{
+		metric.New("cpu", nil, map[string]interface{}{"value": 1.5}, now),
+		metric.New("state", nil, map[string]interface{}{"value": "up"}, now),
+	}
+	if err := c.Write(batch); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	if cpu := db.execsWithPrefix("CREATE TABLE IF NOT EXISTS telegraf.cpu("); len(cpu) != 1 || !strings.Contains(cpu[0], "value Float64") {
+		t.Errorf("expected a Float64 value column in %q", cpu)
+	}
+	if state := db.execsWithPrefix("CREATE TABLE IF NOT EXISTS telegraf.state("); len(state) != 1 || !strings.Contains(state[0], "value String") {
+		t.Errorf("expected a String value column in %q", state)
+	}
+	batches := db.sentBatches("telegraf.state")
+	if len(batches) != 1 || len(batches[0].rows) != 1 || batches[0].rows[0][3] != "up" {
+		t.Errorf("expected the state written as is, got %d batches", len(batches))
+	}
+}
+
+func TestWriteWideLayoutInsertOnly(t *testing.T) {
+	db := newMockDatabase()
+	db.results["system.columns"] = [][]interface{}{
+		{"name", "String"}, {"tags", "String"}, {"ts", "DateTime"}, {"usage_idle", "Float64"},
+	}
+	db.execErrs["CREATE DATABASE"] = &clickhouse.Exception{Code: accessDenied, Message: "Not enough privileges"}
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.TableLayout = layoutWide
+	})
+
+	if err := c.Write(testBatch()); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	batches := db.sentBatches("telegraf.metrics")
+	if len(batches) != 1 || !strings.HasPrefix(batches[0].query, "INSERT INTO telegraf.metrics(name,tags,ts,usage_idle) VALUES(") {
+		t.Errorf("expected the fields without a column dropped, got %d batches", len(batches))
+	}
+}
+
+func TestWriteTablePerMeasurement(t *testing.T) {
+	db := newMockDatabase()
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.TablePerMeasurement = true
+	})
+
+	for i := 0; i < 2; i++ {
+		if err := c.Write(testBatch()); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+
+	if n := len(db.execsWithPrefix("CREATE TABLE IF NOT EXISTS telegraf.metrics(")); n != 0 {
+		t.Errorf("expected no metrics table, got %d", n)
+	}
+	for table, rows := range map[string]int{"cpu": 2, "mem": 1} {
+		if n := len(db.execsWithPrefix("CREATE TABLE IF NOT EXISTS telegraf." + table + "(")); n != 1 {
+			t.Errorf("expected table %s created once, got %d", table, n)
+		}
+		batches := db.sentBatches("telegraf." + table)
+		if len(batches) != 2 || len(batches[0].rows) != rows {
+			t.Errorf("expected 2 batches of %d rows into %s, got %d", rows, table, len(batches))
+		}
+	}
+}
+
+func TestWideTablePerMeasurement(t *testing.T) {
+	db := newMockDatabase()
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.TableLayout = layoutWide
+		c.TablePerMeasurement = true
+	})
+
+	if err := c.Write(testBatch()); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	cpu := db.execsWithPrefix("CREATE TABLE IF NOT EXISTS telegraf.cpu(")
+	if len(cpu) != 1 || !strings.Contains(cpu[0], "usage_idle Float64") || strings.Contains(cpu[0], "used Int64") {
+		t.Errorf("expected only the cpu fields in %q", cpu)
+	}
+	mem := db.execsWithPrefix("CREATE TABLE IF NOT EXISTS telegraf.mem(")
+	if len(mem) != 1 || !strings.Contains(mem[0], "used Int64") || strings.Contains(mem[0], "usage_idle") {
+		t.Errorf("expected only the mem fields in %q", mem)
+	}
+}
+
+func TestWriteMapTags(t *testing.T) {
+	db := newMockDatabase()
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.TagsFormat = tagsMap
+	})
+
+	if err := c.Write(testBatch()); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	creates := db.execsWithPrefix("CREATE TABLE IF NOT EXISTS telegraf.metrics(")
+	if len(creates) != 1 || !strings.Contains(creates[0], "tags_json String EPHEMERAL") ||
+		!strings.Contains(creates[0], "tags Map(String, String) DEFAULT") || !strings.Contains(creates[0], "ORDER BY (name,ts)") {
+		t.Errorf("expected a map of the tags in %q", creates)
+	}
+	batches := db.sentBatches("telegraf.metrics")
+	if len(batches) != 1 {
+		t.Fatalf("expected 1 batch, got %d", len(batches))
+	}
+	if !strings.HasPrefix(batches[0].query, "INSERT INTO telegraf.metrics(name,tags_json,val,ts)") {
+		t.Errorf("expected the tags inserted as JSON, got %q", batches[0].query)
+	}
+	if row := batches[0].rows[0]; row[1] != `{"cpu":"cpu0","host":"a"}` {
+		t.Errorf("unexpected row %v", row)
+	}
+}
+
+func TestWriteMapTagsNeedsEphemeralColumns(t *testing.T) {
+	db := newMockDatabase()
+	db.results["SELECT version()"] = [][]interface{}{{"21.8.15.7"}}
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.TagsFormat = tagsMap
+	})
+
+	if err := c.Write(testBatch()); err == nil || !strings.Contains(err.Error(), "22.4") {
+		t.Errorf("expected the server version to be rejected, got %v", err)
+	}
+}
+
+func TestWriteMapTagsNeedsMapType(t *testing.T) {
+	db := newMockDatabase()
+	db.results["SELECT version()"] = [][]interface{}{{"21.3.20.1"}}
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.TagsFormat = tagsMap
+	})
+
+	if err := c.Write(testBatch()); err == nil || !strings.Contains(err.Error(), "Map type") {
+		t.Errorf("expected the missing Map type to be rejected, got %v", err)
+	}
+}
+
+func TestWriteJSONTypeTags(t *testing.T) {
+	db := newMockDatabase()
+	db.results["SELECT version()"] = [][]interface{}{{"25.3.2.39"}}
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.TagsFormat = tagsJSONType
+	})
+
+	if err := c.Write(testBatch()); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	creates := db.execsWithPrefix("CREATE TABLE IF NOT EXISTS telegraf.metrics(")
+	if len(creates) != 1 || !strings.Contains(creates[0], "tags_json String EPHEMERAL") ||
+		!strings.Contains(creates[0], "tags JSON DEFAULT CAST(tags_json, 'JSON')") || !strings.Contains(creates[0], "ORDER BY (name,ts)") {
+		t.Errorf("expected a JSON column of the tags in %q", creates)
+	}
+	batches := db.sentBatches("telegraf.metrics")
+	if len(batches) != 1 {
+		t.Fatalf("expected 1 batch, got %d", len(batches))
+	}
+	if !strings.HasPrefix(batches[0].query, "INSERT INTO telegraf.metrics(name,tags_json,val,ts)") {
+		t.Errorf("expected the tags inserted as JSON, got %q", batches[0].query)
+	}
+	if expr := c.tagExpr("host"); expr != "CAST(tags.`host`, 'String')" {
+		t.Errorf("unexpected tag expression %s", expr)
+	}
+}
+
+func TestWriteJSONTypeTagsNeedsJSONType(t *testing.T) {
+	db := newMockDatabase()
+	db.results["SELECT version()"] = [][]interface{}{{"24.8.4.13"}}
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.TagsFormat = tagsJSONType
+	})
+
+	if err := c.Write(testBatch()); err == nil || !strings.Contains(err.Error(), "25.3") {
+		t.Errorf("expected the server version to be rejected, got %v", err)
+	}
+}
+
+func TestWriteNestedTags(t *testing.T) {
+	db := newMockDatabase()
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.TagsFormat = tagsNested
+	})
+
+	if err := c.Write(testBatch()); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	creates := db.execsWithPrefix("CREATE TABLE IF NOT EXISTS telegraf.metrics(")
+	if len(creates) != 1 || !strings.Contains(creates[0], "tags_json String EPHEMERAL") ||
+		!strings.Contains(creates[0], "tags.key Array(String) DEFAULT arrayMap(t -> t.1, JSONExtractKeysAndValues(tags_json, 'String'))") ||
+		!strings.Contains(creates[0], "tags.value Array(String) DEFAULT arrayMap(t -> t.2, JSONExtractKeysAndValues(tags_json, 'String'))") ||
+		!strings.Contains(creates[0], "ORDER BY (name,tags.key,tags.value,ts)") {
+		t.Errorf("expected the key and value arrays of the tags in %q", creates)
+	}
+	batches := db.sentBatches("telegraf.metrics")
+	if len(batches) != 1 {
+		t.Fatalf("expected 1 batch, got %d", len(batches))
+	}
+	if !strings.HasPrefix(batches[0].query, "INSERT INTO telegraf.metrics(name,tags_json,val,ts)") {
+		t.Errorf("expected the tags inserted as JSON, got %q", batches[0].query)
+	}
+	if expr := c.tagExpr("host"); expr != "tags.value[indexOf(tags.key, 'host')]" {
+		t.Errorf("unexpected tag expression %s", expr)
+	}
+}
+
+func TestWriteColumnCodecs(t *testing.T) {
+	db := newMockDatabase()
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.ColumnCodecs = map[string]string{"ts": "DoubleDelta, ZSTD", "val": "Gorilla", "tags": "ZSTD(3)"}
+		c.EncryptColumns = []string{"tags"}
+	})
+	if err := c.Write(testBatch()); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	creates := db.execsWithPrefix("CREATE TABLE IF NOT EXISTS telegraf.metrics(")
+	if len(creates) != 1 {
+		t.Fatalf("expected 1 CREATE TABLE, got %q", creates)
+	}
+	for _, expected := range []string{
+		"ts DateTime CODEC(DoubleDelta, ZSTD)",
+		"val Float64 CODEC(Gorilla)",
+		"tags String CODEC(ZSTD(3), AES_128_GCM_SIV)",
+		"name String,",
+	} {
+		if !strings.Contains(creates[0], expected) {
+			t.Errorf("expected %s in %s", expected, creates[0])
+		}
+	}
+}
+
+func TestColumnDDLEncrypted(t *testing.T) {
+	c := newClickhouse()
+	c.ColumnCodecs = map[string]string{"tags": "ZSTD(3)", "val": "Gorilla"}
+	c.EncryptColumns = []string{"tags", "host"}
+
+	tests := []struct {
+		col      columnDef
+		codec    string
+		expected string
+	}{
+		// encrypted with a column_codecs entry, compressed before encrypting
+		{columnDef{name: "tags", typ: "String"}, "AES_128_GCM_SIV",
+			"tags String CODEC(ZSTD(3), AES_128_GCM_SIV)"},
+		// encrypted without one
+		{columnDef{name: "host", typ: "LowCardinality(String)", defaultExpr: "''", comment: "agent"}, "AES_128_GCM_SIV",
+			"host LowCardinality(String) DEFAULT '' COMMENT 'agent' CODEC(AES_128_GCM_SIV)"},
+		{columnDef{name: "tags", typ: "String"}, "AES_256_GCM_SIV",
+			"tags String CODEC(ZSTD(3), AES_256_GCM_SIV)"},
+		// not encrypted
+		{columnDef{name: "val", typ: "Float64"}, "AES_128_GCM_SIV",
+			"val Float64 CODEC(Gorilla)"},
+		{columnDef{name: "name", typ: "String"}, "AES_128_GCM_SIV",
+			"name String"},
+	}
+	for _, test := range tests {
+		c.EncryptionCodec = test.codec
+		if ddl := c.columnDDL(test.col); ddl != test.expected {
+			t.Errorf("expected %q, got %q", test.expected, ddl)
+		}
+	}
+
+	// every column encrypted
+	c.EncryptColumns = []string{"*"}
+	c.EncryptionCodec = "AES_128_GCM_SIV"
+	if ddl := c.columnDDL(columnDef{name: "name", typ: "String"}); ddl != "name String CODEC(AES_128_GCM_SIV)" {
+		t.Errorf("expected name encrypted, got %q", ddl)
+	}
+}
+
+func TestWriteIdentifierReplacement(t *testing.T) {
+	db := newMockDatabase()
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.TablePerMeasurement = true
+		c.IdentifierReplacement = "0"
+	})
+	batch := []telegraf.Metric{metric.New("snmp.if-table", map[string]string{"host": "a"},
+		map[string]interface{}{"in": 1.0}, time.Unix(1600000000, 0))}
+	if err := c.Write(batch); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	if creates := db.execsWithPrefix("CREATE TABLE IF NOT EXISTS telegraf.snmp0if0table("); len(creates) != 1 {
+		t.Errorf("expected the dot and dash of the measurement replaced, got %q", db.execsWithPrefix("CREATE TABLE"))
+	}
+
+	c = newClickhouse()
+	c.IdentifierReplacement = "-"
+	if err := c.Connect(); err == nil || !strings.Contains(err.Error(), "identifier_replacement") {
+		t.Errorf("expected the replacement to be rejected, got %v", err)
+	}
+}
+
+func TestWriteBufferTable(t *testing.T) {
+	db := newMockDatabase()
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.UseBufferTable = true
+		c.TableLayout = layoutWide
+	})
+	if err := c.Write(testBatch()); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	creates := db.execsWithPrefix("CREATE TABLE IF NOT EXISTS telegraf.metrics_buffer AS telegraf.metrics ")
+	if len(creates) != 1 || !strings.HasSuffix(creates[0], "ENGINE=Buffer('telegraf','metrics',16,10,100,10000,1000000,10485760,104857600)") {
+		t.Errorf("expected a Buffer table in front of the metrics table, got %q", db.execsWithPrefix("CREATE TABLE"))
+	}
+	if alters := db.execsWithPrefix("ALTER TABLE telegraf.metrics_buffer ADD COLUMN IF NOT EXISTS usage_idle"); len(alters) != 1 {
+		t.Errorf("expected the field columns added to the Buffer table, got %q", db.execsWithPrefix("ALTER TABLE"))
+	}
+	if batches := db.sentBatches("telegraf.metrics_buffer"); len(batches) != 1 {
+		t.Errorf("expected the rows inserted into the Buffer table, got %d batches", len(batches))
+	}
+	if batches := db.sentBatches("telegraf.metrics"); len(batches) != 0 {
+		t.Errorf("expected no rows inserted into the metrics table, got %d batches", len(batches))
+	}
+}
+
+func TestWriteRollup(t *testing.T) {
+	db := newMockDatabase()
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.Rollup = []*rollup{{Table: "metrics_1m", Interval: config.Duration(time.Minute)}}
+	})
+	if err := c.Write(testBatch()); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	creates := db.execsWithPrefix("CREATE TABLE IF NOT EXISTS telegraf.metrics_1m(")
+	if len(creates) != 1 || !strings.Contains(creates[0], "avg AggregateFunction(avg, Float64)") ||
+		!strings.Contains(creates[0], "ENGINE=AggregatingMergeTree PARTITION BY toYYYYMM(date) ORDER BY (name,tags,ts)") {
+		t.Errorf("expected an AggregatingMergeTree rollup table, got %q", creates)
+	}
+	views := db.execsWithPrefix("CREATE MATERIALIZED VIEW IF NOT EXISTS telegraf.metrics_1m_mv TO telegraf.metrics_1m AS SELECT name,tags, " +
+		"toStartOfInterval(m.ts, INTERVAL 60 SECOND) AS ts")
+	if len(views) != 1 || !strings.HasSuffix(views[0], "FROM telegraf.metrics AS m WHERE isFinite(val) GROUP BY name,tags, ts") {
+		t.Errorf("expected a materialized view over the metrics table, got %q", db.execsWithPrefix("CREATE MATERIALIZED VIEW"))
+	}
+}
+
+func TestConnectRollupNeedsNarrowLayout(t *testing.T) {
+	c := newClickhouse()
+	c.TableLayout = layoutWide
+	c.Rollup = []*rollup{{Table: "metrics_1m", Interval: config.Duration(time.Minute)}}
+	if err := c.Connect(); err == nil || !strings.Contains(err.Error(), "narrow layout") {
+		t.Errorf("expected rollups of the wide layout to be rejected, got %v", err)
+	}
+}
+
+func TestWriteGraphite(t *testing.T) {
+	db := newMockDatabase()
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.TableLayout = layoutGraphite
+	})
+	batch := append(testBatch(), metric.New("system", map[string]string{"host": "a"},
+		map[string]interface{}{"uptime_format": "1 day"}, time.Unix(1600000000, 0)))
+	if err := c.Write(batch); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	creates := db.execsWithPrefix("CREATE TABLE IF NOT EXISTS telegraf.metrics(")
+	if len(creates) != 1 || !strings.Contains(creates[0], "Date Date DEFAULT toDate(toDateTime(Time))") ||
+		!strings.Contains(creates[0], "ENGINE=GraphiteMergeTree('graphite_rollup') PARTITION BY toYYYYMM(Date) ORDER BY (Path, Time)") {
+		t.Errorf("expected a GraphiteMergeTree table, got %q", creates)
+	}
+	batches := db.sentBatches("telegraf.metrics")
+	if len(batches) != 1 {
+		t.Fatalf("expected 1 batch, got %d", len(batches))
+	}
+	if !strings.HasPrefix(batches[0].query, "INSERT INTO telegraf.metrics(Path,Value,Time,Timestamp)") {
+		t.Errorf("expected the graphite columns inserted, got %q", batches[0].query)
+	}
+	var paths []string
+	for _, row := range batches[0].rows {
+		paths = append(paths, row[0].(string))
+		if row[2] != uint32(1600000000) {
+			t.Errorf("unexpected time of %v", row)
+		}
+	}
+	// the fields of a metric are not ordered
+	sort.Strings(paths)
+	expected := []string{"a.cpu0.cpu.usage_idle", "a.cpu0.cpu.usage_user", "a.mem.used"}
+	if strings.Join(paths, " ") != strings.Join(expected, " ") {
+		t.Errorf("expected paths %v without the string field, got %v", expected, paths)
+	}
+}
+
+func TestWriteSchemaCheck(t *testing.T) {
+	for check, fails := range map[string]bool{"off": false, "warn": false, "fail": true} {
+		db := newMockDatabase()
+		db.results["system.columns"] = [][]interface{}{{"name", "String"}, {"tags", "String"}, {"val", "Float32"}, {"ts", "DateTime"}}
+		c := newTestClient(t, db, func(c *ClickhouseClient) {
+			c.SchemaCheck = check
+		})
+
+		err := c.Write(testBatch())
+		if !fails {
+			if err != nil {
+				t.Errorf("%s: write: %v", check, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), "missing column date") || !strings.Contains(err.Error(), "column val is Float32 instead of Float64") {
+			t.Errorf("%s: expected the differences of the table, got %v", check, err)
+		}
+		if batches := db.sentBatches("telegraf.metrics"); len(batches) != 0 {
+			t.Errorf("%s: expected no inserts into the incompatible table, got %d", check, len(batches))
+		}
+	}
+}
+
+func TestWriteTableNameTemplate(t *testing.T) {
+	db := newMockDatabase()
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.TableName = `{{ .Tag "service" }}_{{ .Name }}`
+	})
+	now := time.Unix(1600000000, 0)
+	batch := []telegraf.Metric{
+		metric.New("http", map[string]string{"service": "api"}, map[string]interface{}{"latency": 1.5}, now),
+		metric.New("http", map[string]string{"service": "web-ui"}, map[string]interface{}{"latency": 2.5}, now),
+		metric.New("http", map[string]string{"service": "api"}, map[string]interface{}{"latency": 3.5}, now),
+	}
+	if err := c.Write(batch); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	for table, rows := range map[string]int{"api_http": 2, "web_ui_http": 1} {
+		if creates := db.execsWithPrefix("CREATE TABLE IF NOT EXISTS telegraf." + table + "("); len(creates) != 1 {
+			t.Errorf("expected %s created, got %q", table, db.execsWithPrefix("CREATE TABLE"))
+		}
+		batches := db.sentBatches("telegraf." + table)
+		if len(batches) != 1 || len(batches[0].rows) != rows {
+			t.Errorf("expected 1 batch of %d rows into %s, got %d batches", rows, table, len(batches))
+		}
+	}
+}
+
+func TestWriteDatabaseTag(t *testing.T) {
+	db := newMockDatabase()
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.DatabaseTag = "tenant"
+	})
+	now := time.Unix(1600000000, 0)
+	batch := append(testBatch(),
+		metric.New("cpu", map[string]string{"host": "b", "tenant": "acme-prod"}, map[string]interface{}{"usage_idle": 98.5}, now))
+	for i := 0; i < 2; i++ {
+		if err := c.Write(batch); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+
+	if creates := db.execsWithPrefix("CREATE DATABASE IF NOT EXISTS acme_prod"); len(creates) != 1 {
+		t.Errorf("expected the database of the tag created once, got %q", db.execsWithPrefix("CREATE DATABASE"))
+	}
+	if creates := db.execsWithPrefix("CREATE TABLE IF NOT EXISTS acme_prod.metrics("); len(creates) != 1 {
+		t.Errorf("expected the metrics table of the database created once, got %q", db.execsWithPrefix("CREATE TABLE"))
+	}
+	if batches := db.sentBatches("acme_prod.metrics"); len(batches) != 2 || len(batches[0].rows) != 1 {
+		t.Errorf("expected the tagged rows inserted into acme_prod.metrics, got %d batches", len(batches))
+	}
+	if batches := db.sentBatches("telegraf.metrics"); len(batches) != 2 || len(batches[0].rows) != 3 {
+		t.Errorf("expected the untagged rows inserted into telegraf.metrics, got %d batches", len(batches))
+	}
+	if tables := c.managedTables(); !reflect.DeepEqual(tables, []string{"metrics", "acme_prod.metrics"}) {
+		t.Errorf("expected the table of the database managed, got %q", tables)
+	}
+}
+
+func TestWriteEngine(t *testing.T) {
+	for engine, expected := range map[string]string{
+		"":                            "ENGINE=MergeTree PARTITION BY toYYYYMM(date) ORDER BY (name,tags,ts)",
+		"ReplacingMergeTree(updated)": "ENGINE=ReplacingMergeTree(updated) PARTITION BY toYYYYMM(date) ORDER BY (name,tags,ts)",
+		"Memory":                      "ENGINE=Memory",
+	} {
+		db := newMockDatabase()
+		c := newTestClient(t, db, func(c *ClickhouseClient) {
+			c.Engine = engine
+		})
+		if err := c.Write(testBatch()); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+
+		creates := db.execsWithPrefix("CREATE TABLE IF NOT EXISTS telegraf.metrics(")
+		if len(creates) != 1 || !strings.Contains(creates[0], expected) {
+			t.Errorf("expected %s, got %q", expected, creates)
+		}
+	}
+}
+
+func TestWritePartitionBy(t *testing.T) {
+	db := newMockDatabase()
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.PartitionBy = "toYYYYMMDD(ts)"
+	})
+	if err := c.Write(testBatch()); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	creates := db.execsWithPrefix("CREATE TABLE IF NOT EXISTS telegraf.metrics(")
+	if len(creates) != 1 || !strings.Contains(creates[0], "PARTITION BY toYYYYMMDD(ts) ORDER BY") {
+		t.Errorf("expected daily partitions, got %q", creates)
+	}
+}
+
+func TestWriteOrderBy(t *testing.T) {
+	db := newMockDatabase()
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.OrderBy = "(name, ts)"
+	})
+	if err := c.Write(testBatch()); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	creates := db.execsWithPrefix("CREATE TABLE IF NOT EXISTS telegraf.metrics(")
+	if len(creates) != 1 || !strings.Contains(creates[0], "ORDER BY (name, ts) SETTINGS") {
+		t.Errorf("expected the configured sorting key, got %q", creates)
+	}
+
+	for expr, expected := range map[string]string{"((a, b))": "a, b", "(a)+(b)": "(a)+(b)", "a": "a"} {
+		if trimmed := trimParens(expr); trimmed != expected {
+			t.Errorf("expected %s trimmed to %s, got %s", expr, expected, trimmed)
+		}
+	}
+}
+
+func TestWriteCreatesTableWithTTL(t *testing.T) {
+	db := newMockDatabase()
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.TTL = "ts + INTERVAL 30 DAY"
+	})
+	db.results["SELECT engine_full"] = [][]interface{}{{"MergeTree PARTITION BY toYYYYMM(date) ORDER BY (name, tags, ts) TTL ts + toIntervalDay(30) SETTINGS index_granularity = 8192"}}
+	if err := c.Write(testBatch()); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	creates := db.execsWithPrefix("CREATE TABLE IF NOT EXISTS telegraf.metrics(")
+	if len(creates) != 1 || !strings.Contains(creates[0], "ORDER BY (name,tags,ts) TTL ts + INTERVAL 30 DAY SETTINGS") {
+		t.Errorf("expected the TTL in the CREATE TABLE, got %q", creates)
+	}
+	if alters := db.execsWithPrefix("ALTER TABLE"); len(alters) != 0 {
+		t.Errorf("expected no ALTER of the new table, got %q", alters)
+	}
+}
+
+func TestWriteCreateTableTemplate(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "create.sql")
+	ioutil.WriteFile(file, []byte("CREATE TABLE IF NOT EXISTS {{.Database}}.{{.Table}}{{.OnCluster}} ({{.Columns}}, INDEX i name TYPE set(100) GRANULARITY 1) ENGINE = {{.Engine}}"), 0600)
+
+	db := newMockDatabase()
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.CreateTableTemplateFile = file
+	})
+	if err := c.Write(testBatch()); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	creates := db.execsWithPrefix("CREATE TABLE IF NOT EXISTS telegraf.metrics (")
+	if len(creates) != 1 || !strings.Contains(creates[0], "val Float64") ||
+		!strings.Contains(creates[0], "INDEX i name TYPE set(100) GRANULARITY 1) ENGINE = MergeTree PARTITION BY") {
+		t.Errorf("expected the table created from the template, got %q", creates)
+	}
+
+	c = newClickhouse()
+	c.CreateTableTemplate = "CREATE TABLE {{.Unknown"
+	if err := c.Connect(); err == nil || !strings.Contains(err.Error(), "create_table_template") {
+		t.Errorf("expected an invalid template to be rejected, got %v", err)
+	}
+}
+
+func TestWriteReplicated(t *testing.T) {
+	db := newMockDatabase()
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.Replicated = true
+		c.Engine = "ReplacingMergeTree(updated)"
+	})
+	if err := c.Write(testBatch()); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	creates := db.execsWithPrefix("CREATE TABLE IF NOT EXISTS telegraf.metrics(")
+	expected := "ENGINE=ReplicatedReplacingMergeTree('/clickhouse/tables/{shard}/{database}/{table}','{replica}',updated) PARTITION BY"
+	if len(creates) != 1 || !strings.Contains(creates[0], expected) {
+		t.Errorf("expected %s, got %q", expected, creates)
+	}
+}
+
+func TestWriteOnCluster(t *testing.T) {
+	db := newMockDatabase()
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.Cluster = "metrics"
+		c.TagsAsColumns = true
+	})
+	if err := c.Write(testBatch()); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	for _, prefix := range []string{
+		"CREATE DATABASE IF NOT EXISTS telegraf ON CLUSTER `metrics`",
+		"CREATE TABLE IF NOT EXISTS telegraf.metrics ON CLUSTER `metrics`(",
+		"ALTER TABLE telegraf.metrics ON CLUSTER `metrics` ADD COLUMN",
+	} {
+		if len(db.execsWithPrefix(prefix)) == 0 {
+			t.Errorf("expected a statement starting with %s", prefix)
+		}
+	}
+}
+
+func TestWriteDistributed(t *testing.T) {
+	db := newMockDatabase()
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.Cluster = "metrics"
+		c.Distributed = true
+		c.ShardingKey = "cityHash64(name, tags)"
+		c.TableLayout = layoutWide
+	})
+	if err := c.Write(testBatch()); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	if n := len(db.execsWithPrefix("CREATE TABLE IF NOT EXISTS telegraf.metrics_local ON CLUSTER `metrics`(")); n != 1 {
+		t.Errorf("expected the local table created, got %d", n)
+	}
+	expected := "CREATE TABLE IF NOT EXISTS telegraf.metrics ON CLUSTER `metrics` AS telegraf.metrics_local " +
+		"ENGINE=Distributed('metrics','telegraf','metrics_local',cityHash64(name, tags))"
+	if n := len(db.execsWithPrefix(expected)); n != 1 {
+		t.Errorf("expected %s, got %d", expected, n)
+	}
+	local := db.execsWithPrefix("ALTER TABLE telegraf.metrics_local ON CLUSTER `metrics` ADD COLUMN")
+	distributed := db.execsWithPrefix("ALTER TABLE telegraf.metrics ON CLUSTER `metrics` ADD COLUMN")
+	if len(local) == 0 || len(local) != len(distributed) {
+		t.Errorf("expected columns added to both tables, got %q and %q", local, distributed)
+	}
+	if n := len(db.sentBatches("telegraf.metrics")); n != 1 {
+		t.Errorf("expected 1 batch into the distributed table, got %d", n)
+	}
+}
+
+func TestConnectDistributedNeedsCluster(t *testing.T) {
+	c := newClickhouse()
+	c.Distributed = true
+	if err := c.Connect(); err == nil || !strings.Contains(err.Error(), "cluster") {
+		t.Errorf("expected distributed without a cluster to fail, got %v", err)
+	}
+}
+
+func TestWriteValStr(t *testing.T) {
+	db := newMockDatabase()
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.ValStr = true
+	})
+
+	batch := []telegraf.Metric{metric.New("system", map[string]string{"host": "a"}, map[string]interface{}{"uptime_format": "1 day, 2:03"}, time.Unix(1600000000, 0))}
+	if err := c.Write(batch); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	creates := db.execsWithPrefix("CREATE TABLE IF NOT EXISTS telegraf.metrics(")
+	if len(creates) != 1 || !strings.Contains(creates[0], "val Float64,\n\t\tval_str String") {
+		t.Errorf("expected a val_str column in %q", creates)
+	}
+	batches := db.sentBatches("telegraf.metrics")
+	if len(batches) != 1 || !strings.HasPrefix(batches[0].query, "INSERT INTO telegraf.metrics(name,tags,val,ts,val_str)") {
+		t.Fatalf("expected an insert of val_str, got %d batches", len(batches))
+	}
+	if row := batches[0].rows[0]; row[1] != `{"host":"a"}` || row[4] != "1 day, 2:03" {
+		t.Errorf("expected the string in val_str rather than the tags, got %v", row)
+	}
+}
+
+func TestWriteNaNHandling(t *testing.T) {
+	batch := func() []telegraf.Metric {
+		return []telegraf.Metric{metric.New("cpu", map[string]string{"host": "a"},
+			map[string]interface{}{"usage_idle": math.NaN(), "usage_user": math.Inf(1), "usage_system": 0.5},
+			time.Unix(1600000000, 0))}
+	}
+	for policy, expected := range map[string]map[string]interface{}{
+		nanDrop: {"cpu_usage_system": 0.5},
+		nanZero: {"cpu_usage_idle": float64(0), "cpu_usage_system": 0.5, "cpu_usage_user": float64(0)},
+		nanNull: {"cpu_usage_idle": nil, "cpu_usage_system": 0.5, "cpu_usage_user": nil},
+	} {
+		db := newMockDatabase()
+		c := newTestClient(t, db, func(c *ClickhouseClient) {
+			c.NaNHandling = policy
+		})
+		if err := c.Write(batch()); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+
+		batches := db.sentBatches("telegraf.metrics")
+		if len(batches) != 1 || len(batches[0].rows) != len(expected) {
+			t.Fatalf("%s: expected %d rows, got %v", policy, len(expected), batches)
+		}
+		// the fields of a metric are not ordered, compare the rows by name
+		for _, row := range batches[0].rows {
+			if val, ok := expected[row[0].(string)]; !ok || row[2] != val {
+				t.Errorf("%s: expected val %v of %v, got %v", policy, val, row[0], row[2])
+			}
+		}
+	}
+}
+
+func TestWriteLowCardinality(t *testing.T) {
+	db := newMockDatabase()
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.LowCardinality = true
+	})
+
+	if err := c.Write(testBatch()); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	creates := db.execsWithPrefix("CREATE TABLE IF NOT EXISTS telegraf.metrics(")
+	if len(creates) != 1 || !strings.Contains(creates[0], "name LowCardinality(String)") || !strings.Contains(creates[0], "tags LowCardinality(String)") {
+		t.Errorf("expected LowCardinality name and tags columns in %q", creates)
+	}
+}
+
+func TestWriteTimestampPrecision(t *testing.T) {
+	db := newMockDatabase()
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.TimestampPrecision = "ms"
+	})
+
+	ts := time.Unix(1600000000, 123456789)
+	batch := []telegraf.Metric{metric.New("cpu", map[string]string{"host": "a"}, map[string]interface{}{"usage_idle": 99.5}, ts)}
+	if err := c.Write(batch); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	creates := db.execsWithPrefix("CREATE TABLE IF NOT EXISTS telegraf.metrics(")
+	if len(creates) != 1 || !strings.Contains(creates[0], "ts DateTime64(3)") {
+		t.Errorf("expected a DateTime64(3) ts column in %q", creates)
+	}
+	batches := db.sentBatches("telegraf.metrics")
+	if len(batches) != 1 {
+		t.Fatalf("expected 1 batch, got %d", len(batches))
+	}
+	value, ok := batches[0].rows[0][3].(dateTime64)
+	if !ok || !value.Equal(ts) || value.ticks() != 1600000000123 {
+		t.Errorf("expected the timestamp with its milliseconds, got %v", batches[0].rows[0][3])
+	}
+}
+
+func TestWriteTimezone(t *testing.T) {
+	db := newMockDatabase()
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.Timezone = "UTC"
+		c.AggregateTable = "metrics_1m"
+	})
+
+	if err := c.Write(testBatch()); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	creates := db.execsWithPrefix("CREATE TABLE IF NOT EXISTS telegraf.metrics")
+	if len(creates) != 2 || !strings.Contains(creates[0]+creates[1], "ts DateTime('UTC')") || strings.Contains(creates[0]+creates[1], "ts DateTime,") {
+		t.Errorf("expected ts columns in UTC in %q", creates)
+	}
+	if !strings.Contains(creates[0]+creates[1], "updated DateTime('UTC') DEFAULT now()") {
+		t.Errorf("expected the updated column in UTC in %q", creates)
+	}
+	batches := db.sentBatches("telegraf.metrics")
+	if len(batches) != 1 {
+		t.Fatalf("expected 1 batch, got %d", len(batches))
+	}
+	if ts, ok := batches[0].rows[0][3].(time.Time); !ok || ts.Location() != time.UTC {
+		t.Errorf("expected the timestamp converted to UTC, got %v", batches[0].rows[0][3])
+	}
+}
+
+func TestConnectInvalidTimezone(t *testing.T) {
+	c := newClickhouse()
+	c.Timezone = "Nowhere/Special"
+	if err := c.Connect(); err == nil || !strings.Contains(err.Error(), "timezone") {
+		t.Errorf("expected the timezone to be rejected, got %v", err)
+	}
+}
+
+func TestTimestampPrecisionNeedsDateTime64(t *testing.T) {
+	db := newMockDatabase()
+	db.results["SELECT version()"] = [][]interface{}{{"19.17.4.11"}}
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.TimestampPrecision = "us"
+	})
+
+	if err := c.Write(testBatch()); err == nil || !strings.Contains(err.Error(), "20.1") {
+		t.Errorf("expected the server version to be rejected, got %v", err)
+	}
+
+	// DateTime in a timezone needs no DateTime64
+	db = newMockDatabase()
+	db.results["SELECT version()"] = [][]interface{}{{"19.17.4.11"}}
+	c = newTestClient(t, db, func(c *ClickhouseClient) {
+		c.Timezone = "UTC"
+	})
+	if err := c.Write(testBatch()); err != nil {
+		t.Errorf("expected DateTime('UTC') to be accepted, got %v", err)
+	}
+}
+
+func TestWriteTagsAsColumns(t *testing.T) {
+	db := newMockDatabase()
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.TagsAsColumns = true
+	})
+
+	for i := 0; i < 2; i++ {
+		if err := c.Write(testBatch()); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+
+	alters := db.execsWithPrefix("ALTER TABLE telegraf.metrics ADD COLUMN IF NOT EXISTS")
+	if len(alters) != 2 || !strings.Contains(alters[0]+alters[1], "cpu LowCardinality(String)") || !strings.Contains(alters[0]+alters[1], "host LowCardinality(String)") {
+		t.Errorf("expected a column added once per tag key, got %q", alters)
+	}
+
+	batches := db.sentBatches("telegraf.metrics")
+	if len(batches) != 2 {
+		t.Fatalf("expected 2 batches, got %d", len(batches))
+	}
+	if !strings.HasPrefix(batches[0].query, "INSERT INTO telegraf.metrics(name,tags,val,ts,cpu,host)") {
+		t.Errorf("unexpected insert %q", batches[0].query)
+	}
+	if row := batches[0].rows[2]; row[4] != "" || row[5] != "a" {
+		t.Errorf("expected an empty cpu and the host of mem, got %v", row)
+	}
+}
+
+func TestWriteStagingInserts(t *testing.T) {
+	db := newMockDatabase()
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.StagingInserts = true
+	})
+
+	if err := c.Write(testBatch()); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	creates := db.execsWithPrefix("CREATE TABLE telegraf.metrics_staging_")
+	if len(creates) != 1 || !strings.HasSuffix(creates[0], " AS telegraf.metrics") {
+		t.Fatalf("expected 1 staging table created like the metrics table, got %q", creates)
+	}
+	staging := strings.Fields(creates[0])[2]
+
+	if n := len(db.sentBatches(staging)); n != 1 {
+		t.Errorf("expected 1 batch into %s, got %d", staging, n)
+	}
+	if n := len(db.sentBatches("telegraf.metrics")); n != 0 {
+		t.Errorf("expected no batch into the metrics table, got %d", n)
+	}
+	promote := "INSERT INTO telegraf.metrics(name,tags,val,ts) SELECT name,tags,val,ts FROM " + staging
+	if n := len(db.execsWithPrefix(promote)); n != 1 {
+		t.Errorf("expected 1 %q, got %d", promote, n)
+	}
+	if n := len(db.execsWithPrefix("DROP TABLE IF EXISTS " + staging)); n != 1 {
+		t.Errorf("expected staging table dropped, got %d", n)
+	}
+}
+
+func TestWriteStagingInsertsOnCluster(t *testing.T) {
+	db := newMockDatabase()
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.StagingInserts = true
+		c.Cluster = "main"
+	})
+
+	if err := c.Write(testBatch()); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	creates := db.execsWithPrefix("CREATE TABLE telegraf.metrics_staging_")
+	if len(creates) != 1 || !strings.HasSuffix(creates[0], " ON CLUSTER `main` AS telegraf.metrics") {
+		t.Fatalf("expected the staging table created on the cluster, got %q", creates)
+	}
+	drop := "DROP TABLE IF EXISTS " + strings.Fields(creates[0])[2] + " ON CLUSTER `main`"
+	if n := len(db.execsWithPrefix(drop)); n != 1 {
+		t.Errorf("expected 1 %q, got %d", drop, n)
+	}
+}
+
+func TestWriteStagingInsertsDenied(t *testing.T) {
+	db := newMockDatabase()
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.StagingInserts = true
+	})
+
+	db.execErrs["CREATE TABLE telegraf.metrics_staging_"] = &clickhouse.Exception{Code: accessDenied, Message: "Not enough privileges"}
+	if err := c.Write(testBatch()); err == nil || !strings.Contains(err.Error(), "DDL privileges") {
+		t.Errorf("expected the denied staging table to fail the write, got %v", err)
+	}
+	if n := len(db.sentBatches("telegraf.metrics")); n != 0 {
+		t.Errorf("expected no batch bypassing the staging table, got %d", n)
+	}
+
+	c = newClickhouse()
+	c.Hosts = []string{"a:9000"}
+	c.StagingInserts = true
+	c.CreateSchema = false
+	if err := c.Connect(); err == nil {
+		t.Error("expected staging_inserts to need create_schema")
+	}
+}
+
+func TestWriteStagingDroppedOnFailure(t *testing.T) {
+	db := newMockDatabase()
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.StagingInserts = true
+	})
+
+	db.execErrs["INSERT INTO telegraf.metrics("] = errors.New("too many parts")
+	if err := c.Write(testBatch()); err == nil {
+		t.Fatal("expected write to fail")
+	}
+	if n := len(db.execsWithPrefix("DROP TABLE IF EXISTS telegraf.metrics_staging_")); n != 1 {
+		t.Errorf("expected staging table dropped, got %d", n)
+	}
+}
+
+func TestWriteExtraColumns(t *testing.T) {
+	db := newMockDatabase()
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.ExtraColumns = map[string]string{"region": "eu-west-1", "environment": "production"}
+	})
+
+	if err := c.Write(testBatch()); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	creates := db.execsWithPrefix("CREATE TABLE IF NOT EXISTS telegraf.metrics(")
+	if len(creates) != 1 || !strings.Contains(creates[0], "environment String DEFAULT ''") || !strings.Contains(creates[0], "region String DEFAULT ''") {
+		t.Errorf("expected extra columns in %q", creates)
+	}
+
+	batches := db.sentBatches("telegraf.metrics")
+	if len(batches) != 1 {
+		t.Fatalf("expected 1 batch, got %d", len(batches))
+	}
+	if !strings.HasPrefix(batches[0].query, "INSERT INTO telegraf.metrics(name,tags,val,ts,environment,region)") {
+		t.Errorf("unexpected insert %q", batches[0].query)
+	}
+	for _, row := range batches[0].rows {
+		if row[4] != "production" || row[5] != "eu-west-1" {
+			t.Errorf("unexpected extra values in %v", row)
+		}
+	}
+}
+
+func TestWriteInsertSettings(t *testing.T) {
+	db := newMockDatabase()
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.Settings = map[string]string{"max_insert_block_size": "1048576", "priority": "2"}
+		c.QuerySettings = map[string]string{"priority": "1"}
+	})
+
+	if err := c.Write(testBatch()); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	batches := db.sentBatches("telegraf.metrics")
+	if len(batches) != 1 {
+		t.Fatalf("expected 1 batch, got %d", len(batches))
+	}
+	if !strings.Contains(batches[0].query, " SETTINGS max_insert_block_size=1048576, priority=1 VALUES(") {
+		t.Errorf("expected merged settings on the insert, got %q", batches[0].query)
+	}
+}
+
+func TestWriteAsyncInsert(t *testing.T) {
+	db := newMockDatabase()
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.AsyncInsert = true
+	})
+	if err := c.Write(testBatch()); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	batches := db.sentBatches("telegraf.metrics")
+	if len(batches) != 1 || !strings.Contains(batches[0].query, " SETTINGS async_insert=1, wait_for_async_insert=1 VALUES(") {
+		t.Errorf("expected async_insert on the insert, got %v", batches)
+	}
+
+	// servers without async inserts insert synchronously
+	db = newMockDatabase()
+	delete(db.results, "system.settings")
+	c = newTestClient(t, db, func(c *ClickhouseClient) {
+		c.AsyncInsert = true
+	})
+	if err := c.Write(testBatch()); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	batches = db.sentBatches("telegraf.metrics")
+	if len(batches) != 1 || strings.Contains(batches[0].query, "async_insert") {
+		t.Errorf("expected no async_insert on the insert, got %v", batches)
+	}
+}
+
+func TestWriteAgentMetadata(t *testing.T) {
+	db := newMockDatabase()
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.ExtraColumns = map[string]string{"region": "eu-west-1"}
+		c.AgentMetadata = true
+	})
+
+	if err := c.Write(testBatch()); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	batches := db.sentBatches("telegraf.metrics")
+	if len(batches) != 1 {
+		t.Fatalf("expected 1 batch, got %d", len(batches))
+	}
+	if !strings.HasPrefix(batches[0].query, "INSERT INTO telegraf.metrics(name,tags,val,ts,region,agent_hostname,agent_version,plugin_version)") {
+		t.Errorf("unexpected insert %q", batches[0].query)
+	}
+	if row := batches[0].rows[0]; row[5] != c.hostname || row[6] == "" || row[7] == "" {
+		t.Errorf("unexpected metadata in %v", row)
+	}
+}
+
+func TestWriteBatchID(t *testing.T) {
+	db := newMockDatabase()
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.BatchID = true
+	})
+
+	for i := 0; i < 2; i++ {
+		if err := c.Write(testBatch()); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+
+	creates := db.execsWithPrefix("CREATE TABLE IF NOT EXISTS telegraf.metrics(")
+	if len(creates) != 1 || !strings.Contains(creates[0], "batch_id UUID") {
+		t.Errorf("expected batch_id column in %q", creates)
+	}
+
+	batches := db.sentBatches("telegraf.metrics")
+	if len(batches) != 2 {
+		t.Fatalf("expected 2 batches, got %d", len(batches))
+	}
+	ids := make(map[interface{}]bool)
+	for _, b := range batches {
+		first := b.rows[0][4]
+		for _, row := range b.rows {
+			if row[4] != first {
+				t.Errorf("expected one batch_id per flush, got %v and %v", first, row[4])
+			}
+		}
+		ids[first] = true
+	}
+	if len(ids) != 2 {
+		t.Errorf("expected distinct batch_id per flush, got %v", ids)
+	}
+}
+
+func TestWriteMetricType(t *testing.T) {
+	db := newMockDatabase()
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.MetricType = true
+	})
+
+	now := time.Unix(1600000000, 0)
+	batch := []telegraf.Metric{
+		metric.New("net", map[string]string{"host": "a"}, map[string]interface{}{"bytes_recv": int64(10)}, now, telegraf.Counter),
+		metric.New("mem", map[string]string{"host": "a"}, map[string]interface{}{"used": int64(1024)}, now),
+	}
+	if err := c.Write(batch); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	creates := db.execsWithPrefix("CREATE TABLE IF NOT EXISTS telegraf.metrics(")
+	if len(creates) != 1 || !strings.Contains(creates[0], "metric_type LowCardinality(String) DEFAULT ''") {
+		t.Errorf("expected metric_type column in %q", creates)
+	}
+	batches := db.sentBatches("telegraf.metrics")
+	if len(batches) != 1 {
+		t.Fatalf("expected 1 batch, got %d", len(batches))
+	}
+	if !strings.HasPrefix(batches[0].query, "INSERT INTO telegraf.metrics(name,tags,val,ts,metric_type)") {
+		t.Errorf("expected the metric_type column inserted, got %q", batches[0].query)
+	}
+	if rows := batches[0].rows; rows[0][4] != "counter" || rows[1][4] != "untyped" {
+		t.Errorf("unexpected metric types of %v", rows)
+	}
+}
+func TestExtraColumnNamesResolved(t *testing.T) {
+	db := newMockDatabase()
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.ExtraColumns = map[string]string{"ts": "a", "order": "b", "my-dc": "c", "my_dc": "d", "1st": "e"}
+	})
+
+	expected := []string{"_1st", "my_dc", "my_dc_2", "order_", "ts_2"}
+	if strings.Join(c.extraColumnNames, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected columns %v, got %v", expected, c.extraColumnNames)
+	}
+
+	if err := c.Write(testBatch()); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	batches := db.sentBatches("telegraf.metrics")
+	if len(batches) != 1 || !strings.HasPrefix(batches[0].query, "INSERT INTO telegraf.metrics(name,tags,val,ts,_1st,my_dc,my_dc_2,order_,ts_2)") {
+		t.Fatalf("unexpected inserts %v", batches)
+	}
+	if row := batches[0].rows[0]; row[4] != "e" || row[5] != "c" || row[6] != "d" || row[8] != "a" {
+		t.Errorf("unexpected values %v", row)
+	}
+}
+
+func TestExtraColumnNamesGraphite(t *testing.T) {
+	db := newMockDatabase()
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.TableLayout = layoutGraphite
+		c.ExtraColumns = map[string]string{"Path": "a", "Timestamp": "b", "path": "c"}
+	})
+
+	expected := []string{"Path_2", "Timestamp_2", "path"}
+	if strings.Join(c.extraColumnNames, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected columns %v, got %v", expected, c.extraColumnNames)
+	}
+}
+
+func TestWriteDictionaryColumns(t *testing.T) {
+	db := newMockDatabase()
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.DictionaryColumns = []*dictionaryColumn{
+			{Name: "datacenter", Dictionary: "hosts", Attribute: "dc", KeyTag: "host"},
+			{Name: "rack", Dictionary: "infra.racks", Attribute: "rack", KeyTag: "rack_id", NumericKey: true, Type: "UInt16"},
+		}
+	})
+
+	if err := c.Write(testBatch()); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	creates := db.execsWithPrefix("CREATE TABLE IF NOT EXISTS telegraf.metrics(")
+	if len(creates) != 1 {
+		t.Fatalf("expected 1 CREATE TABLE, got %d", len(creates))
+	}
+	for _, expected := range []string{
+		"datacenter String MATERIALIZED dictGet('telegraf.hosts', 'dc', tuple(JSONExtractString(tags, 'host')))",
+		"rack UInt16 MATERIALIZED dictGet('infra.racks', 'rack', toUInt64OrZero(JSONExtractString(tags, 'rack_id')))",
+	} {
+		if !strings.Contains(creates[0], expected) {
+			t.Errorf("expected %q in %q", expected, creates[0])
+		}
+	}
+
+	batches := db.sentBatches("telegraf.metrics")
+	if len(batches) != 1 || !strings.HasPrefix(batches[0].query, "INSERT INTO telegraf.metrics(name,tags,val,ts)") {
+		t.Errorf("expected materialized columns left out of the insert, got %v", batches)
+	}
+}
+
+func TestWriteShadowFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shadow.ndjson")
+
+	db := newMockDatabase()
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.ShadowFile = path
+		c.ShadowFileMaxSize = 1
+		c.ShadowFileMaxBackups = 1
+	})
+
+	for i := 0; i < 2; i++ {
+		if err := c.Write(testBatch()); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+
+	for _, name := range []string{path, path + ".1"} {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatalf("read shadow file: %v", err)
+		}
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		if len(lines) != 3 {
+			t.Errorf("%s: expected 3 lines, got %d", name, len(lines))
+		}
+
+		var row map[string]interface{}
+		if err := json.Unmarshal([]byte(lines[0]), &row); err != nil {
+			t.Fatalf("decode %q: %v", lines[0], err)
+		}
+		for _, column := range []string{"name", "tags", "val", "ts"} {
+			if _, ok := row[column]; !ok {
+				t.Errorf("%s: missing column %s in %s", name, column, lines[0])
+			}
+		}
+	}
+}
+
+func TestConnectAppliesPoolLimits(t *testing.T) {
+	c := newTestClient(t, newMockDatabase(), func(c *ClickhouseClient) {
+		c.Hosts = []string{"127.0.0.1:1"}
+		c.MaxOpenConns = 4
+		c.ConnMaxLifetime = config.Duration(time.Minute)
+		c.openDatabase = openDSN
+	})
+
+	stats := c.db.(*sqlDatabase).db.Stats()
+	if stats.MaxOpenConnections != 4 {
+		t.Errorf("expected 4 open connections at most, got %d", stats.MaxOpenConnections)
+	}
+}
+
+func TestConnectRawDSN(t *testing.T) {
+	var opened string
+	c := newTestClient(t, newMockDatabase(), func(c *ClickhouseClient) {
+		c.DSN = "tcp://ch:9000?username=writer&block_size=100000"
+		db := c.openDatabase
+		c.openDatabase = func(dsn string, role string) (database, error) {
+			opened = dsn
+			return db(dsn, role)
+		}
+	})
+
+	if opened != c.DSN || c.DBI != c.DSN {
+		t.Errorf("expected the dsn to be used as is, got %s", opened)
+	}
+
+	c.DSN = "ch:9000"
+	if err := c.Connect(); err == nil {
+		t.Error("expected a dsn without scheme to fail")
+	}
+}
+
+func TestWriteDeadlineCancelsInserts(t *testing.T) {
+	db := newMockDatabase()
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.WriteDeadline = config.Duration(50 * time.Millisecond)
+	})
+	db.sendBlock = make(chan struct{})
+	defer close(db.sendBlock)
+
+	start := time.Now()
+	if err := c.Write(testBatch()); err != context.DeadlineExceeded {
+		t.Fatalf("expected the deadline to cancel the insert, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected the write to return at its deadline, took %s", elapsed)
+	}
+	if len(db.batches) != 1 {
+		t.Errorf("expected no retries after the deadline, got %d batches", len(db.batches))
+	}
+}
+
+func TestConnectionCheck(t *testing.T) {
+	db := newMockDatabase()
+	db.pingErr = errors.New("dial tcp 127.0.0.1:9000: connection refused")
+
+	c := newClickhouse()
+	c.Hosts = []string{"127.0.0.1:9000"}
+	c.Database = "telegraf"
+	c.TableName = "metrics"
+	c.openDatabase = func(string, string) (database, error) { return db, nil }
+	c.ConnectionCheck = "strict"
+	defer c.Close()
+	if err := c.Connect(); err == nil {
+		t.Fatal("expected a strict connection check to fail on an unreachable server")
+	}
+	if !db.closed {
+		t.Error("expected the database to be closed")
+	}
+
+	c.ConnectionCheck = "lazy"
+	if err := c.Connect(); err != nil {
+		t.Fatalf("expected a lazy connection check to succeed, got %v", err)
+	}
+}
+
+func TestCompactCatalogOnCluster(t *testing.T) {
+	db := newMockDatabase()
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.Catalog = true
+		c.Cluster = "main"
+	})
+
+	c.compactCatalog()
+	stmt := "OPTIMIZE TABLE telegraf." + c.CatalogTable + " ON CLUSTER `main` FINAL"
+	if n := len(db.execsWithPrefix(stmt)); n != 1 {
+		t.Errorf("expected 1 %q, got %q", stmt, db.execsWithPrefix("OPTIMIZE"))
+	}
+
+	atomic.StoreInt32(&c.insertOnly, 1)
+	c.compactCatalog()
+	if n := len(db.execsWithPrefix("OPTIMIZE")); n != 1 {
+		t.Errorf("expected no compaction while insert-only, got %d", n)
+	}
+}
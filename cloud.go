@@ -0,0 +1,63 @@
+package clickhouse
+
+import (
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/influxdata/telegraf/config"
+)
+
+const cloudDomain = ".clickhouse.cloud"
+
+// whether the plugin talks to ClickHouse Cloud, either configured or
+// because all hosts are in its domain
+func (c *ClickhouseClient) isCloud() bool {
+	if c.Cloud {
+		return true
+	}
+	if len(c.Hosts) == 0 {
+		return false
+	}
+	for _, host := range c.Hosts {
+		if !strings.HasSuffix(hostName(host), cloudDomain) {
+			return false
+		}
+	}
+	return true
+}
+
+// the host name of a host with optional port
+func hostName(host string) string {
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		return name
+	}
+	return host
+}
+
+// adjust the connection options to what ClickHouse Cloud requires: TLS on
+// the secure ports and keep-alives outliving its idle connection timeout.
+func (c *ClickhouseClient) applyCloudDefaults() {
+	if !c.isCloud() {
+		return
+	}
+
+	c.Secure = true
+	port := "9440"
+	if c.Protocol == "http" || c.Protocol == "https" {
+		port = "8443"
+	}
+	for i, host := range c.Hosts {
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			c.Hosts[i] = net.JoinHostPort(host, port)
+		}
+	}
+	if c.TCPKeepAlivePeriod == 0 {
+		c.TCPKeepAlivePeriod = config.Duration(30 * time.Second)
+	}
+
+	if c.Debug {
+		log.Println("ClickHouse Cloud hosts:", c.Hosts)
+	}
+}
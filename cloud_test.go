@@ -0,0 +1,44 @@
+package clickhouse
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCloudDefaults(t *testing.T) {
+	c := newTestClient(t, newMockDatabase(), func(c *ClickhouseClient) {
+		c.Hosts = []string{"abc123.eu-west-1.aws.clickhouse.cloud"}
+	})
+
+	if !strings.HasPrefix(c.DBI, "tcp://abc123.eu-west-1.aws.clickhouse.cloud:9440?") || !strings.Contains(c.DBI, "secure=true") {
+		t.Errorf("expected the secure native port, got %s", c.DBI)
+	}
+	if time.Duration(c.TCPKeepAlivePeriod) != 30*time.Second {
+		t.Errorf("expected a 30s keep-alive, got %s", time.Duration(c.TCPKeepAlivePeriod))
+	}
+}
+
+func TestCloudToken(t *testing.T) {
+	c := newClickhouse()
+	c.Hosts = []string{"abc123.clickhouse.cloud"}
+	c.Protocol = "https"
+	c.Token = "eyJhbGciOi"
+	c.applyCloudDefaults()
+
+	dsn, err := buildDsn(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(dsn, "https://abc123.clickhouse.cloud:8443?") || !strings.Contains(dsn, "http_header.Authorization=Bearer+eyJhbGciOi") {
+		t.Errorf("expected https on 8443 with a bearer token, got %s", dsn)
+	}
+}
+
+func TestNotCloud(t *testing.T) {
+	c := newClickhouse()
+	c.Hosts = []string{"abc123.clickhouse.cloud:9440", "ch.example.com:9000"}
+	if c.isCloud() {
+		t.Error("expected mixed hosts not to be detected as cloud")
+	}
+}
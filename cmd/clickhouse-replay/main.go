@@ -0,0 +1,42 @@
+// Command clickhouse-replay re-ingests the spool files written by the
+// clickhouse output on failed inserts.
+//
+//	clickhouse-replay -hosts 127.0.0.1:9000 /var/lib/telegraf/clickhouse-spool/*.manifest.json
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	clickhouse "github.com/taylor840326/telegraf-clickhouse-plugin"
+)
+
+func main() {
+	var opts clickhouse.ReplayOptions
+	hosts := flag.String("hosts", "127.0.0.1:9000", "comma separated ClickHouse hosts")
+	flag.StringVar(&opts.Database, "database", "telegraf", "database to connect to")
+	flag.StringVar(&opts.User, "user", "default", "user")
+	flag.StringVar(&opts.Password, "password", "", "password")
+	flag.Float64Var(&opts.RowsPerSecond, "rate", 0, "maximum rows per second, unlimited when zero")
+	flag.IntVar(&opts.BatchSize, "batch-size", 10000, "rows per INSERT")
+	flag.BoolVar(&opts.Keep, "keep", false, "keep spool files after replaying them")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] manifest...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	opts.Hosts = strings.Split(*hosts, ",")
+	opts.Progress = os.Stdout
+	if err := clickhouse.Replay(opts, flag.Args()...); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,110 @@
+package clickhouse
+
+import (
+	"fmt"
+	"strings"
+)
+
+// keywords that are ambiguous as bare column names in generated statements
+var reservedWords = map[string]bool{
+	"all": true, "and": true, "array": true, "as": true, "asc": true,
+	"between": true, "by": true, "case": true, "cast": true, "cross": true,
+	"default": true, "desc": true, "distinct": true, "else": true, "end": true,
+	"except": true, "exists": true, "final": true, "format": true, "from": true,
+	"full": true, "global": true, "group": true, "having": true, "if": true,
+	"ilike": true, "in": true, "inner": true, "interval": true, "into": true,
+	"is": true, "join": true, "key": true, "left": true, "like": true,
+	"limit": true, "not": true, "null": true, "offset": true, "on": true,
+	"or": true, "order": true, "outer": true, "prewhere": true, "primary": true,
+	"right": true, "sample": true, "select": true, "settings": true,
+	"table": true, "then": true, "to": true, "ttl": true, "union": true,
+	"using": true, "values": true, "when": true, "where": true, "with": true,
+}
+
+// sanitize name into a bare identifier of letters, digits and
+// underscores, replacing each other character, e.g. dots, dashes or
+// unicode letters, with replacement
+func sanitizeColumnName(name string, replacement byte) string {
+	sanitized := make([]byte, 0, len(name))
+	for _, r := range name {
+		if r < 0x80 && isIdentifierChar(byte(r)) {
+			sanitized = append(sanitized, byte(r))
+		} else {
+			sanitized = append(sanitized, replacement)
+		}
+	}
+	if len(sanitized) == 0 || sanitized[0] >= '0' && sanitized[0] <= '9' {
+		sanitized = append([]byte{'_'}, sanitized...)
+	}
+	return string(sanitized)
+}
+
+// whether b may appear in a bare identifier
+func isIdentifierChar(b byte) bool {
+	return b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b >= '0' && b <= '9' || b == '_'
+}
+
+// assigns unique column names, resolving collisions with reserved words
+// and names already taken by suffixing _2, _3, ... The result only
+// depends on the columns seeded from existing tables and the order names
+// are requested in, which callers sort.
+type columnNamer struct {
+	replacement byte
+	used        map[string]bool
+	// columns of the fields and tags of existing tables by their comment
+	seeded map[string]string
+}
+
+func newColumnNamer(replacement byte, taken ...string) *columnNamer {
+	n := &columnNamer{replacement: replacement, used: make(map[string]bool), seeded: make(map[string]string)}
+	for _, name := range taken {
+		n.used[name] = true
+	}
+	return n
+}
+
+// comments of the generated columns recording the field or tag they were
+// named for, by which the names are seeded from existing tables
+func fieldComment(key string) string {
+	return "field " + key
+}
+
+func tagComment(key string) string {
+	return "tag " + key
+}
+
+// seed column as named for the field or tag of comment in an existing
+// table, ignoring the comments of other columns
+func (n *columnNamer) seed(comment, column string) {
+	if !strings.HasPrefix(comment, "field ") && !strings.HasPrefix(comment, "tag ") {
+		return
+	}
+	if _, ok := n.seeded[comment]; !ok {
+		n.seeded[comment] = column
+		n.used[column] = true
+	}
+}
+
+// column of the field or tag of comment, the seeded one if an existing
+// table has it and a unique name of key otherwise
+func (n *columnNamer) nameFor(comment, key string) string {
+	if column, ok := n.seeded[comment]; ok {
+		return column
+	}
+	return n.name(key)
+}
+
+// unique column name of name
+func (n *columnNamer) name(name string) string {
+	base := sanitizeColumnName(name, n.replacement)
+	if reservedWords[strings.ToLower(base)] {
+		base += "_"
+	}
+
+	column := base
+	for i := 2; n.used[column]; i++ {
+		column = fmt.Sprintf("%s_%d", base, i)
+	}
+	n.used[column] = true
+	return column
+}
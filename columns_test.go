@@ -0,0 +1,56 @@
+package clickhouse
+
+import "testing"
+
+func TestColumnNamer(t *testing.T) {
+	n := newColumnNamer('_', "name", "ts")
+
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{name: "host", expected: "host"},
+		{name: "ts", expected: "ts_2"},
+		{name: "ts", expected: "ts_3"},
+		{name: "SELECT", expected: "SELECT_"},
+		{name: "disk.used", expected: "disk_used"},
+		{name: "disk-used", expected: "disk_used_2"},
+		{name: "9to5", expected: "_9to5"},
+		{name: "", expected: "_"},
+		{name: "température", expected: "temp_rature"},
+	}
+
+	for _, tt := range tests {
+		if got := n.name(tt.name); got != tt.expected {
+			t.Errorf("%q: expected %q, got %q", tt.name, tt.expected, got)
+		}
+	}
+}
+
+func TestColumnNamerReplacement(t *testing.T) {
+	n := newColumnNamer('x')
+	if got := n.name("ifHCInOctets.1-2"); got != "ifHCInOctetsx1x2" {
+		t.Errorf("expected the dot and dash replaced, got %q", got)
+	}
+}
+
+func TestColumnNamerSeeded(t *testing.T) {
+	n := newColumnNamer('_', "name", "ts")
+	// a_b was named before a-b in an earlier run
+	n.seed(fieldComment("a_b"), "a_b")
+	n.seed(fieldComment("a-b"), "a_b_2")
+	n.seed("written by hand", "notes")
+
+	if got := n.nameFor(fieldComment("a-b"), "a-b"); got != "a_b_2" {
+		t.Errorf("expected a-b to keep its column a_b_2, got %q", got)
+	}
+	if got := n.nameFor(fieldComment("a_b"), "a_b"); got != "a_b" {
+		t.Errorf("expected a_b to keep its column a_b, got %q", got)
+	}
+	if got := n.nameFor(fieldComment("a.b"), "a.b"); got != "a_b_3" {
+		t.Errorf("expected a.b named after the seeded columns, got %q", got)
+	}
+	if got := n.nameFor(tagComment("notes"), "notes"); got != "notes" {
+		t.Errorf("expected columns of other comments not seeded, got %q", got)
+	}
+}
@@ -0,0 +1,59 @@
+package clickhouse
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+
+	"github.com/ClickHouse/clickhouse-go"
+)
+
+// opens the native connections of the pool and prepares their session
+type connector struct {
+	dsn string
+	// role activated on every new connection
+	role string
+	// opens a connection of the dsn, clickhouse.Open unless set
+	open func(dsn string) (driver.Conn, error)
+}
+
+func (c *connector) Connect(ctx context.Context) (driver.Conn, error) {
+	dsn, err := withDiscoveredHosts(c.dsn)
+	if err != nil {
+		return nil, err
+	}
+	if dsn, err = withPasswordFile(dsn); err != nil {
+		return nil, err
+	}
+	open := c.open
+	if open == nil {
+		open = clickhouse.Open
+	}
+	conn, err := open(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.role != "" {
+		execer, ok := conn.(driver.ExecerContext)
+		if !ok {
+			conn.Close()
+			return nil, errors.New("driver does not support SET ROLE")
+		}
+		if _, err := execer.ExecContext(ctx, "SET ROLE "+quoteIdentifier(c.role), nil); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
+
+func (c *connector) Driver() driver.Driver {
+	return c
+}
+
+// Open implements driver.Driver for connections opened outside the pool.
+func (c *connector) Open(name string) (driver.Conn, error) {
+	return (&connector{dsn: name, role: c.role, open: c.open}).Connect(context.Background())
+}
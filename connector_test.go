@@ -0,0 +1,160 @@
+package clickhouse
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"sync"
+	"testing"
+)
+
+// driver connection recording the statements executed on it
+type fakeConn struct {
+	mu      sync.Mutex
+	execs   []string
+	execErr error
+	closed  bool
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("not supported")
+}
+
+func (c *fakeConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("not supported")
+}
+
+func (c *fakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.execs = append(c.execs, query)
+	if c.execErr != nil {
+		return nil, c.execErr
+	}
+	return driver.RowsAffected(0), nil
+}
+
+// driver connection without ExecContext
+type plainConn struct {
+	closed bool
+}
+
+func (c *plainConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("not supported")
+}
+
+func (c *plainConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func (c *plainConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("not supported")
+}
+
+// connector opening fake connections, returning them in the order opened
+func newFakeConnector(role string, execErr error) (*connector, func() []*fakeConn) {
+	var mu sync.Mutex
+	var conns []*fakeConn
+	c := &connector{
+		dsn:  "tcp://127.0.0.1:9000?database=telegraf",
+		role: role,
+		open: func(string) (driver.Conn, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			conn := &fakeConn{execErr: execErr}
+			conns = append(conns, conn)
+			return conn, nil
+		},
+	}
+	return c, func() []*fakeConn {
+		mu.Lock()
+		defer mu.Unlock()
+		return conns
+	}
+}
+
+func TestConnectorSetRoleOnEveryConnection(t *testing.T) {
+	c, opened := newFakeConnector("telegraf writer", nil)
+	db := sql.OpenDB(c)
+	defer db.Close()
+
+	// hold the connections so the pool opens new ones
+	ctx := context.Background()
+	var held []*sql.Conn
+	for i := 0; i < 3; i++ {
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			t.Fatalf("connect: %v", err)
+		}
+		held = append(held, conn)
+	}
+	for _, conn := range held {
+		conn.Close()
+	}
+
+	conns := opened()
+	if len(conns) != 3 {
+		t.Fatalf("expected 3 connections, got %d", len(conns))
+	}
+	for i, conn := range conns {
+		if len(conn.execs) != 1 || conn.execs[0] != "SET ROLE `telegraf writer`" {
+			t.Errorf("expected SET ROLE on connection %d, got %q", i, conn.execs)
+		}
+	}
+
+	// connections opened outside the pool as well
+	conn, err := c.Open(c.dsn)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if execs := conn.(*fakeConn).execs; len(execs) != 1 || execs[0] != "SET ROLE `telegraf writer`" {
+		t.Errorf("expected SET ROLE on the opened connection, got %q", execs)
+	}
+}
+
+func TestConnectorWithoutRole(t *testing.T) {
+	c, opened := newFakeConnector("", nil)
+
+	if _, err := c.Connect(context.Background()); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	if execs := opened()[0].execs; len(execs) != 0 {
+		t.Errorf("expected no statements without a role, got %q", execs)
+	}
+}
+
+func TestConnectorSetRoleFailure(t *testing.T) {
+	c, opened := newFakeConnector("writer", errors.New("code: 511, message: There is no role `writer` in user directories"))
+
+	if _, err := c.Connect(context.Background()); err == nil {
+		t.Fatal("expected the failed SET ROLE returned")
+	}
+	if conn := opened()[0]; !conn.closed {
+		t.Error("expected the connection closed")
+	}
+}
+
+func TestConnectorSetRoleUnsupported(t *testing.T) {
+	conn := &plainConn{}
+	c := &connector{
+		dsn:  "tcp://127.0.0.1:9000",
+		role: "writer",
+		open: func(string) (driver.Conn, error) { return conn, nil },
+	}
+
+	if _, err := c.Connect(context.Background()); err == nil {
+		t.Fatal("expected a driver without ExecContext rejected")
+	}
+	if !conn.closed {
+		t.Error("expected the connection closed")
+	}
+}
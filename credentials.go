@@ -0,0 +1,308 @@
+package clickhouse
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go"
+)
+
+// replacement of credentials in log output
+const redacted = "xxxxx"
+
+var (
+	// ${NAME} references to environment variables, a bare $ is kept as a
+	// password may well contain one
+	envRefRe = regexp.MustCompile(`\$\{(\w+)\}`)
+
+	// password parameters of DSNs that failed to parse
+	passwordParamRe = regexp.MustCompile(`(password=)[^&\s"]*`)
+
+	// contents of password files by path, read again once modified
+	passwordFilesMu sync.Mutex
+	passwordFiles   = map[string]*passwordFile{}
+)
+
+type passwordFile struct {
+	modTime  time.Time
+	password string
+}
+
+// s with ${NAME} replaced by the environment variable NAME
+func expandEnvRefs(s string) string {
+	return envRefRe.ReplaceAllStringFunc(s, func(ref string) string {
+		return os.Getenv(envRefRe.FindStringSubmatch(ref)[1])
+	})
+}
+
+// the password in the file at path without trailing newlines, read again
+// when the file changed so rotated passwords apply to new connections
+func readPasswordFile(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+
+	passwordFilesMu.Lock()
+	defer passwordFilesMu.Unlock()
+	if cached, ok := passwordFiles[path]; ok && cached.modTime.Equal(info.ModTime()) {
+		return cached.password, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	password := strings.TrimRight(string(data), "\r\n")
+	passwordFiles[path] = &passwordFile{modTime: info.ModTime(), password: password}
+	return password, nil
+}
+
+// dsn with the password read from its password_file parameter, unchanged
+// without one
+func withPasswordFile(dsn string) (string, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	path := query.Get("password_file")
+	if path == "" {
+		return dsn, nil
+	}
+
+	password, err := readPasswordFile(path)
+	if err != nil {
+		return "", err
+	}
+	query.Del("password_file")
+	query.Set("password", password)
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// dsn with its password, header values and proxy password masked, hosts
+// and the other parameters left readable
+func redactDSN(dsn string) string {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return passwordParamRe.ReplaceAllString(dsn, "${1}"+redacted)
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), redacted)
+	}
+	query := u.Query()
+	for name := range query {
+		if name == "password" || strings.HasPrefix(name, "http_header.") {
+			query.Set(name, redacted)
+		}
+	}
+	if proxy, err := url.Parse(query.Get("proxy_url")); err == nil && proxy.User != nil {
+		if _, ok := proxy.User.Password(); ok {
+			proxy.User = url.UserPassword(proxy.User.Username(), redacted)
+			query.Set("proxy_url", proxy.String())
+		}
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// masks the credentials of a DSN wherever they appear in a message, as
+// is and escaped the way URLs carry them
+type credentialRedactor struct {
+	secrets      []string
+	passwordFile string
+}
+
+// redactor of the credentials of dsn, nil if it holds none
+func newCredentialRedactor(dsn string) *credentialRedactor {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil
+	}
+	r := &credentialRedactor{}
+	if password, ok := u.User.Password(); ok {
+		r.add(password)
+	}
+	query := u.Query()
+	r.add(query.Get("password"))
+	r.passwordFile = query.Get("password_file")
+	if proxy, err := url.Parse(query.Get("proxy_url")); err == nil && proxy.User != nil {
+		password, _ := proxy.User.Password()
+		r.add(password)
+	}
+	for name := range query {
+		if !strings.HasPrefix(name, "http_header.") {
+			continue
+		}
+		value := query.Get(name)
+		r.add(value)
+		// the token of "Bearer <token>" may show up on its own
+		if i := strings.IndexByte(value, ' '); i >= 0 {
+			r.add(value[i+1:])
+		}
+	}
+	if len(r.secrets) == 0 && r.passwordFile == "" {
+		return nil
+	}
+	return r
+}
+
+func (r *credentialRedactor) add(secret string) {
+	if secret == "" {
+		return
+	}
+	r.secrets = append(r.secrets, secret, url.QueryEscape(secret), url.PathEscape(secret))
+}
+
+// s with every credential masked
+func (r *credentialRedactor) redact(s string) string {
+	if r == nil {
+		return s
+	}
+	secrets := r.secrets
+	if r.passwordFile != "" {
+		// the file may have been rotated since connecting
+		if password, err := readPasswordFile(r.passwordFile); err == nil && password != "" {
+			secrets = append(secrets, password, url.QueryEscape(password), url.PathEscape(password))
+		}
+	}
+	for _, secret := range secrets {
+		s = strings.Replace(s, secret, redacted, -1)
+	}
+	return s
+}
+
+// err with its message redacted. Errors free of credentials are returned
+// as is, keeping them comparable; server exceptions keep their type so
+// their code is still inspected, other errors are wrapped, network errors
+// remaining network errors failed over on.
+func (r *credentialRedactor) redactError(err error) error {
+	if r == nil || err == nil {
+		return err
+	}
+	msg := r.redact(err.Error())
+	if msg == err.Error() {
+		return err
+	}
+	if exception, ok := err.(*clickhouse.Exception); ok {
+		masked := *exception
+		masked.Message = r.redact(exception.Message)
+		masked.StackTrace = r.redact(exception.StackTrace)
+		return &masked
+	}
+	if _, ok := err.(net.Error); ok {
+		return &redactedNetError{redactedError{err: err, msg: msg}}
+	}
+	return &redactedError{err: err, msg: msg}
+}
+
+// an error with its message redacted, unwrapping to the original
+type redactedError struct {
+	err error
+	msg string
+}
+
+func (e *redactedError) Error() string {
+	return e.msg
+}
+
+func (e *redactedError) Unwrap() error {
+	return e.err
+}
+
+// a redacted net.Error, timing out as the original did
+type redactedNetError struct {
+	redactedError
+}
+
+func (e *redactedNetError) Timeout() bool {
+	return e.err.(net.Error).Timeout()
+}
+
+func (e *redactedNetError) Temporary() bool {
+	return e.err.(net.Error).Temporary()
+}
+
+// database returning errors with the credentials redacted by r, db
+// itself without credentials to redact
+func redactDatabase(db database, r *credentialRedactor) database {
+	if r == nil {
+		return db
+	}
+	return &redactedDatabase{db: db, r: r}
+}
+
+type redactedDatabase struct {
+	db database
+	r  *credentialRedactor
+}
+
+func (d *redactedDatabase) Ping() error {
+	return d.r.redactError(d.db.Ping())
+}
+
+func (d *redactedDatabase) Exec(query string) error {
+	return d.r.redactError(d.db.Exec(query))
+}
+
+func (d *redactedDatabase) QueryRow(query string, dest ...interface{}) error {
+	return d.r.redactError(d.db.QueryRow(query, dest...))
+}
+
+func (d *redactedDatabase) Query(query string) (rows, error) {
+	result, err := d.db.Query(query)
+	if err != nil {
+		return nil, d.r.redactError(err)
+	}
+	return &redactedRows{rows: result, r: d.r}, nil
+}
+
+func (d *redactedDatabase) Batch(ctx context.Context, query string) (batch, error) {
+	b, err := d.db.Batch(ctx, query)
+	if err != nil {
+		return nil, d.r.redactError(err)
+	}
+	return &redactedBatch{batch: b, r: d.r}, nil
+}
+
+func (d *redactedDatabase) Close() error {
+	return d.r.redactError(d.db.Close())
+}
+
+type redactedRows struct {
+	rows
+	r *credentialRedactor
+}
+
+func (r *redactedRows) Scan(dest ...interface{}) error {
+	return r.r.redactError(r.rows.Scan(dest...))
+}
+
+func (r *redactedRows) Err() error {
+	return r.r.redactError(r.rows.Err())
+}
+
+type redactedBatch struct {
+	batch
+	r *credentialRedactor
+}
+
+func (b *redactedBatch) Append(values ...interface{}) error {
+	return b.r.redactError(b.batch.Append(values...))
+}
+
+func (b *redactedBatch) Send() error {
+	return b.r.redactError(b.batch.Send())
+}
+
+func (b *redactedBatch) Abort() error {
+	return b.r.redactError(b.batch.Abort())
+}
@@ -0,0 +1,152 @@
+package clickhouse
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// the operations the plugin performs on a ClickHouse connection
+type database interface {
+	Ping() error
+	Exec(query string) error
+	// scan the single result row of query into dest
+	QueryRow(query string, dest ...interface{}) error
+	Query(query string) (rows, error)
+	// start an INSERT batch, the query's VALUES placeholders are bound by
+	// batch.Append. The batch is abandoned once ctx is done.
+	Batch(ctx context.Context, query string) (batch, error)
+	Close() error
+}
+
+// rows of a query result
+type rows interface {
+	Next() bool
+	Scan(dest ...interface{}) error
+	Err() error
+	Close() error
+}
+
+// rows of an INSERT sent to the server as a whole
+type batch interface {
+	Append(values ...interface{}) error
+	Send() error
+	Abort() error
+}
+
+// connection pool limits, zero leaves the default
+type poolLimits struct {
+	maxOpen     int
+	maxIdle     int
+	maxLifetime time.Duration
+}
+
+// database holding a pool of connections that can be bounded
+type pooledDatabase interface {
+	setPoolLimits(limits poolLimits)
+}
+
+// database backed by database/sql and the clickhouse-go driver
+type sqlDatabase struct {
+	db *sql.DB
+}
+
+// open the database of dsn, speaking HTTP for http:// and https:// DSNs
+// and the native protocol otherwise
+func openDSN(dsn string, role string) (database, error) {
+	if strings.HasPrefix(dsn, "http://") || strings.HasPrefix(dsn, "https://") {
+		return openHTTPDatabase(dsn, role)
+	}
+	return openSQLDatabase(dsn, role), nil
+}
+
+func openSQLDatabase(dsn string, role string) database {
+	return &sqlDatabase{db: sql.OpenDB(&connector{dsn: dsn, role: role})}
+}
+
+func (d *sqlDatabase) Ping() error {
+	return d.db.Ping()
+}
+
+func (d *sqlDatabase) Exec(query string) error {
+	_, err := d.db.Exec(query)
+	return err
+}
+
+func (d *sqlDatabase) QueryRow(query string, dest ...interface{}) error {
+	return d.db.QueryRow(query).Scan(dest...)
+}
+
+func (d *sqlDatabase) Query(query string) (rows, error) {
+	return d.db.Query(query)
+}
+
+func (d *sqlDatabase) Batch(ctx context.Context, query string) (batch, error) {
+	// the driver only accepts inserts in a transaction, sent on commit
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	stmt, err := tx.PrepareContext(ctx, query)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return &sqlBatch{ctx: ctx, tx: tx, stmt: stmt}, nil
+}
+
+func (d *sqlDatabase) setPoolLimits(limits poolLimits) {
+	if limits.maxOpen > 0 {
+		d.db.SetMaxOpenConns(limits.maxOpen)
+	}
+	if limits.maxIdle > 0 {
+		d.db.SetMaxIdleConns(limits.maxIdle)
+	}
+	if limits.maxLifetime > 0 {
+		d.db.SetConnMaxLifetime(limits.maxLifetime)
+	}
+}
+
+func (d *sqlDatabase) Close() error {
+	return d.db.Close()
+}
+
+type sqlBatch struct {
+	ctx  context.Context
+	tx   *sql.Tx
+	stmt *sql.Stmt
+}
+
+func (b *sqlBatch) Append(values ...interface{}) error {
+	_, err := b.stmt.ExecContext(b.ctx, values...)
+	return err
+}
+
+// commit the transaction, sending the rows. Commit itself does not watch
+// the context, once it is done the commit is abandoned and left to the
+// driver's read and write timeouts; the server may still store the rows.
+func (b *sqlBatch) Send() error {
+	if b.ctx.Done() == nil {
+		defer b.stmt.Close()
+		return b.tx.Commit()
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		defer b.stmt.Close()
+		done <- b.tx.Commit()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-b.ctx.Done():
+		return b.ctx.Err()
+	}
+}
+
+func (b *sqlBatch) Abort() error {
+	b.stmt.Close()
+	return b.tx.Rollback()
+}
@@ -0,0 +1,231 @@
+package clickhouse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// in-memory database recording the statements issued by the plugin
+type mockDatabase struct {
+	mu sync.Mutex
+
+	pingErr error
+	// errors of Exec for statements starting with a prefix
+	execErrs map[string]error
+	// result rows of queries containing a substring
+	results map[string][][]interface{}
+	// error of Append for a row, nil to accept it
+	appendErr func(values []interface{}) error
+	sendErr   error
+	// errors of the next Sends, consumed in order before sendErr, nil
+	// letting the Send succeed
+	sendErrs []error
+	// Sends block until closed or their context is done
+	sendBlock chan struct{}
+
+	execs   []string
+	queries []string
+	batches []*mockBatch
+	closed  bool
+}
+
+func newMockDatabase() *mockDatabase {
+	return &mockDatabase{
+		execErrs: make(map[string]error),
+		results: map[string][][]interface{}{
+			"SELECT version()": {{"23.8.2.7"}},
+			"system.settings":  {{"async_insert", "0"}},
+		},
+	}
+}
+
+func (d *mockDatabase) Ping() error {
+	return d.pingErr
+}
+
+func (d *mockDatabase) Exec(query string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.execs = append(d.execs, query)
+	for prefix, err := range d.execErrs {
+		if strings.HasPrefix(strings.TrimSpace(query), prefix) {
+			return err
+		}
+	}
+	return nil
+}
+
+// result of the longest substring of query with a result, recording the
+// query
+func (d *mockDatabase) result(query string) [][]interface{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.queries = append(d.queries, query)
+
+	match := ""
+	var result [][]interface{}
+	for substr, rows := range d.results {
+		if strings.Contains(query, substr) && len(substr) > len(match) {
+			match, result = substr, rows
+		}
+	}
+	return result
+}
+
+func (d *mockDatabase) QueryRow(query string, dest ...interface{}) error {
+	result := d.result(query)
+	if len(result) == 0 {
+		return fmt.Errorf("no result for %q", query)
+	}
+	return scanRow(result[0], dest)
+}
+
+func (d *mockDatabase) Query(query string) (rows, error) {
+	return &mockRows{rows: d.result(query), next: -1}, nil
+}
+
+func (d *mockDatabase) Batch(ctx context.Context, query string) (batch, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	b := &mockBatch{ctx: ctx, db: d, query: query}
+	d.batches = append(d.batches, b)
+	return b, nil
+}
+
+func (d *mockDatabase) Close() error {
+	d.closed = true
+	return nil
+}
+
+// statements executed starting with prefix
+func (d *mockDatabase) execsWithPrefix(prefix string) []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var execs []string
+	for _, query := range d.execs {
+		if strings.HasPrefix(strings.TrimSpace(query), prefix) {
+			execs = append(execs, query)
+		}
+	}
+	return execs
+}
+
+// queries issued containing substr
+func (d *mockDatabase) queriesContaining(substr string) []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var queries []string
+	for _, query := range d.queries {
+		if strings.Contains(query, substr) {
+			queries = append(queries, query)
+		}
+	}
+	return queries
+}
+
+// sent batches inserting into table
+func (d *mockDatabase) sentBatches(table string) []*mockBatch {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var batches []*mockBatch
+	for _, b := range d.batches {
+		if b.sent && strings.HasPrefix(b.query, "INSERT INTO "+table+"(") {
+			batches = append(batches, b)
+		}
+	}
+	return batches
+}
+
+type mockBatch struct {
+	ctx     context.Context
+	db      *mockDatabase
+	query   string
+	rows    [][]interface{}
+	sent    bool
+	aborted bool
+}
+
+func (b *mockBatch) Append(values ...interface{}) error {
+	if b.db.appendErr != nil {
+		if err := b.db.appendErr(values); err != nil {
+			return err
+		}
+	}
+	b.rows = append(b.rows, values)
+	return nil
+}
+
+func (b *mockBatch) Send() error {
+	if b.db.sendBlock != nil {
+		select {
+		case <-b.db.sendBlock:
+		case <-b.ctx.Done():
+			return b.ctx.Err()
+		}
+	}
+
+	b.db.mu.Lock()
+	if len(b.db.sendErrs) > 0 {
+		err := b.db.sendErrs[0]
+		b.db.sendErrs = b.db.sendErrs[1:]
+		b.db.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	} else {
+		b.db.mu.Unlock()
+		if b.db.sendErr != nil {
+			return b.db.sendErr
+		}
+	}
+	b.sent = true
+	return nil
+}
+
+func (b *mockBatch) Abort() error {
+	b.aborted = true
+	return nil
+}
+
+type mockRows struct {
+	rows [][]interface{}
+	next int
+}
+
+func (r *mockRows) Next() bool {
+	r.next++
+	return r.next < len(r.rows)
+}
+
+func (r *mockRows) Scan(dest ...interface{}) error {
+	return scanRow(r.rows[r.next], dest)
+}
+
+func (r *mockRows) Err() error {
+	return nil
+}
+
+func (r *mockRows) Close() error {
+	return nil
+}
+
+func scanRow(row []interface{}, dest []interface{}) error {
+	if len(row) != len(dest) {
+		return errors.New("column count mismatch")
+	}
+	for i, v := range row {
+		target := reflect.ValueOf(dest[i]).Elem()
+		target.Set(reflect.ValueOf(v).Convert(target.Type()))
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package clickhouse
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go"
+)
+
+// server error codes of a user lacking DDL privileges
+const (
+	readonly     = 164
+	accessDenied = 497
+)
+
+// report whether err denies the user the privileges for a statement
+func isAccessDenied(err error) bool {
+	exception, ok := err.(*clickhouse.Exception)
+	return ok && (exception.Code == accessDenied || exception.Code == readonly)
+}
+
+// an audit record of a DDL statement issued by the plugin
+type ddlAuditRecord struct {
+	Timestamp time.Time `json:"timestamp"`
+	Target    string    `json:"target"`
+	Statement string    `json:"statement"`
+	Outcome   string    `json:"outcome"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// ON CLUSTER clause running DDL on every node of the cluster, empty
+// without one
+func (c *ClickhouseClient) onCluster() string {
+	if c.Cluster == "" {
+		return ""
+	}
+	return " ON CLUSTER " + quoteIdentifier(c.Cluster)
+}
+
+// placeholders of a create_table_template
+type createTableData struct {
+	Database  string
+	Table     string
+	OnCluster string
+	// column definitions separated by commas
+	Columns string
+	// engine clause the plugin would use
+	Engine string
+}
+
+// template of the CREATE TABLE of the generated tables, inline or read
+// from its file, nil without one
+func (c *ClickhouseClient) loadCreateTableTemplate() (*template.Template, error) {
+	text := c.CreateTableTemplate
+	switch {
+	case text != "" && c.CreateTableTemplateFile != "":
+		return nil, errors.New("create_table_template and create_table_template_file are mutually exclusive")
+	case c.CreateTableTemplateFile != "":
+		data, err := ioutil.ReadFile(c.CreateTableTemplateFile)
+		if err != nil {
+			return nil, err
+		}
+		text = string(data)
+	case text == "":
+		return nil, nil
+	}
+	return template.New("create_table_template").Parse(text)
+}
+
+// execute a DDL statement against target and record it in the audit log.
+// Once the user turns out to lack DDL privileges the plugin continues
+// insert-only and skips all further DDL.
+func (c *ClickhouseClient) execDDL(target string, stmt string) error {
+	if atomic.LoadInt32(&c.insertOnly) != 0 {
+		return nil
+	}
+
+	err := c.db.Exec(stmt)
+
+	record := ddlAuditRecord{
+		Timestamp: time.Now().UTC(),
+		Target:    target,
+		Statement: strings.Join(strings.Fields(stmt), " "),
+		Outcome:   "success",
+	}
+	if err != nil {
+		record.Outcome = "failure"
+		record.Error = err.Error()
+		if !isAccessDenied(err) {
+			log.Printf("E! [outputs.clickhouse] DDL on %s failed: %s: %s", record.Target, record.Statement, record.Error)
+		}
+	} else {
+		log.Printf("I! [outputs.clickhouse] DDL on %s: %s", record.Target, record.Statement)
+	}
+
+	if c.DDLAuditFile != "" {
+		if auditErr := appendDDLAudit(c.DDLAuditFile, record); auditErr != nil {
+			log.Printf("E! [outputs.clickhouse] Unable to write DDL audit file %s: %s", c.DDLAuditFile, auditErr.Error())
+		}
+	}
+
+	if err != nil && isAccessDenied(err) {
+		if atomic.CompareAndSwapInt32(&c.insertOnly, 0, 1) {
+			log.Printf("W! [outputs.clickhouse] User lacks DDL privileges, continuing insert-only without managing the schema: %s", err.Error())
+		}
+		return nil
+	}
+
+	return err
+}
+
+// append record as a JSON line to the audit file
+func appendDDLAudit(path string, record ddlAuditRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+
+	if _, err = f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
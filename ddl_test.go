@@ -0,0 +1,168 @@
+package clickhouse
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go"
+)
+
+// records of the DDL audit file at path
+func readDDLAudit(t *testing.T, path string) []ddlAuditRecord {
+	t.Helper()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read audit file: %v", err)
+	}
+	var records []ddlAuditRecord
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		var record ddlAuditRecord
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("audit line %q: %v", line, err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestExecDDLAudit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ddl.log")
+	db := newMockDatabase()
+	db.execErrs["ALTER TABLE telegraf.broken"] = errors.New("code: 60, message: Table telegraf.broken doesn't exist")
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.DDLAuditFile = path
+	})
+
+	before := time.Now().UTC().Add(-time.Second)
+	if err := c.execDDL("telegraf.metrics", "ALTER TABLE telegraf.metrics\n\t\tADD COLUMN IF NOT EXISTS host String"); err != nil {
+		t.Fatalf("execDDL: %v", err)
+	}
+	if err := c.execDDL("telegraf.broken", "ALTER TABLE telegraf.broken DROP COLUMN host"); err == nil {
+		t.Fatal("expected the failed DDL returned")
+	}
+
+	records := readDDLAudit(t, path)
+	if len(records) != 2 {
+		t.Fatalf("expected 2 audit records, got %d", len(records))
+	}
+
+	success := records[0]
+	if success.Target != "telegraf.metrics" || success.Outcome != "success" || success.Error != "" {
+		t.Errorf("unexpected success record %+v", success)
+	}
+	// whitespace of the statement collapsed to a single line
+	if want := "ALTER TABLE telegraf.metrics ADD COLUMN IF NOT EXISTS host String"; success.Statement != want {
+		t.Errorf("expected statement %q, got %q", want, success.Statement)
+	}
+	if success.Timestamp.Before(before) || success.Timestamp.Location() != time.UTC {
+		t.Errorf("expected a current UTC timestamp, got %s", success.Timestamp)
+	}
+
+	failure := records[1]
+	if failure.Target != "telegraf.broken" || failure.Outcome != "failure" ||
+		failure.Error != "code: 60, message: Table telegraf.broken doesn't exist" {
+		t.Errorf("unexpected failure record %+v", failure)
+	}
+	if atomic.LoadInt32(&c.insertOnly) != 0 {
+		t.Error("expected other DDL errors to keep managing the schema")
+	}
+}
+
+func TestExecDDLAuditLineFormat(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ddl.log")
+	db := newMockDatabase()
+	db.execErrs["DROP"] = errors.New("denied")
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.DDLAuditFile = path
+	})
+
+	c.execDDL("telegraf.metrics", "OPTIMIZE TABLE telegraf.metrics FINAL")
+	c.execDDL("telegraf.metrics", "DROP TABLE telegraf.metrics")
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read audit file: %v", err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected a line per statement, got %q", data)
+	}
+	for i, line := range lines {
+		var fields map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &fields); err != nil {
+			t.Fatalf("line %q: %v", line, err)
+		}
+		want := []string{"timestamp", "target", "statement", "outcome"}
+		if i == 1 {
+			want = append(want, "error")
+		}
+		if len(fields) != len(want) {
+			t.Errorf("expected the fields %v, got %q", want, line)
+		}
+		for _, key := range want {
+			if _, ok := fields[key]; !ok {
+				t.Errorf("expected %s in %q", key, line)
+			}
+		}
+	}
+	if !strings.HasPrefix(lines[0], `{"timestamp":"`) {
+		t.Errorf("expected the timestamp first, got %q", lines[0])
+	}
+}
+
+func TestExecDDLInsertOnlyFallback(t *testing.T) {
+	for _, code := range []int32{accessDenied, readonly} {
+		path := filepath.Join(t.TempDir(), "ddl.log")
+		db := newMockDatabase()
+		db.execErrs["CREATE TABLE"] = &clickhouse.Exception{Code: code, Message: "Not enough privileges"}
+		c := newTestClient(t, db, func(c *ClickhouseClient) {
+			c.DDLAuditFile = path
+		})
+
+		// the denial is not an error, the plugin continues insert-only
+		if err := c.execDDL("telegraf.metrics", "CREATE TABLE telegraf.metrics(ts DateTime) ENGINE=Log"); err != nil {
+			t.Errorf("code %d: expected no error, got %v", code, err)
+		}
+		if atomic.LoadInt32(&c.insertOnly) != 1 {
+			t.Errorf("code %d: expected insert-only", code)
+		}
+
+		// further DDL is skipped without reaching the server or the audit file
+		if err := c.execDDL("telegraf.other", "ALTER TABLE telegraf.other ADD COLUMN host String"); err != nil {
+			t.Errorf("code %d: expected no error, got %v", code, err)
+		}
+		if n := len(db.execsWithPrefix("ALTER TABLE")); n != 0 {
+			t.Errorf("code %d: expected DDL skipped while insert-only, got %d", code, n)
+		}
+
+		records := readDDLAudit(t, path)
+		if len(records) != 1 || records[0].Outcome != "failure" || !strings.Contains(records[0].Error, "Not enough privileges") {
+			t.Errorf("code %d: expected the denied statement audited, got %+v", code, records)
+		}
+	}
+}
+
+func TestIsAccessDenied(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&clickhouse.Exception{Code: accessDenied}, true},
+		{&clickhouse.Exception{Code: readonly}, true},
+		{&clickhouse.Exception{Code: 60}, false},
+		{errors.New("code: 497"), false},
+		{nil, false},
+	}
+	for _, test := range tests {
+		if got := isAccessDenied(test.err); got != test.want {
+			t.Errorf("isAccessDenied(%v) = %v, want %v", test.err, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package clickhouse
+
+import (
+	"github.com/ClickHouse/clickhouse-go"
+	"github.com/influxdata/telegraf"
+)
+
+// server error codes of inserts that fail the same way on every retry
+var permanentErrorCodes = map[int32]bool{
+	6:   true, // CANNOT_PARSE_TEXT
+	16:  true, // NO_SUCH_COLUMN_IN_TABLE
+	27:  true, // CANNOT_PARSE_INPUT_ASSERTION_FAILED
+	41:  true, // CANNOT_PARSE_DATETIME
+	47:  true, // UNKNOWN_IDENTIFIER
+	53:  true, // TYPE_MISMATCH
+	62:  true, // SYNTAX_ERROR
+	69:  true, // ARGUMENT_OUT_OF_BOUND
+	70:  true, // CANNOT_CONVERT_TYPE
+	117: true, // INCORRECT_DATA
+}
+
+// report whether an insert failing with err cannot succeed when retried
+func isPermanentError(err error) bool {
+	exception, ok := err.(*clickhouse.Exception)
+	return ok && permanentErrorCodes[exception.Code]
+}
+
+// apply the redact, transform and derive steps to metric. Each step may
+// return a copy; intermediate copies are dropped right away since copies
+// of a tracked metric hold a reference on its delivery.
+func (c *ClickhouseClient) preprocess(metric telegraf.Metric) telegraf.Metric {
+	var steps []func(telegraf.Metric) telegraf.Metric
+	if len(c.Redact) > 0 {
+		steps = append(steps, c.redact)
+	}
+	if len(c.Transform) > 0 {
+		steps = append(steps, c.transform)
+	}
+	if len(c.Derived) > 0 {
+		steps = append(steps, c.derive)
+	}
+
+	m := metric
+	for _, step := range steps {
+		next := step(m)
+		if next != m && m != metric {
+			m.Drop()
+		}
+		m = next
+	}
+	return m
+}
+
+// reject the tracked delivery of the metric a row was converted from,
+// once per flush. Telegraf accepts the whole batch after Write returns,
+// rejecting a copy marks the delivery failed without releasing the
+// metric's own reference twice.
+func (s *writeStats) rejectSource(row insertRow) {
+	m := row.metric.source
+	if m == nil {
+		return
+	}
+	if _, ok := s.rejectedSources[m]; ok {
+		return
+	}
+	s.rejectedSources[m] = struct{}{}
+	m.Copy().Reject()
+}
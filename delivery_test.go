@@ -0,0 +1,97 @@
+package clickhouse
+
+import (
+	"testing"
+
+	"github.com/ClickHouse/clickhouse-go"
+	"github.com/influxdata/telegraf"
+)
+
+// delivery of a tracked metric and its copies
+type trackingDelivery struct {
+	refs     int
+	accepted int
+	rejected int
+}
+
+// a metric with Telegraf's tracking semantics: every copy holds a
+// reference on the shared delivery
+type trackedMetric struct {
+	telegraf.Metric
+	d *trackingDelivery
+}
+
+func track(m telegraf.Metric) (*trackedMetric, *trackingDelivery) {
+	d := &trackingDelivery{refs: 1}
+	return &trackedMetric{Metric: m, d: d}, d
+}
+
+func (m *trackedMetric) Copy() telegraf.Metric {
+	m.d.refs++
+	return &trackedMetric{Metric: m.Metric.Copy(), d: m.d}
+}
+
+func (m *trackedMetric) Accept() { m.d.accepted++; m.d.refs-- }
+func (m *trackedMetric) Reject() { m.d.rejected++; m.d.refs-- }
+func (m *trackedMetric) Drop()   { m.d.refs-- }
+
+func TestWriteReleasesCopiesOfTrackedMetrics(t *testing.T) {
+	db := newMockDatabase()
+	scale := 2.0
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.Transform = []*transformRule{{Measurement: "cpu", Fields: []string{"*"}, Scale: &scale}}
+		c.Derived = []*derivedField{{Measurement: "cpu", Field: "usage_total", Expression: "usage_idle + usage_user"}}
+	})
+
+	m, d := track(testBatch()[0])
+	if err := c.Write([]telegraf.Metric{m}); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	// the original is accepted by Telegraf once Write returns
+	if d.refs != 1 || d.rejected != 0 {
+		t.Errorf("expected only the original referenced, got %+v", *d)
+	}
+}
+
+func TestWriteRejectsPermanentErrors(t *testing.T) {
+	db := newMockDatabase()
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.PermanentErrors = "reject"
+	})
+
+	var metrics []telegraf.Metric
+	var deliveries []*trackingDelivery
+	for _, m := range testBatch() {
+		tracked, d := track(m)
+		metrics = append(metrics, tracked)
+		deliveries = append(deliveries, d)
+	}
+
+	db.sendErr = &clickhouse.Exception{Code: 53, Message: "Type mismatch"}
+	if err := c.Write(metrics); err != nil {
+		t.Fatalf("expected rejected batch to be dropped, got %v", err)
+	}
+
+	for i, d := range deliveries {
+		if d.rejected != 1 || d.refs != 1 {
+			t.Errorf("metric %d: expected rejected once and the original referenced, got %+v", i, *d)
+		}
+	}
+}
+
+func TestWriteRetriesTransientErrors(t *testing.T) {
+	db := newMockDatabase()
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.PermanentErrors = "reject"
+	})
+
+	m, d := track(testBatch()[0])
+	db.sendErr = &clickhouse.Exception{Code: 252, Message: "Too many parts"}
+	if err := c.Write([]telegraf.Metric{m}); err == nil {
+		t.Fatal("expected write to fail")
+	}
+	if d.rejected != 0 {
+		t.Errorf("expected no rejection, got %+v", *d)
+	}
+}
@@ -0,0 +1,282 @@
+package clickhouse
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go"
+)
+
+// how native connections to a host are established
+type dialSettings struct {
+	// HTTP CONNECT or SOCKS5 proxy tunneling the connection
+	proxy *url.URL
+	// interval of TCP keep-alive probes, zero for the OS default
+	keepAlive time.Duration
+	// hosts skipped after failing to accept connections
+	cooldown *hostCooldown
+}
+
+var (
+	// the driver takes a single dial function for the whole process, it
+	// looks up the settings of the address dialed
+	registerDialOnce sync.Once
+	dialSettingsMu   sync.RWMutex
+	dialRegistry     = map[string]*dialSettings{}
+)
+
+// parse a proxy_url, supported by the native dialer and the HTTP transport
+func parseProxyURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported proxy_url scheme %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("proxy_url %q has no host", raw)
+	}
+	return u, nil
+}
+
+// dial settings of the native connections to hosts, replacing any
+// registered before for the same addresses
+func registerDialSettings(hosts []string, settings *dialSettings) {
+	registerDialOnce.Do(func() {
+		clickhouse.RegisterDial(dial)
+	})
+
+	dialSettingsMu.Lock()
+	defer dialSettingsMu.Unlock()
+	for _, host := range hosts {
+		dialRegistry[host] = settings
+	}
+}
+
+func deregisterDialSettings(hosts []string) {
+	dialSettingsMu.Lock()
+	defer dialSettingsMu.Unlock()
+	for _, host := range hosts {
+		delete(dialRegistry, host)
+	}
+}
+
+// register the dial settings of the client for its current hosts
+func (c *ClickhouseClient) registerDial() {
+	if c.dialSettings == nil {
+		return
+	}
+	deregisterDialSettings(c.dialHosts)
+	c.dialHosts = c.hosts()
+	c.dialSettings.cooldown.setHosts(c.dialHosts)
+	registerDialSettings(c.dialHosts, c.dialSettings)
+}
+
+func (c *ClickhouseClient) deregisterDial() {
+	deregisterDialSettings(c.dialHosts)
+	c.dialHosts = nil
+}
+
+// the dial function of the driver, connecting directly unless settings
+// are registered for address
+func dial(network, address string, timeout time.Duration, tlsConfig *tls.Config) (net.Conn, error) {
+	dialSettingsMu.RLock()
+	settings := dialRegistry[address]
+	dialSettingsMu.RUnlock()
+
+	dialer := &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	var err error
+	switch {
+	case settings == nil:
+		conn, err = dialer.Dial(network, address)
+	case settings.cooldown.cooling(address):
+		// the driver moves on to the next host
+		return nil, fmt.Errorf("skipping %s within failover_cooldown", address)
+	case settings.proxy != nil:
+		dialer.KeepAlive = settings.keepAlive
+		conn, err = dialProxy(dialer, settings.proxy, address)
+	default:
+		dialer.KeepAlive = settings.keepAlive
+		conn, err = dialer.Dial(network, address)
+	}
+	if settings != nil {
+		if err != nil {
+			settings.cooldown.fail(address)
+		} else {
+			settings.cooldown.recover(address)
+		}
+	}
+	if err != nil || tlsConfig == nil {
+		return conn, err
+	}
+
+	if tlsConfig.ServerName == "" {
+		if host, _, err := net.SplitHostPort(address); err == nil {
+			tlsConfig = tlsConfig.Clone()
+			tlsConfig.ServerName = host
+		}
+	}
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// open a connection to address tunneled through proxy
+func dialProxy(dialer *net.Dialer, proxy *url.URL, address string) (net.Conn, error) {
+	conn, err := dialer.Dial("tcp", proxy.Host)
+	if err != nil {
+		return nil, err
+	}
+	if dialer.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(dialer.Timeout))
+	}
+
+	switch proxy.Scheme {
+	case "http":
+		err = httpConnect(conn, proxy, address)
+	default:
+		err = socks5Connect(conn, proxy, address)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: %s", proxy.Host, err.Error())
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// establish an HTTP CONNECT tunnel to address
+func httpConnect(conn net.Conn, proxy *url.URL, address string) error {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: http.Header{},
+	}
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxy.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+
+	// the native protocol has the client speak first, nothing beyond the
+	// response is buffered
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("CONNECT %s: %s", address, resp.Status)
+	}
+	return nil
+}
+
+// establish a SOCKS5 (RFC 1928) connection to address, authenticating
+// with the proxy's user info if present (RFC 1929)
+func socks5Connect(conn net.Conn, proxy *url.URL, address string) error {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return err
+	}
+	if len(host) > 255 {
+		return errors.New("host name too long")
+	}
+
+	method := byte(0x00)
+	if proxy.User != nil {
+		method = 0x02
+	}
+	if _, err := conn.Write([]byte{0x05, 0x01, method}); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != 0x05 || reply[1] != method {
+		return errors.New("no acceptable authentication method")
+	}
+
+	if method == 0x02 {
+		user := proxy.User.Username()
+		password, _ := proxy.User.Password()
+		if len(user) > 255 || len(password) > 255 {
+			return errors.New("credentials too long")
+		}
+		auth := []byte{0x01, byte(len(user))}
+		auth = append(auth, user...)
+		auth = append(auth, byte(len(password)))
+		auth = append(auth, password...)
+		if _, err := conn.Write(auth); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0x00 {
+			return errors.New("authentication failed")
+		}
+	}
+
+	// CONNECT by domain name, resolved by the proxy
+	req := []byte{0x05, 0x01, 0x00, 0x03, byte(len(host))}
+	req = append(req, host...)
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[1] != 0x00 {
+		return fmt.Errorf("connect failed with reply %d", header[1])
+	}
+	var skip int
+	switch header[3] {
+	case 0x01:
+		skip = net.IPv4len
+	case 0x04:
+		skip = net.IPv6len
+	case 0x03:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return err
+		}
+		skip = int(length[0])
+	default:
+		return fmt.Errorf("unknown address type %d", header[3])
+	}
+	// the address and port bound by the proxy, unused
+	bound := make([]byte, skip+2)
+	if _, err := io.ReadFull(conn, bound); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package clickhouse
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/influxdata/telegraf/config"
+)
+
+// listener echoing everything it receives
+func newEchoServer(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// proxy accepting a single connection, handshake reads the tunnel request
+// and returns the address to connect to
+func newTestProxy(t *testing.T, handshake func(conn net.Conn, r *bufio.Reader) string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		target, err := net.Dial("tcp", handshake(conn, r))
+		if err != nil {
+			return
+		}
+		defer target.Close()
+		go io.Copy(target, r)
+		io.Copy(conn, target)
+	}()
+	return l.Addr().String()
+}
+
+func assertEcho(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("expected the tunnel to echo, got %q, %v", buf, err)
+	}
+}
+
+func TestDialHTTPProxy(t *testing.T) {
+	echo := newEchoServer(t)
+	var auth string
+	proxy := newTestProxy(t, func(conn net.Conn, r *bufio.Reader) string {
+		req, err := http.ReadRequest(r)
+		if err != nil {
+			return ""
+		}
+		auth = req.Header.Get("Proxy-Authorization")
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		return req.Host
+	})
+
+	u, _ := url.Parse("http://user:secret@" + proxy)
+	conn, err := dialProxy(&net.Dialer{Timeout: 5 * time.Second}, u, echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEcho(t, conn)
+	if auth != "Basic dXNlcjpzZWNyZXQ=" {
+		t.Errorf("expected basic proxy credentials, got %q", auth)
+	}
+}
+
+func TestDialSOCKS5Proxy(t *testing.T) {
+	echo := newEchoServer(t)
+	proxy := newTestProxy(t, func(conn net.Conn, r *bufio.Reader) string {
+		greeting := make([]byte, 3)
+		io.ReadFull(r, greeting)
+		conn.Write([]byte{0x05, 0x00})
+
+		header := make([]byte, 5)
+		io.ReadFull(r, header)
+		host := make([]byte, header[4])
+		io.ReadFull(r, host)
+		port := make([]byte, 2)
+		io.ReadFull(r, port)
+		conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 127, 0, 0, 1, 0, 0})
+		return net.JoinHostPort(string(host), strconv.Itoa(int(port[0])<<8|int(port[1])))
+	})
+
+	u, _ := url.Parse("socks5://" + proxy)
+	conn, err := dialProxy(&net.Dialer{Timeout: 5 * time.Second}, u, echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEcho(t, conn)
+}
+
+func TestParseProxyURL(t *testing.T) {
+	for _, raw := range []string{"ftp://proxy:21", "socks5://", "://"} {
+		if _, err := parseProxyURL(raw); err == nil {
+			t.Errorf("expected %q to be rejected", raw)
+		}
+	}
+}
+
+func TestConnectRegistersDialSettings(t *testing.T) {
+	c := newTestClient(t, newMockDatabase(), func(c *ClickhouseClient) {
+		c.DialTimeout = config.Duration(2500 * time.Millisecond)
+		c.TCPKeepAlivePeriod = config.Duration(30 * time.Second)
+	})
+
+	if !strings.Contains(c.DBI, "timeout=2.5") {
+		t.Errorf("expected the dial timeout in %s", c.DBI)
+	}
+	dialSettingsMu.RLock()
+	settings := dialRegistry["127.0.0.1:9000"]
+	dialSettingsMu.RUnlock()
+	if settings == nil || settings.keepAlive != 30*time.Second || settings.proxy != nil {
+		t.Errorf("expected a 30s keep-alive for the host, got %+v", settings)
+	}
+}
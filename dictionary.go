@@ -0,0 +1,67 @@
+package clickhouse
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// a MATERIALIZED column of the generated DDL resolving a tag through an
+// existing dictionary, e.g. host to datacenter
+type dictionaryColumn struct {
+	Name       string `toml:"name"`
+	Dictionary string `toml:"dictionary"`
+	Attribute  string `toml:"attribute"`
+	KeyTag     string `toml:"key_tag"`
+	// UInt64 keyed dictionary, the tag value is converted to a number
+	NumericKey bool   `toml:"numeric_key"`
+	Type       string `toml:"type"`
+
+	// name of the column after resolving collisions
+	column string
+}
+
+func (d *dictionaryColumn) init() error {
+	if d.Name == "" || d.Dictionary == "" || d.Attribute == "" || d.KeyTag == "" {
+		return fmt.Errorf("dictionary column %q needs name, dictionary, attribute and key_tag", d.Name)
+	}
+	if d.Type == "" {
+		d.Type = "String"
+	}
+	return nil
+}
+
+// the dictGet expression of the column over the tags column
+func (c *ClickhouseClient) dictionaryExpr(d *dictionaryColumn) string {
+	dictionary := d.Dictionary
+	if !strings.Contains(dictionary, ".") {
+		dictionary = c.Database + "." + dictionary
+	}
+
+	key := c.tagExpr(d.KeyTag)
+	if d.NumericKey {
+		key = "toUInt64OrZero(" + key + ")"
+	} else {
+		key = "tuple(" + key + ")"
+	}
+	return fmt.Sprintf("dictGet(%s, %s, %s)", quoteString(dictionary), quoteString(d.Attribute), key)
+}
+
+// assign the dictionary columns names unique among the columns of namer
+func (c *ClickhouseClient) resolveDictionaryColumns(namer *columnNamer) {
+	for _, d := range c.DictionaryColumns {
+		d.column = namer.name(d.Name)
+		if d.column != d.Name {
+			log.Printf("W! [outputs.clickhouse] Dictionary column %q is created as %s", d.Name, d.column)
+		}
+	}
+}
+
+// definitions of the dictionary columns of the table holding the tags
+func (c *ClickhouseClient) dictionaryColumnDefs() []columnDef {
+	defs := make([]columnDef, 0, len(c.DictionaryColumns))
+	for _, d := range c.DictionaryColumns {
+		defs = append(defs, columnDef{name: d.column, typ: d.Type, materialized: c.dictionaryExpr(d)})
+	}
+	return defs
+}
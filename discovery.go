@@ -0,0 +1,196 @@
+package clickhouse
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	lookupSRV = net.LookupSRV
+
+	// host discoveries referenced by the host_discovery parameter of DSNs,
+	// consulted whenever a connection is opened
+	discoveriesMu sync.RWMutex
+	discoveries   = map[string]*hostDiscovery{}
+)
+
+// the hosts behind a DNS SRV record as of the last resolution
+type hostDiscovery struct {
+	record string
+
+	mu    sync.RWMutex
+	hosts []string
+}
+
+// resolve record into host:port addresses, ordered by priority and by
+// address within a priority. The resolver shuffles the records of a
+// priority by weight, which would change the hosts on every resolution.
+func resolveSRV(record string) ([]string, error) {
+	_, addrs, err := lookupSRV("", "", record)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no SRV records found for %s", record)
+	}
+
+	addrs = append([]*net.SRV{}, addrs...)
+	sort.SliceStable(addrs, func(i, j int) bool {
+		a, b := addrs[i], addrs[j]
+		if a.Priority != b.Priority {
+			return a.Priority < b.Priority
+		}
+		if a.Target != b.Target {
+			return a.Target < b.Target
+		}
+		return a.Port < b.Port
+	})
+
+	hosts := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		host := strings.TrimSuffix(addr.Target, ".")
+		hosts = append(hosts, net.JoinHostPort(host, strconv.Itoa(int(addr.Port))))
+	}
+	return hosts, nil
+}
+
+func (d *hostDiscovery) current() []string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.hosts
+}
+
+// resolve the record again, keeping the previous hosts on failure. Reports
+// whether the hosts changed.
+func (d *hostDiscovery) refresh() (bool, error) {
+	hosts, err := resolveSRV(d.record)
+	if err != nil {
+		return false, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if reflect.DeepEqual(hosts, d.hosts) {
+		return false, nil
+	}
+	d.hosts = hosts
+	return true, nil
+}
+
+// resolve discovery_srv and register the discovery for the DSN, the name
+// it is referenced by is left in discoveryName
+func (c *ClickhouseClient) startDiscovery() error {
+	c.stopDiscovery()
+	if c.DiscoverySRV == "" {
+		return nil
+	}
+
+	discovery := &hostDiscovery{record: c.DiscoverySRV}
+	if _, err := discovery.refresh(); err != nil {
+		return fmt.Errorf("unable to discover hosts: %s", err.Error())
+	}
+	log.Printf("I! [outputs.clickhouse] Discovered hosts %s from %s", strings.Join(discovery.current(), ","), c.DiscoverySRV)
+
+	name := fmt.Sprintf("outputs.clickhouse.%p", c)
+	discoveriesMu.Lock()
+	discoveries[name] = discovery
+	discoveriesMu.Unlock()
+	c.discovery = discovery
+	c.discoveryName = name
+	return nil
+}
+
+func (c *ClickhouseClient) stopDiscovery() {
+	if c.discoveryName == "" {
+		return
+	}
+	discoveriesMu.Lock()
+	delete(discoveries, c.discoveryName)
+	discoveriesMu.Unlock()
+	c.discovery = nil
+	c.discoveryName = ""
+}
+
+// hosts connected to, the discovered ones when discovery_srv is set
+func (c *ClickhouseClient) hosts() []string {
+	if c.discovery != nil {
+		return c.discovery.current()
+	}
+	return c.Hosts
+}
+
+// resolve discovery_srv every interval until the plugin is closed. New
+// hosts are picked up as the pool opens connections.
+func (c *ClickhouseClient) runDiscovery(interval time.Duration) {
+	defer c.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			changed, err := c.discovery.refresh()
+			if err != nil {
+				log.Printf("W! [outputs.clickhouse] Unable to refresh hosts from %s, keeping the previous ones: %s", c.DiscoverySRV, err.Error())
+				continue
+			}
+			if changed {
+				log.Printf("I! [outputs.clickhouse] Discovered hosts changed to %s", strings.Join(c.discovery.current(), ","))
+				c.registerDial()
+			}
+		}
+	}
+}
+
+// hosts of the discovery registered under name
+func lookupDiscoveredHosts(name string) ([]string, error) {
+	discoveriesMu.RLock()
+	discovery, ok := discoveries[name]
+	discoveriesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("no host discovery registered under name %s", name)
+	}
+	hosts := discovery.current()
+	if len(hosts) == 0 {
+		return nil, errors.New("no hosts discovered")
+	}
+	return hosts, nil
+}
+
+// dsn with its host and alt_hosts replaced by the currently discovered
+// hosts, unchanged without a host_discovery parameter
+func withDiscoveredHosts(dsn string) (string, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	name := query.Get("host_discovery")
+	if name == "" {
+		return dsn, nil
+	}
+	hosts, err := lookupDiscoveredHosts(name)
+	if err != nil {
+		return "", err
+	}
+
+	u.Host = hosts[0]
+	query.Del("alt_hosts")
+	if len(hosts) > 1 {
+		query.Set("alt_hosts", strings.Join(hosts[1:], ","))
+	}
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
@@ -0,0 +1,81 @@
+package clickhouse
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func withSRVRecords(t *testing.T, addrs ...*net.SRV) {
+	lookupSRV = func(service, proto, name string) (string, []*net.SRV, error) {
+		return name, addrs, nil
+	}
+	t.Cleanup(func() { lookupSRV = net.LookupSRV })
+}
+
+func TestConnectDiscoversHosts(t *testing.T) {
+	withSRVRecords(t,
+		&net.SRV{Target: "ch-0.clickhouse.", Port: 9000},
+		&net.SRV{Target: "ch-1.clickhouse.", Port: 9000})
+
+	c := newTestClient(t, newMockDatabase(), func(c *ClickhouseClient) {
+		c.Hosts = nil
+		c.DiscoverySRV = "_native._tcp.clickhouse"
+	})
+	if !strings.HasPrefix(c.DBI, "tcp://ch-0.clickhouse:9000?") || !strings.Contains(c.DBI, "alt_hosts=ch-1.clickhouse%3A9000") {
+		t.Errorf("expected the discovered hosts in %s", c.DBI)
+	}
+
+	withSRVRecords(t, &net.SRV{Target: "ch-2.clickhouse.", Port: 9440})
+	changed, err := c.discovery.refresh()
+	if err != nil || !changed {
+		t.Fatalf("expected the hosts to change, got %v, %v", changed, err)
+	}
+	dsn, err := withDiscoveredHosts(c.DBI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(dsn, "tcp://ch-2.clickhouse:9440?") || strings.Contains(dsn, "alt_hosts") {
+		t.Errorf("expected connections to go to the new host, got %s", dsn)
+	}
+}
+
+func TestDiscoveryKeepsHostsOnEmptyAnswer(t *testing.T) {
+	withSRVRecords(t, &net.SRV{Target: "ch-0.clickhouse.", Port: 9000})
+	d := &hostDiscovery{record: "_native._tcp.clickhouse"}
+	if _, err := d.refresh(); err != nil {
+		t.Fatal(err)
+	}
+
+	withSRVRecords(t)
+	if _, err := d.refresh(); err == nil {
+		t.Error("expected an empty answer to fail")
+	}
+	if hosts := d.current(); len(hosts) != 1 || hosts[0] != "ch-0.clickhouse:9000" {
+		t.Errorf("expected the previous hosts to be kept, got %v", hosts)
+	}
+}
+
+func TestDiscoveryIgnoresOrderWithinPriority(t *testing.T) {
+	withSRVRecords(t,
+		&net.SRV{Target: "ch-1.clickhouse.", Port: 9000, Priority: 10},
+		&net.SRV{Target: "ch-0.clickhouse.", Port: 9000, Priority: 10},
+		&net.SRV{Target: "backup.clickhouse.", Port: 9000, Priority: 20})
+	d := &hostDiscovery{record: "_native._tcp.clickhouse"}
+	if _, err := d.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	expected := "ch-0.clickhouse:9000,ch-1.clickhouse:9000,backup.clickhouse:9000"
+	if hosts := strings.Join(d.current(), ","); hosts != expected {
+		t.Errorf("expected hosts %s, got %s", expected, hosts)
+	}
+
+	// the resolver shuffled the records of the first priority
+	withSRVRecords(t,
+		&net.SRV{Target: "ch-0.clickhouse.", Port: 9000, Priority: 10},
+		&net.SRV{Target: "ch-1.clickhouse.", Port: 9000, Priority: 10},
+		&net.SRV{Target: "backup.clickhouse.", Port: 9000, Priority: 20})
+	if changed, err := d.refresh(); err != nil || changed {
+		t.Errorf("expected the hosts unchanged, got %v, %v", changed, err)
+	}
+}
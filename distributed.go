@@ -0,0 +1,47 @@
+package clickhouse
+
+import "fmt"
+
+// table storing the rows of table on each node, table itself unless it
+// is a Distributed table over the cluster
+func (c *ClickhouseClient) localTable(table string) string {
+	if !c.Distributed {
+		return table
+	}
+	return table + c.LocalTableSuffix
+}
+
+// create table with columns and engine, or with distributed the local
+// table on every node and table distributing the rows over them by the
+// sharding key.
+func (c *ClickhouseClient) createShardedTable(table string, columns []columnDef, engine string) error {
+	if !c.Distributed {
+		return c.createTable(table, columns, engine)
+	}
+	local := c.localTable(table)
+	if err := c.createTable(local, columns, engine); err != nil {
+		return err
+	}
+
+	database, localName := c.splitTable(local)
+	stmt := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s%s AS %s ENGINE=Distributed(%s,%s,%s,%s)",
+		c.qualifiedTable(table), c.onCluster(), c.qualifiedTable(local),
+		quoteString(c.Cluster), quoteString(database), quoteString(localName), c.ShardingKey)
+	return c.execDDL(c.qualifiedTable(table), stmt)
+}
+
+// add col to the local table of table first, then to table itself
+// unless they are the same
+func (c *ClickhouseClient) alterShardedTable(table string, col columnDef) error {
+	tables := []string{table}
+	if c.Distributed {
+		tables = []string{c.localTable(table), table}
+	}
+	for _, t := range tables {
+		stmt := fmt.Sprintf("ALTER TABLE %s%s ADD COLUMN IF NOT EXISTS %s", c.qualifiedTable(t), c.onCluster(), c.columnDDL(col))
+		if err := c.execDDL(c.qualifiedTable(t), stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
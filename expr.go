@@ -0,0 +1,265 @@
+package clickhouse
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"unicode"
+
+	"github.com/influxdata/telegraf"
+)
+
+// an arithmetic expression over the numeric fields of a metric
+type expr interface {
+	// value of the expression, false if a field is missing or the result
+	// is not a finite number
+	eval(fields map[string]float64) (float64, bool)
+}
+
+type numberExpr float64
+
+func (e numberExpr) eval(map[string]float64) (float64, bool) {
+	return float64(e), true
+}
+
+type fieldExpr string
+
+func (e fieldExpr) eval(fields map[string]float64) (float64, bool) {
+	v, ok := fields[string(e)]
+	return v, ok
+}
+
+type negExpr struct {
+	x expr
+}
+
+func (e negExpr) eval(fields map[string]float64) (float64, bool) {
+	v, ok := e.x.eval(fields)
+	return -v, ok
+}
+
+type binaryExpr struct {
+	op   byte
+	x, y expr
+}
+
+func (e binaryExpr) eval(fields map[string]float64) (float64, bool) {
+	x, ok := e.x.eval(fields)
+	if !ok {
+		return 0, false
+	}
+	y, ok := e.y.eval(fields)
+	if !ok {
+		return 0, false
+	}
+
+	var v float64
+	switch e.op {
+	case '+':
+		v = x + y
+	case '-':
+		v = x - y
+	case '*':
+		v = x * y
+	case '/':
+		v = x / y
+	}
+	return v, !math.IsNaN(v) && !math.IsInf(v, 0)
+}
+
+// parse an expression of numbers, field names, + - * / and parentheses
+func parseExpr(s string) (expr, error) {
+	p := &exprParser{src: s}
+	p.next()
+	e, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok != tokEOF {
+		return nil, fmt.Errorf("unexpected %q at offset %d in %q", p.text, p.start, s)
+	}
+	return e, nil
+}
+
+const (
+	tokEOF = iota
+	tokNumber
+	tokIdent
+	tokOp
+)
+
+type exprParser struct {
+	src   string
+	pos   int
+	start int
+	tok   int
+	text  string
+}
+
+// advance to the next token
+func (p *exprParser) next() {
+	for p.pos < len(p.src) && p.src[p.pos] == ' ' {
+		p.pos++
+	}
+	p.start = p.pos
+	if p.pos == len(p.src) {
+		p.tok, p.text = tokEOF, ""
+		return
+	}
+
+	c := rune(p.src[p.pos])
+	switch {
+	case unicode.IsDigit(c) || c == '.':
+		for p.pos < len(p.src) && (unicode.IsDigit(rune(p.src[p.pos])) || p.src[p.pos] == '.') {
+			p.pos++
+		}
+		p.tok = tokNumber
+	case unicode.IsLetter(c) || c == '_':
+		for p.pos < len(p.src) && isIdentChar(rune(p.src[p.pos])) {
+			p.pos++
+		}
+		p.tok = tokIdent
+	default:
+		p.pos++
+		p.tok = tokOp
+	}
+	p.text = p.src[p.start:p.pos]
+}
+
+func isIdentChar(c rune) bool {
+	return unicode.IsLetter(c) || unicode.IsDigit(c) || c == '_' || c == '.'
+}
+
+// sum = product { ("+" | "-") product }
+func (p *exprParser) parseSum() (expr, error) {
+	x, err := p.parseProduct()
+	if err != nil {
+		return nil, err
+	}
+	for p.tok == tokOp && (p.text == "+" || p.text == "-") {
+		op := p.text[0]
+		p.next()
+		y, err := p.parseProduct()
+		if err != nil {
+			return nil, err
+		}
+		x = binaryExpr{op: op, x: x, y: y}
+	}
+	return x, nil
+}
+
+// product = unary { ("*" | "/") unary }
+func (p *exprParser) parseProduct() (expr, error) {
+	x, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.tok == tokOp && (p.text == "*" || p.text == "/") {
+		op := p.text[0]
+		p.next()
+		y, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		x = binaryExpr{op: op, x: x, y: y}
+	}
+	return x, nil
+}
+
+// unary = "-" unary | number | field | "(" sum ")"
+func (p *exprParser) parseUnary() (expr, error) {
+	switch {
+	case p.tok == tokOp && p.text == "-":
+		p.next()
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return negExpr{x: x}, nil
+	case p.tok == tokNumber:
+		v, err := strconv.ParseFloat(p.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q in %q", p.text, p.src)
+		}
+		p.next()
+		return numberExpr(v), nil
+	case p.tok == tokIdent:
+		name := p.text
+		p.next()
+		return fieldExpr(name), nil
+	case p.tok == tokOp && p.text == "(":
+		p.next()
+		x, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		if p.tok != tokOp || p.text != ")" {
+			return nil, fmt.Errorf("missing ) at offset %d in %q", p.start, p.src)
+		}
+		p.next()
+		return x, nil
+	case p.tok == tokEOF:
+		return nil, fmt.Errorf("unexpected end of %q", p.src)
+	}
+	return nil, fmt.Errorf("unexpected %q at offset %d in %q", p.text, p.start, p.src)
+}
+
+// a field computed from other fields of a metric
+type derivedField struct {
+	// measurement the field is added to, all if empty or "*"
+	Measurement string `toml:"measurement"`
+	Field       string `toml:"field"`
+	Expression  string `toml:"expression"`
+
+	expr expr
+}
+
+func (d *derivedField) init() error {
+	if d.Field == "" {
+		return fmt.Errorf("derived field of expression %q has no name", d.Expression)
+	}
+	e, err := parseExpr(d.Expression)
+	if err != nil {
+		return fmt.Errorf("invalid expression of derived field %s: %s", d.Field, err.Error())
+	}
+	d.expr = e
+	return nil
+}
+
+// add the derived fields computable from the numeric fields of metric,
+// returning a copy if any field was added.
+func (c *ClickhouseClient) derive(metric telegraf.Metric) telegraf.Metric {
+	var fields map[string]float64
+	var derived telegraf.Metric
+
+	for _, d := range c.Derived {
+		if d.Measurement != "" && d.Measurement != "*" && d.Measurement != metric.Name() {
+			continue
+		}
+
+		if fields == nil {
+			fields = make(map[string]float64)
+			for _, field := range metric.FieldList() {
+				if v, ok := convertField(field.Value).(float64); ok {
+					fields[field.Key] = v
+				}
+			}
+		}
+
+		v, ok := d.expr.eval(fields)
+		if !ok {
+			continue
+		}
+		if derived == nil {
+			derived = metric.Copy()
+		}
+		derived.AddField(d.Field, v)
+		// later expressions may refer to derived fields
+		fields[d.Field] = v
+	}
+
+	if derived == nil {
+		return metric
+	}
+	return derived
+}
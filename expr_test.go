@@ -0,0 +1,72 @@
+package clickhouse
+
+import (
+	"testing"
+	"time"
+
+	"github.com/influxdata/telegraf/metric"
+)
+
+func TestParseExpr(t *testing.T) {
+	fields := map[string]float64{"used": 25, "total": 200, "a.b": 3}
+
+	tests := []struct {
+		expr     string
+		expected float64
+		ok       bool
+	}{
+		{expr: "used / total * 100", expected: 12.5, ok: true},
+		{expr: "(total - used) / total", expected: 0.875, ok: true},
+		{expr: "-used + 1 * 2", expected: -23, ok: true},
+		{expr: "a.b * 2.5", expected: 7.5, ok: true},
+		{expr: "used / 0", ok: false},
+		{expr: "missing + 1", ok: false},
+	}
+
+	for _, tt := range tests {
+		e, err := parseExpr(tt.expr)
+		if err != nil {
+			t.Fatalf("parse %q: %v", tt.expr, err)
+		}
+		v, ok := e.eval(fields)
+		if ok != tt.ok || (ok && v != tt.expected) {
+			t.Errorf("%q: expected %v (%v), got %v (%v)", tt.expr, tt.expected, tt.ok, v, ok)
+		}
+	}
+}
+
+func TestParseExprErrors(t *testing.T) {
+	for _, s := range []string{"", "used /", "(used", "used total", "used % 2", "1..2"} {
+		if _, err := parseExpr(s); err == nil {
+			t.Errorf("expected %q to fail", s)
+		}
+	}
+}
+
+func TestDerive(t *testing.T) {
+	c := newClickhouse()
+	c.Derived = []*derivedField{
+		{Measurement: "mem", Field: "used_percent", Expression: "used / total * 100"},
+		{Measurement: "mem", Field: "free_percent", Expression: "100 - used_percent"},
+	}
+	for _, d := range c.Derived {
+		if err := d.init(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m := metric.New("mem", nil,
+		map[string]interface{}{"used": int64(25), "total": uint64(100)},
+		time.Unix(1600000000, 0))
+
+	derived := c.derive(m)
+	if v, _ := derived.GetField("used_percent"); v != 25.0 {
+		t.Errorf("expected used_percent 25, got %v", v)
+	}
+	if v, _ := derived.GetField("free_percent"); v != 75.0 {
+		t.Errorf("expected free_percent 75, got %v", v)
+	}
+	if m.HasField("used_percent") {
+		t.Error("expected the original metric untouched")
+	}
+}
@@ -0,0 +1,183 @@
+package clickhouse
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/influxdata/telegraf"
+)
+
+const (
+	telegrafModule = "github.com/influxdata/telegraf"
+	pluginModule   = "github.com/taylor840326/telegraf-clickhouse-plugin"
+)
+
+// columns of the generated metrics tables, of the graphite layout last
+var builtinColumns = []string{"date", "name", "tags", "tags_json", "tags.key", "tags.value", "val", "val_str", "ts", "updated", "series_id",
+	"Path", "Value", "Time", "Date", "Timestamp"}
+
+// columns of the agent metadata
+var metadataColumns = []string{"agent_hostname", "agent_version", "plugin_version"}
+
+// assign the extra and dictionary columns names that are valid and unique
+// among the columns of the metrics tables
+func (c *ClickhouseClient) resolveExtraColumns() {
+	taken := append([]string{}, builtinColumns...)
+	if c.AgentMetadata {
+		taken = append(taken, metadataColumns...)
+	}
+	if c.BatchID {
+		taken = append(taken, "batch_id")
+	}
+	if c.MetricType {
+		taken = append(taken, "metric_type")
+	}
+	namer := newColumnNamer(c.IdentifierReplacement[0], taken...)
+
+	c.extraColumnKeys = make([]string, 0, len(c.ExtraColumns))
+	for key := range c.ExtraColumns {
+		c.extraColumnKeys = append(c.extraColumnKeys, key)
+	}
+	sort.Strings(c.extraColumnKeys)
+
+	c.extraColumnNames = make([]string, 0, len(c.extraColumnKeys))
+	for _, key := range c.extraColumnKeys {
+		name := namer.name(key)
+		if name != key {
+			log.Printf("W! [outputs.clickhouse] Extra column %q is written as %s", key, name)
+		}
+		c.extraColumnNames = append(c.extraColumnNames, name)
+	}
+
+	c.resolveDictionaryColumns(namer)
+	// the field columns of the wide layout are named as fields show up
+	c.fieldNamer = namer
+}
+
+// names and values of the extra columns in a stable order, followed by
+// the agent metadata columns if enabled
+func (c *ClickhouseClient) extraColumns() ([]string, []string) {
+	names := append([]string{}, c.extraColumnNames...)
+	values := make([]string, 0, len(names)+len(metadataColumns))
+	for _, key := range c.extraColumnKeys {
+		values = append(values, c.ExtraColumns[key])
+	}
+
+	if c.AgentMetadata {
+		names = append(names, metadataColumns...)
+		values = append(values, c.hostname, moduleVersion(telegrafModule), moduleVersion(pluginModule))
+	}
+	return names, values
+}
+
+// version of a module linked into the running binary, "unknown" if the
+// binary carries no build information
+func moduleVersion(path string) string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	if info.Main.Path == path {
+		return info.Main.Version
+	}
+	for _, dep := range info.Deps {
+		if dep.Path == path {
+			return dep.Version
+		}
+	}
+	return "unknown"
+}
+
+// definitions of the extra columns of the metrics table
+func (c *ClickhouseClient) extraColumnDefs() []columnDef {
+	names, _ := c.extraColumns()
+	defs := make([]columnDef, 0, len(names))
+	for _, name := range names {
+		defs = append(defs, columnDef{name: name, typ: "String", defaultExpr: "''"})
+	}
+	if c.BatchID {
+		defs = append(defs, columnDef{name: "batch_id", typ: "UUID"})
+	}
+	if c.MetricType {
+		defs = append(defs, columnDef{name: "metric_type", typ: "LowCardinality(String)", defaultExpr: "''"})
+	}
+	return defs
+}
+
+// append the constant values of the extra columns, the identifier of the
+// flush and the type of the metric to every row
+func (c *ClickhouseClient) withExtraColumns(columns []string, rows []insertRow, batchID string) ([]string, []insertRow) {
+	names, extra := c.extraColumns()
+
+	values := make([]interface{}, 0, len(extra)+1)
+	size := 0
+	for _, value := range extra {
+		values = append(values, value)
+		size += len(value)
+	}
+	if c.BatchID {
+		names = append(names, "batch_id")
+		values = append(values, batchID)
+		size += 16
+	}
+	if c.MetricType {
+		names = append(names, "metric_type")
+	}
+	if len(names) == 0 {
+		return columns, rows
+	}
+
+	for i := range rows {
+		rows[i].values = append(rows[i].values[:len(rows[i].values):len(rows[i].values)], values...)
+		rows[i].size += size
+		if c.MetricType {
+			typ := metricTypeName(rows[i].metric.source)
+			rows[i].values = append(rows[i].values, typ)
+			rows[i].size += len(typ)
+		}
+	}
+	return append(columns[:len(columns):len(columns)], names...), rows
+}
+
+// name of the Telegraf value type of m, e.g. counter for the metric_type
+// column
+func metricTypeName(m telegraf.Metric) string {
+	if m == nil {
+		return "untyped"
+	}
+	switch m.Type() {
+	case telegraf.Counter:
+		return "counter"
+	case telegraf.Gauge:
+		return "gauge"
+	case telegraf.Summary:
+		return "summary"
+	case telegraf.Histogram:
+		return "histogram"
+	}
+	return "untyped"
+}
+
+// sequence of the batch ids made up without randomness
+var batchIDSeq uint64
+
+// random version 4 UUID identifying a flush. Should the system run out of
+// randomness the id is made of the time and a sequence number instead,
+// unique within the process.
+func newBatchID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		log.Printf("W! [outputs.clickhouse] Unable to read random batch id, using the time: %s", err.Error())
+		binary.BigEndian.PutUint64(b[0:8], uint64(time.Now().UnixNano()))
+		binary.BigEndian.PutUint64(b[8:16], atomic.AddUint64(&batchIDSeq, 1))
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
@@ -0,0 +1,156 @@
+package clickhouse
+
+import (
+	"context"
+	"database/sql/driver"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go"
+)
+
+// whether err is a failure of the connection rather than of the
+// statement, leaving the batch worth retrying on another connection
+func isConnectionError(err error) bool {
+	switch err {
+	case driver.ErrBadConn, io.EOF, io.ErrUnexpectedEOF:
+		return true
+	case context.DeadlineExceeded, context.Canceled:
+		return false
+	}
+	switch err.(type) {
+	case net.Error:
+		return true
+	case *clickhouse.Exception:
+		return false
+	}
+	msg := err.Error()
+	for _, s := range []string{"connection refused", "connection reset", "broken pipe", "no hosts discovered"} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// hosts failing to accept connections, skipped for a period unless all
+// hosts fail, and hosts quarantined by the health checks, skipped until
+// they recover. A nil cooldown skips no host.
+type hostCooldown struct {
+	period time.Duration
+
+	mu          sync.Mutex
+	hosts       []string
+	failed      map[string]time.Time
+	quarantined map[string]bool
+}
+
+func newHostCooldown(period time.Duration) *hostCooldown {
+	if period <= 0 {
+		return nil
+	}
+	return newHostQuarantine(period)
+}
+
+// cooldown of hosts quarantined by health checks, skipping hosts failing
+// to accept connections for period as well if positive
+func newHostQuarantine(period time.Duration) *hostCooldown {
+	return &hostCooldown{period: period, failed: make(map[string]time.Time), quarantined: make(map[string]bool)}
+}
+
+// set the hosts failed over between
+func (h *hostCooldown) setHosts(hosts []string) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.hosts = hosts
+}
+
+// whether host failed within the period or is quarantined while others
+// are not
+func (h *hostCooldown) cooling(host string) bool {
+	if h == nil {
+		return false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	unavailable := func(host string) bool {
+		return h.quarantined[host] || now.Sub(h.failed[host]) < h.period
+	}
+	if !unavailable(host) {
+		return false
+	}
+	for _, other := range h.hosts {
+		if !unavailable(other) {
+			return true
+		}
+	}
+	// all hosts are failing, try them anyway
+	return false
+}
+
+func (h *hostCooldown) fail(host string) {
+	if h == nil || h.period <= 0 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.failed[host]; !ok {
+		log.Printf("W! [outputs.clickhouse] Host %s failed, skipping it for %s", host, h.period)
+	}
+	h.failed[host] = time.Now()
+}
+
+// take host out of the rotation until it recovers
+func (h *hostCooldown) quarantine(host string, err error) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.quarantined[host] {
+		log.Printf("W! [outputs.clickhouse] Host %s failed its health check, removing it from the rotation: %s", host, err.Error())
+	}
+	h.quarantined[host] = true
+}
+
+func (h *hostCooldown) recover(host string) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, failed := h.failed[host]
+	if failed || h.quarantined[host] {
+		log.Printf("I! [outputs.clickhouse] Host %s recovered", host)
+		delete(h.failed, host)
+		delete(h.quarantined, host)
+	}
+}
+
+// insert rows like insertBatch, retrying up to failover_retries times while
+// the insert fails on the connection. Each retry opens a new connection,
+// reaching the next host once the failed one is discarded.
+func (c *ClickhouseClient) insertWithFailover(ctx context.Context, table string, columns []string, rows []insertRow, stats *writeStats) ([]rejectedRow, error) {
+	for attempt := 0; ; attempt++ {
+		written, bytes, failed := stats.rows, stats.bytes, stats.failed
+		rejected, err := c.insertBatch(ctx, table, columns, rows, stats)
+		if err == nil || ctx.Err() != nil || attempt >= c.FailoverRetries || !isConnectionError(err) {
+			return rejected, err
+		}
+
+		// the rows were not written, count them once on the retry
+		stats.rows, stats.bytes, stats.failed = written, bytes, failed
+		stats.retries++
+		log.Printf("W! [outputs.clickhouse] Insert of %d rows into %s failed on the connection, retrying (%d/%d): %s",
+			len(rows), table, attempt+1, c.FailoverRetries, err.Error())
+	}
+}
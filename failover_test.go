@@ -0,0 +1,149 @@
+package clickhouse
+
+import (
+	"database/sql/driver"
+	"errors"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go"
+	"github.com/influxdata/telegraf/config"
+)
+
+func TestWriteRetriesConnectionErrors(t *testing.T) {
+	db := newMockDatabase()
+	c := newTestClient(t, db, nil)
+	db.sendErrs = []error{driver.ErrBadConn}
+	written := c.health.rowsWritten.Get()
+
+	if err := c.Write(testBatch()); err != nil {
+		t.Fatalf("expected the retry to succeed, got %v", err)
+	}
+	if sent := db.sentBatches("telegraf.metrics"); len(sent) != 1 || len(sent[0].rows) != 3 {
+		t.Fatalf("expected one batch of 3 rows, got %v", sent)
+	}
+	if rows := c.health.rowsWritten.Get() - written; rows != 3 {
+		t.Errorf("expected the rows counted once, got %d", rows)
+	}
+}
+
+func TestWriteGivesUpAfterFailoverRetries(t *testing.T) {
+	db := newMockDatabase()
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.FailoverRetries = 1
+	})
+	db.sendErrs = []error{driver.ErrBadConn, driver.ErrBadConn}
+
+	if err := c.Write(testBatch()); err != driver.ErrBadConn {
+		t.Fatalf("expected the connection error, got %v", err)
+	}
+}
+
+func TestWriteDoesNotRetryServerErrors(t *testing.T) {
+	db := newMockDatabase()
+	c := newTestClient(t, db, nil)
+	db.sendErrs = []error{&clickhouse.Exception{Code: 241, Message: "Memory limit exceeded"}}
+
+	if err := c.Write(testBatch()); err == nil {
+		t.Fatal("expected the server error to fail the write")
+	}
+}
+
+func TestIsConnectionError(t *testing.T) {
+	for err, expected := range map[error]bool{
+		driver.ErrBadConn:                   true,
+		errors.New("write: broken pipe"):    true,
+		&clickhouse.Exception{Code: 53}:     false,
+		errors.New("column count mismatch"): false,
+	} {
+		if isConnectionError(err) != expected {
+			t.Errorf("expected isConnectionError(%v) to be %t", err, expected)
+		}
+	}
+}
+
+func TestHostCooldown(t *testing.T) {
+	h := newHostCooldown(time.Minute)
+	h.setHosts([]string{"a:9000", "b:9000"})
+
+	h.fail("a:9000")
+	if !h.cooling("a:9000") || h.cooling("b:9000") {
+		t.Error("expected only the failed host to cool down")
+	}
+
+	h.fail("b:9000")
+	if h.cooling("a:9000") || h.cooling("b:9000") {
+		t.Error("expected all hosts to be tried when all fail")
+	}
+
+	h.recover("b:9000")
+	if !h.cooling("a:9000") {
+		t.Error("expected the failed host to cool down again")
+	}
+
+	if newHostCooldown(0).cooling("a:9000") {
+		t.Error("expected no cooldown without a period")
+	}
+}
+
+func TestHealthChecksQuarantineHosts(t *testing.T) {
+	var mu sync.Mutex
+	down := map[string]bool{"b:9000": true}
+	probe := probeHost
+	probeHost = func(host string, proxy *url.URL, timeout time.Duration) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if down[host] {
+			return errors.New("connection refused")
+		}
+		return nil
+	}
+	t.Cleanup(func() { probeHost = probe })
+
+	c := newTestClient(t, newMockDatabase(), func(c *ClickhouseClient) {
+		c.Hosts = []string{"a:9000", "b:9000"}
+		c.HealthCheckInterval = config.Duration(time.Hour)
+	})
+	if c.dialSettings == nil || c.dialSettings.cooldown != c.cooldown {
+		t.Fatal("expected the native dialer to skip quarantined hosts")
+	}
+
+	c.checkHosts()
+	if !c.cooldown.cooling("b:9000") || c.cooldown.cooling("a:9000") {
+		t.Error("expected the unreachable host quarantined")
+	}
+
+	mu.Lock()
+	down["b:9000"] = false
+	mu.Unlock()
+	c.checkHosts()
+	if c.cooldown.cooling("b:9000") {
+		t.Error("expected the recovered host back in the rotation")
+	}
+}
+
+func TestHTTPDatabaseSharesQuarantine(t *testing.T) {
+	probe := probeHost
+	probeHost = func(string, *url.URL, time.Duration) error { return nil }
+	t.Cleanup(func() { probeHost = probe })
+
+	c := newTestClient(t, newMockDatabase(), func(c *ClickhouseClient) {
+		c.Hosts = []string{"a:8123", "b:8123"}
+		c.Protocol = "http"
+		c.HealthCheckInterval = config.Duration(time.Hour)
+	})
+
+	dsn, err := buildDsn(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := openHTTPDatabase(dsn, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.(*httpDatabase).cooldown != c.cooldown {
+		t.Error("expected the HTTP database to skip the hosts quarantined by the client")
+	}
+}
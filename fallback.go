@@ -0,0 +1,136 @@
+package clickhouse
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// successor tables tried before giving up on an incompatible schema
+const maxTableVersions = 10
+
+// differences of the existing columns of a table to the generated
+// columns that break inserts, none if the table does not exist
+func schemaProblems(existing map[string]string, columns []columnDef) []string {
+	if len(existing) == 0 {
+		return nil
+	}
+
+	var problems []string
+	for _, col := range columns {
+		if col.materialized != "" {
+			continue
+		}
+		typ, ok := existing[col.name]
+		switch {
+		case !ok:
+			problems = append(problems, "missing column "+col.name)
+		case typ != col.typ:
+			problems = append(problems, fmt.Sprintf("column %s is %s instead of %s", col.name, typ, col.typ))
+		}
+	}
+	return problems
+}
+
+// add the generated columns missing from the existing table, noting the
+// columns added in existing. Columns stay missing if the user lacks DDL
+// privileges.
+func (c *ClickhouseClient) addMissingColumns(table string, existing map[string]string, columns []columnDef) error {
+	if len(existing) == 0 {
+		return nil
+	}
+	for _, col := range columns {
+		if _, ok := existing[col.name]; ok || col.materialized != "" {
+			continue
+		}
+		if err := c.addColumn(table, col); err != nil {
+			return err
+		}
+		if typ, ok := c.knownColumns[table][col.name]; ok {
+			existing[col.name] = typ
+		}
+	}
+	return nil
+}
+
+// compare the existing metrics table to the columns of the layout by
+// schema_check, logging the differences or failing on them
+func (c *ClickhouseClient) checkSchema(table string) error {
+	if c.SchemaCheck == "off" {
+		return nil
+	}
+	existing, err := c.tableColumns(table)
+	if err != nil {
+		return err
+	}
+	problems := schemaProblems(existing, c.metricsTableColumns())
+	if len(problems) == 0 {
+		return nil
+	}
+	if c.SchemaCheck == "fail" {
+		return fmt.Errorf("table %s is incompatible with the %s layout: %s",
+			c.qualifiedTable(table), c.TableLayout, strings.Join(problems, ", "))
+	}
+	log.Printf("W! [outputs.clickhouse] Table %s is incompatible with the %s layout, inserts may fail: %s",
+		c.qualifiedTable(table), c.TableLayout, strings.Join(problems, ", "))
+	return nil
+}
+
+// types of the columns of table by name, none if it does not exist
+func (c *ClickhouseClient) tableColumns(table string) (map[string]string, error) {
+	database, name := c.splitTable(table)
+	rows, err := c.db.Query(fmt.Sprintf(
+		"SELECT name, type FROM system.columns WHERE database = %s AND table = %s",
+		quoteString(database), quoteString(name),
+	))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	existing := make(map[string]string)
+	for rows.Next() {
+		var name, typ string
+		if err := rows.Scan(&name, &typ); err != nil {
+			return nil, err
+		}
+		existing[name] = typ
+	}
+	return existing, rows.Err()
+}
+
+// add the columns missing from the existing metrics table, and switch to
+// a versioned successor of it, e.g. metrics_v2, if it remains
+// incompatible with the configured layout: its columns conflict in type
+// or the user may not add the missing ones.
+func (c *ClickhouseClient) fallbackOnIncompatibleSchema(create func(table string) error) error {
+	columns := c.metricsTableColumns()
+	table := c.metricsTable()
+	for version := 2; ; version++ {
+		existing, err := c.tableColumns(table)
+		if err != nil {
+			return err
+		}
+		if err := c.addMissingColumns(table, existing, columns); err != nil {
+			return err
+		}
+		problems := schemaProblems(existing, columns)
+		if len(problems) == 0 {
+			return nil
+		}
+		if version > maxTableVersions {
+			return fmt.Errorf("table %s.%s is incompatible with the %s layout: %s",
+				c.Database, table, c.TableLayout, strings.Join(problems, ", "))
+		}
+
+		successor := fmt.Sprintf("%s_v%d", c.TableName, version)
+		log.Printf("W! [outputs.clickhouse] Table %s.%s is incompatible with the %s layout (%s), writing to %s.%s instead. Migrate the data and update tablename.",
+			c.Database, table, c.TableLayout, strings.Join(problems, ", "), c.Database, successor)
+
+		table = successor
+		c.setMetricsTable(table)
+		if err := create(table); err != nil {
+			return err
+		}
+	}
+}
@@ -1,3 +1,5 @@
 module github.com/taylor840326/telegraf-clickhouse-plugin
 
 go 1.12
+
+require github.com/ClickHouse/clickhouse-go v1.5.4
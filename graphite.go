@@ -0,0 +1,88 @@
+package clickhouse
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// characters of the path nodes replaced as by the graphite serializer of
+// Telegraf
+var graphiteReplacer = strings.NewReplacer("/", "-", "@", "-", "*", "-", " ", "_", "..", ".", `\`, "", ")", "_", "(", "_")
+
+// create the table of the graphite layout in the schema of
+// graphite-clickhouse, rolled up by the graphite_rollup section of the
+// server configuration
+func (c *ClickhouseClient) createGraphiteTable(table string) error {
+	engine := fmt.Sprintf("%s PARTITION BY toYYYYMM(Date) ORDER BY (Path, Time)",
+		c.engineFamily("GraphiteMergeTree", quoteString(c.GraphiteRollup)))
+	if c.TTL != "" {
+		engine += " TTL " + c.TTL
+	}
+	return c.createShardedTable(table, c.metricsTableColumns(), engine+" SETTINGS index_granularity=8192")
+}
+
+// path of metr in the graphite tree by the graphite_template. Nodes of
+// tags metr lacks are left out, tags expands to the values of the tags
+// the template does not name, ordered by key.
+func (c *ClickhouseClient) graphitePath(metr clickhouseMetric) string {
+	template := strings.Split(c.GraphiteTemplate, ".")
+	named := make(map[string]bool, len(template))
+	for _, node := range template {
+		named[node] = true
+	}
+
+	var nodes []string
+	for _, node := range template {
+		switch node {
+		case "measurement":
+			nodes = append(nodes, metr.measurement)
+		case "field":
+			// the field of single value metrics is implied
+			if metr.field != "value" {
+				nodes = append(nodes, metr.field)
+			}
+		case "tags":
+			keys := make([]string, 0, len(metr.Tags))
+			for key := range metr.Tags {
+				if !named[key] {
+					keys = append(keys, key)
+				}
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				nodes = append(nodes, fmt.Sprint(metr.Tags[key]))
+			}
+		default:
+			if value, ok := metr.Tags[node]; ok {
+				nodes = append(nodes, fmt.Sprint(value))
+			}
+		}
+	}
+	for i, node := range nodes {
+		nodes[i] = graphiteReplacer.Replace(node)
+	}
+	return strings.Join(nodes, ".")
+}
+
+// rows of the graphite layout, one per numeric field. Graphite has no
+// string values, string fields are dropped.
+func (c *ClickhouseClient) graphiteRows(batchMetrics []clickhouseMetrics) ([]string, []insertRow) {
+	var rows []insertRow
+	for _, metrs := range batchMetrics {
+		for _, metr := range metrs {
+			if metr.str {
+				continue
+			}
+			path := c.graphitePath(metr)
+			rows = append(rows, insertRow{
+				metric: metr,
+				values: []interface{}{path, metr.Val, uint32(metr.Ts.Unix()), uint32(time.Now().Unix())},
+				// Path + Value(Float64) + Time(UInt32) + Timestamp(UInt32)
+				size: len(path) + 8 + 4 + 4,
+			})
+		}
+	}
+	return []string{"Path", "Value", "Time", "Timestamp"}, rows
+}
@@ -0,0 +1,63 @@
+package clickhouse
+
+import (
+	"log"
+	"time"
+
+	"github.com/influxdata/telegraf/selfstat"
+)
+
+// internal health of the plugin, exposed through Telegraf's selfstat
+// registry as the internal_clickhouse measurement. Collected by
+// inputs.internal it can be checked by outputs.health.
+type healthStats struct {
+	lastSuccess   selfstat.Stat
+	lastFailure   selfstat.Stat
+	writeErrors   selfstat.Stat
+	rowsWritten   selfstat.Stat
+	rowsRejected  selfstat.Stat
+	partsPressure selfstat.Stat
+	// spool files of spool_dir not replayed yet and the rows they hold
+	spoolFiles selfstat.Stat
+	spoolRows  selfstat.Stat
+}
+
+func newHealthStats(database, table string) *healthStats {
+	tags := map[string]string{
+		"database": database,
+		"table":    table,
+	}
+	return &healthStats{
+		lastSuccess:   selfstat.Register("clickhouse", "last_success_unix", tags),
+		lastFailure:   selfstat.Register("clickhouse", "last_failure_unix", tags),
+		writeErrors:   selfstat.Register("clickhouse", "write_errors", tags),
+		rowsWritten:   selfstat.Register("clickhouse", "rows_written", tags),
+		rowsRejected:  selfstat.Register("clickhouse", "rows_rejected", tags),
+		partsPressure: selfstat.Register("clickhouse", "parts_pressure", tags),
+		spoolFiles:    selfstat.Register("clickhouse", "spool_files", tags),
+		spoolRows:     selfstat.Register("clickhouse", "spool_rows", tags),
+	}
+}
+
+// record the outcome of a flush
+func (h *healthStats) record(stats *writeStats, err error) {
+	if err != nil {
+		h.lastFailure.Set(time.Now().Unix())
+		h.writeErrors.Incr(1)
+		return
+	}
+	h.lastSuccess.Set(time.Now().Unix())
+	h.rowsWritten.Incr(int64(stats.rows))
+	h.rowsRejected.Incr(int64(stats.failed))
+}
+
+// record the depth of the spool directory dir
+func (h *healthStats) recordSpool(dir string) {
+	files, rows, err := spoolDepth(dir)
+	if err != nil {
+		log.Printf("W! [outputs.clickhouse] Unable to read spool directory %s: %s", dir, err.Error())
+		return
+	}
+	h.spoolFiles.Set(int64(files))
+	h.spoolRows.Set(int64(rows))
+}
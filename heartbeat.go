@@ -0,0 +1,49 @@
+package clickhouse
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// create the heartbeat table if it does not exist.
+func (c *ClickhouseClient) createHeartbeatTable() error {
+	stmt := fmt.Sprintf(`
+	CREATE TABLE IF NOT EXISTS %s.%s%s(
+		date Date DEFAULT toDate(ts),
+		ts DateTime,
+		host String
+	) ENGINE=%s
+	`, c.Database, c.HeartbeatTable, c.onCluster(), c.mergeTreeEngine("host,ts"))
+
+	return c.execDDL(fmt.Sprintf("%s.%s", c.Database, c.HeartbeatTable), stmt)
+}
+
+// insert a heartbeat row every heartbeat_interval until the plugin is closed,
+// independently of whether any metrics are flowing.
+func (c *ClickhouseClient) runHeartbeat(interval time.Duration) {
+	defer c.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	ready := false
+	for {
+		select {
+		case <-c.done:
+			return
+		case ts := <-ticker.C:
+			if !ready {
+				if err := c.createHeartbeatTable(); err != nil {
+					continue
+				}
+				ready = true
+			}
+
+			if err := c.insertRows(c.HeartbeatTable, []string{"ts", "host"}, [][]interface{}{{ts, c.hostname}}); err != nil {
+				ready = false
+				log.Printf("E! [outputs.clickhouse] Unable to write heartbeat: %s", err.Error())
+			}
+		}
+	}
+}
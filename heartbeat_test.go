@@ -0,0 +1,129 @@
+package clickhouse
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/influxdata/telegraf/config"
+)
+
+// wait until n batches inserting into table were started, then stop the
+// heartbeat so the batches can be inspected
+func waitHeartbeats(t *testing.T, c *ClickhouseClient, db *mockDatabase, table string, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		db.mu.Lock()
+		started := 0
+		for _, b := range db.batches {
+			if strings.HasPrefix(b.query, "INSERT INTO "+table+"(") {
+				started++
+			}
+		}
+		db.mu.Unlock()
+		if started >= n {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d heartbeats, got %d", n, started)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	c.Close()
+}
+
+func TestHeartbeat(t *testing.T) {
+	db := newMockDatabase()
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.HeartbeatInterval = config.Duration(10 * time.Millisecond)
+	})
+
+	start := time.Now()
+	waitHeartbeats(t, c, db, "telegraf.telegraf_heartbeat", 3)
+
+	if n := len(db.execsWithPrefix("CREATE TABLE IF NOT EXISTS telegraf.telegraf_heartbeat")); n != 1 {
+		t.Errorf("expected the heartbeat table created once, got %d", n)
+	}
+	batches := db.sentBatches("telegraf.telegraf_heartbeat")
+	if len(batches) < 3 {
+		t.Fatalf("expected 3 heartbeats, got %d", len(batches))
+	}
+	if want := "INSERT INTO telegraf.telegraf_heartbeat(ts,host) VALUES(?,?)"; batches[0].query != want {
+		t.Errorf("expected %q, got %q", want, batches[0].query)
+	}
+
+	var last time.Time
+	for i, b := range batches {
+		if len(b.rows) != 1 {
+			t.Fatalf("expected 1 row per heartbeat, got %d", len(b.rows))
+		}
+		ts, host := b.rows[0][0].(time.Time), b.rows[0][1]
+		if host != c.hostname {
+			t.Errorf("expected host %q, got %v", c.hostname, host)
+		}
+		if ts.Before(start) {
+			t.Errorf("expected heartbeat %d after the start, got %s", i, ts)
+		}
+		// a row per tick of the interval
+		if i > 0 && ts.Sub(last) < 5*time.Millisecond {
+			t.Errorf("expected heartbeats an interval apart, got %s", ts.Sub(last))
+		}
+		last = ts
+	}
+}
+
+func TestHeartbeatRecreatesTableAfterFailure(t *testing.T) {
+	db := newMockDatabase()
+	db.sendErrs = []error{errors.New("code: 60, message: Table telegraf.telegraf_heartbeat doesn't exist")}
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.HeartbeatInterval = config.Duration(10 * time.Millisecond)
+	})
+
+	waitHeartbeats(t, c, db, "telegraf.telegraf_heartbeat", 3)
+
+	// the failed insert marks the table as not ready, the next tick creates
+	// it again before inserting
+	if n := len(db.execsWithPrefix("CREATE TABLE IF NOT EXISTS telegraf.telegraf_heartbeat")); n != 2 {
+		t.Errorf("expected the heartbeat table created twice, got %d", n)
+	}
+	if n := len(db.sentBatches("telegraf.telegraf_heartbeat")); n < 2 {
+		t.Errorf("expected the heartbeats after the failure inserted, got %d", n)
+	}
+}
+
+func TestHeartbeatWithoutTable(t *testing.T) {
+	db := newMockDatabase()
+	db.execErrs["CREATE TABLE IF NOT EXISTS telegraf.telegraf_heartbeat"] = errors.New("code: 81, message: Database telegraf doesn't exist")
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.HeartbeatInterval = config.Duration(10 * time.Millisecond)
+	})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(db.execsWithPrefix("CREATE TABLE IF NOT EXISTS telegraf.telegraf_heartbeat")) < 3 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the heartbeat table creation retried")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	c.Close()
+
+	// no heartbeat is inserted while the table cannot be created
+	if n := len(db.sentBatches("telegraf.telegraf_heartbeat")); n != 0 {
+		t.Errorf("expected no heartbeats, got %d", n)
+	}
+}
+
+func TestHeartbeatDisabled(t *testing.T) {
+	db := newMockDatabase()
+	c := newTestClient(t, db, nil)
+
+	time.Sleep(20 * time.Millisecond)
+	c.Close()
+
+	if n := len(db.execsWithPrefix("CREATE TABLE IF NOT EXISTS telegraf.telegraf_heartbeat")); n != 0 {
+		t.Errorf("expected no heartbeat table without heartbeat_interval, got %d", n)
+	}
+}
@@ -0,0 +1,485 @@
+package clickhouse
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go"
+)
+
+var (
+	// the column list and clause preceding VALUES of an INSERT
+	insertColumnsRe = regexp.MustCompile(`(?is)^\s*(INSERT\s+INTO\s+\S+?)\s*\(([^)]*)\)(.*?)\s*VALUES\s*\(.*\)\s*$`)
+	// Code: 60. DB::Exception: ... of an HTTP error response
+	httpExceptionRe = regexp.MustCompile(`^Code:\s*(\d+)\.\s*(?:DB::Exception:\s*)?`)
+)
+
+// prefix of DSN parameters carrying a request header
+const httpHeaderParam = "http_header."
+
+// formats of HTTP inserts
+const (
+	insertFormatJSON  = "JSONEachRow"
+	insertFormatArrow = "ArrowStream"
+)
+
+// database speaking the HTTP interface of ClickHouse. Inserts are sent
+// as JSONEachRow or ArrowStream, query results are read as TabSeparated.
+type httpDatabase struct {
+	client *http.Client
+	scheme string
+	// hosts tried in order from the one picked by connection_open_strategy
+	hosts    []string
+	strategy string
+	// name of the host discovery replacing hosts, if any
+	discovery string
+	cooldown  *hostCooldown
+	// requests sent, picking the first host of round robin
+	sent     uint32
+	params   url.Values
+	user     string
+	password string
+	// file the password is read from, re-read once it changes
+	passwordFile string
+	// extra headers of every request
+	headers http.Header
+	// format of the inserts, JSONEachRow unless ArrowStream
+	insertFormat string
+}
+
+// open the HTTP database of a http:// or https:// DSN as built by buildDsn
+func openHTTPDatabase(dsn string, role string) (database, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, err
+	}
+	query := u.Query()
+
+	d := &httpDatabase{
+		client:       &http.Client{},
+		params:       url.Values{},
+		user:         query.Get("username"),
+		password:     query.Get("password"),
+		passwordFile: query.Get("password_file"),
+		scheme:       u.Scheme,
+		hosts:        []string{u.Host},
+		strategy:     query.Get("connection_open_strategy"),
+		discovery:    query.Get("host_discovery"),
+		insertFormat: query.Get("insert_format"),
+	}
+	if alt := query.Get("alt_hosts"); alt != "" {
+		d.hosts = append(d.hosts, strings.Split(alt, ",")...)
+	}
+
+	var timeout time.Duration
+	for _, name := range []string{"read_timeout", "write_timeout"} {
+		if seconds, err := strconv.Atoi(query.Get(name)); err == nil {
+			timeout += time.Duration(seconds) * time.Second
+		}
+	}
+	d.client.Timeout = timeout
+
+	if name := query.Get("tls_config"); name != "" {
+		tlsConfig := lookupTLSConfig(name)
+		if tlsConfig == nil {
+			return nil, fmt.Errorf("no TLS config registered under name %s", name)
+		}
+		d.transport().TLSClientConfig = tlsConfig
+	}
+	dialer := &net.Dialer{}
+	if seconds, err := strconv.ParseFloat(query.Get("timeout"), 64); err == nil {
+		dialer.Timeout = time.Duration(seconds * float64(time.Second))
+	}
+	if keepAlive, err := time.ParseDuration(query.Get("tcp_keepalive")); err == nil {
+		dialer.KeepAlive = keepAlive
+	}
+	if dialer.Timeout > 0 || dialer.KeepAlive != 0 {
+		d.transport().DialContext = dialer.DialContext
+	}
+	if name := query.Get("host_cooldown"); name != "" {
+		if d.cooldown = lookupHostCooldown(name); d.cooldown == nil {
+			return nil, fmt.Errorf("no host cooldown registered under name %s", name)
+		}
+	} else if period, err := time.ParseDuration(query.Get("failover_cooldown")); err == nil {
+		d.cooldown = newHostCooldown(period)
+		d.cooldown.setHosts(d.hosts)
+	}
+	if raw := query.Get("proxy_url"); raw != "" {
+		proxy, err := parseProxyURL(raw)
+		if err != nil {
+			return nil, err
+		}
+		d.transport().Proxy = http.ProxyURL(proxy)
+	}
+
+	// everything else is a header or a setting of every request
+	for name, values := range query {
+		if strings.HasPrefix(name, httpHeaderParam) {
+			if d.headers == nil {
+				d.headers = http.Header{}
+			}
+			d.headers[http.CanonicalHeaderKey(strings.TrimPrefix(name, httpHeaderParam))] = values
+			continue
+		}
+		switch name {
+		case "username", "password", "alt_hosts", "read_timeout", "write_timeout", "debug", "tls_config", "skip_verify", "connection_open_strategy", "host_discovery", "proxy_url", "timeout", "tcp_keepalive", "failover_cooldown", "password_file", "host_cooldown", "insert_format":
+			continue
+		}
+		d.params[name] = values
+	}
+	if role != "" {
+		d.params.Set("role", role)
+	}
+	return d, nil
+}
+
+// index of the host a request is sent to first, with the semantics of
+// the driver's connection_open_strategy
+func (d *httpDatabase) firstHost(hosts []string) int {
+	switch d.strategy {
+	case "in_order":
+		return 0
+	case "time_random":
+		return rand.Intn(len(hosts))
+	default:
+		return int(atomic.AddUint32(&d.sent, 1)-1) % len(hosts)
+	}
+}
+
+// send a request to the first host answering it
+func (d *httpDatabase) do(ctx context.Context, method string, path string, params url.Values, body []byte) ([]byte, error) {
+	hosts := d.hosts
+	if d.discovery != "" {
+		var err error
+		if hosts, err = lookupDiscoveredHosts(d.discovery); err != nil {
+			return nil, err
+		}
+		d.cooldown.setHosts(hosts)
+	}
+	password := d.password
+	if d.passwordFile != "" {
+		var err error
+		if password, err = readPasswordFile(d.passwordFile); err != nil {
+			return nil, err
+		}
+	}
+
+	var lastErr error
+	first := d.firstHost(hosts)
+	for i := range hosts {
+		host := hosts[(first+i)%len(hosts)]
+		if d.cooldown.cooling(host) {
+			continue
+		}
+		u := url.URL{Scheme: d.scheme, Host: host, Path: path}
+		query := url.Values{}
+		for name, values := range d.params {
+			query[name] = values
+		}
+		for name, values := range params {
+			query[name] = values
+		}
+		u.RawQuery = query.Encode()
+
+		req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(ctx)
+		for name, values := range d.headers {
+			req.Header[name] = values
+		}
+		if d.user != "" {
+			req.Header.Set("X-ClickHouse-User", d.user)
+		}
+		if password != "" {
+			req.Header.Set("X-ClickHouse-Key", password)
+		}
+
+		resp, err := d.client.Do(req)
+		if err != nil && ctx.Err() != nil {
+			// cancelled, not a failure of the host
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			// try the next host
+			d.cooldown.fail(host)
+			lastErr = err
+			continue
+		}
+		d.cooldown.recover(host)
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, httpError(resp, data)
+		}
+		return data, nil
+	}
+	return nil, lastErr
+}
+
+// the server exception of an error response
+func httpError(resp *http.Response, body []byte) error {
+	message := strings.TrimSpace(string(body))
+	code, err := strconv.Atoi(resp.Header.Get("X-ClickHouse-Exception-Code"))
+	if m := httpExceptionRe.FindStringSubmatch(message); m != nil {
+		if err != nil {
+			code, err = strconv.Atoi(m[1])
+		}
+		message = message[len(m[0]):]
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %s", resp.Status, message)
+	}
+	return &clickhouse.Exception{Code: int32(code), Name: "DB::Exception", Message: message}
+}
+
+func (d *httpDatabase) Ping() error {
+	_, err := d.do(context.Background(), http.MethodGet, "/ping", nil, nil)
+	return err
+}
+
+func (d *httpDatabase) Exec(query string) error {
+	_, err := d.do(context.Background(), http.MethodPost, "/", nil, []byte(query))
+	return err
+}
+
+func (d *httpDatabase) QueryRow(query string, dest ...interface{}) error {
+	rows, err := d.Query(query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		return errors.New("no rows in result set")
+	}
+	return rows.Scan(dest...)
+}
+
+func (d *httpDatabase) Query(query string) (rows, error) {
+	data, err := d.do(context.Background(), http.MethodPost, "/", nil, []byte(strings.TrimSpace(query)+" FORMAT TabSeparated"))
+	if err != nil {
+		return nil, err
+	}
+	return &tsvRows{scanner: bufio.NewScanner(bytes.NewReader(data))}, nil
+}
+
+func (d *httpDatabase) Batch(ctx context.Context, query string) (batch, error) {
+	m := insertColumnsRe.FindStringSubmatch(query)
+	if m == nil {
+		return nil, fmt.Errorf("unsupported insert %q", query)
+	}
+
+	columns := strings.Split(m[2], ",")
+	for i := range columns {
+		columns[i] = strings.TrimSpace(columns[i])
+	}
+	b := &httpBatch{
+		ctx:     ctx,
+		db:      d,
+		query:   fmt.Sprintf("%s(%s)%s FORMAT JSONEachRow", m[1], strings.Join(columns, ","), m[3]),
+		columns: columns,
+	}
+	if d.insertFormat == insertFormatArrow {
+		b.query = fmt.Sprintf("%s(%s)%s FORMAT ArrowStream", m[1], strings.Join(columns, ","), m[3])
+		b.arrow = newArrowBatch(columns)
+	}
+	return b, nil
+}
+
+// the transport of the client, created on first use
+func (d *httpDatabase) transport() *http.Transport {
+	transport, ok := d.client.Transport.(*http.Transport)
+	if !ok {
+		transport = &http.Transport{Proxy: http.ProxyFromEnvironment}
+		d.client.Transport = transport
+	}
+	return transport
+}
+
+// the HTTP transport has no notion of a connection lifetime, only the
+// open and idle limits apply
+func (d *httpDatabase) setPoolLimits(limits poolLimits) {
+	transport := d.transport()
+	if limits.maxOpen > 0 {
+		transport.MaxConnsPerHost = limits.maxOpen
+	}
+	if limits.maxIdle > 0 {
+		transport.MaxIdleConnsPerHost = limits.maxIdle
+	}
+}
+
+func (d *httpDatabase) Close() error {
+	d.client.CloseIdleConnections()
+	return nil
+}
+
+// rows of an INSERT encoded as JSONEachRow, or kept for ArrowStream,
+// sent in a single request
+type httpBatch struct {
+	ctx     context.Context
+	db      *httpDatabase
+	query   string
+	columns []string
+	body    bytes.Buffer
+	arrow   *arrowBatch
+}
+
+func (b *httpBatch) Append(values ...interface{}) error {
+	if len(values) != len(b.columns) {
+		return fmt.Errorf("got %d values for %d columns", len(values), len(b.columns))
+	}
+	if b.arrow != nil {
+		return b.arrow.append(values)
+	}
+
+	row := make(map[string]interface{}, len(values))
+	for i, value := range values {
+		v, err := jsonValue(value)
+		if err != nil {
+			return fmt.Errorf("column %s: %s", b.columns[i], err.Error())
+		}
+		row[b.columns[i]] = v
+	}
+
+	line, err := json.Marshal(row)
+	if err != nil {
+		return err
+	}
+	b.body.Write(line)
+	b.body.WriteByte('\n')
+	return nil
+}
+
+// value as encoded in JSONEachRow, times as unix timestamps and
+// non-finite floats as the strings the server parses them from
+func jsonValue(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case time.Time:
+		return v.Unix(), nil
+	case dateTime64:
+		return v.ticks(), nil
+	case float64:
+		switch {
+		case math.IsNaN(v):
+			return "nan", nil
+		case math.IsInf(v, 1):
+			return "inf", nil
+		case math.IsInf(v, -1):
+			return "-inf", nil
+		}
+		return v, nil
+	case string, bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, nil:
+		return v, nil
+	}
+	return nil, fmt.Errorf("unsupported value %T", value)
+}
+
+func (b *httpBatch) Send() error {
+	body := b.body.Bytes()
+	if b.arrow != nil && b.arrow.rows > 0 {
+		body = b.arrow.encode()
+	}
+	if len(body) == 0 {
+		return nil
+	}
+	_, err := b.db.do(b.ctx, http.MethodPost, "/", url.Values{"query": {b.query}}, body)
+	return err
+}
+
+func (b *httpBatch) Abort() error {
+	b.body.Reset()
+	if b.arrow != nil {
+		b.arrow = newArrowBatch(b.columns)
+	}
+	return nil
+}
+
+// rows of a TabSeparated result
+type tsvRows struct {
+	scanner *bufio.Scanner
+	fields  []string
+}
+
+func (r *tsvRows) Next() bool {
+	if !r.scanner.Scan() {
+		return false
+	}
+	r.fields = strings.Split(r.scanner.Text(), "\t")
+	return true
+}
+
+func (r *tsvRows) Scan(dest ...interface{}) error {
+	if len(dest) != len(r.fields) {
+		return fmt.Errorf("expected %d destinations, got %d columns", len(dest), len(r.fields))
+	}
+	for i, field := range r.fields {
+		if err := scanTSV(unescapeTSV(field), dest[i]); err != nil {
+			return fmt.Errorf("column %d: %s", i, err.Error())
+		}
+	}
+	return nil
+}
+
+func (r *tsvRows) Err() error {
+	return r.scanner.Err()
+}
+
+func (r *tsvRows) Close() error {
+	return nil
+}
+
+var tsvUnescaper = strings.NewReplacer(`\\`, `\`, `\t`, "\t", `\n`, "\n", `\r`, "\r", `\0`, "\x00", `\'`, "'", `\b`, "\b", `\f`, "\f")
+
+func unescapeTSV(field string) string {
+	if !strings.Contains(field, `\`) {
+		return field
+	}
+	return tsvUnescaper.Replace(field)
+}
+
+// convert a TabSeparated value into the type dest points to
+func scanTSV(value string, dest interface{}) error {
+	var err error
+	switch d := dest.(type) {
+	case *string:
+		*d = value
+	case *int:
+		*d, err = strconv.Atoi(value)
+	case *int64:
+		*d, err = strconv.ParseInt(value, 10, 64)
+	case *uint64:
+		*d, err = strconv.ParseUint(value, 10, 64)
+	case *float64:
+		*d, err = strconv.ParseFloat(value, 64)
+	case *bool:
+		*d = value == "1" || value == "true"
+	case *time.Time:
+		*d, err = time.ParseInLocation("2006-01-02 15:04:05", value, time.Local)
+	default:
+		err = fmt.Errorf("unsupported destination %T", dest)
+	}
+	return err
+}
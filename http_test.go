@@ -0,0 +1,350 @@
+package clickhouse
+
+import (
+	"context"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/influxdata/telegraf/config"
+)
+
+// a fake ClickHouse HTTP interface recording the requests it receives
+type httpServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests []*http.Request
+	bodies   []string
+	// response body and status per query prefix
+	responses map[string]string
+	fail      map[string]int
+}
+
+func newHTTPServer(t *testing.T) *httpServer {
+	s := &httpServer{responses: make(map[string]string), fail: make(map[string]int)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.requests = append(s.requests, r)
+		s.bodies = append(s.bodies, string(data))
+
+		if r.URL.Path == "/ping" {
+			w.Write([]byte("Ok.\n"))
+			return
+		}
+		query := r.URL.Query().Get("query")
+		if query == "" {
+			query = string(data)
+		}
+		for prefix, status := range s.fail {
+			if strings.HasPrefix(query, prefix) {
+				w.Header().Set("X-ClickHouse-Exception-Code", "53")
+				w.WriteHeader(status)
+				w.Write([]byte("Code: 53. DB::Exception: Type mismatch. (TYPE_MISMATCH)"))
+				return
+			}
+		}
+		for prefix, response := range s.responses {
+			if strings.HasPrefix(query, prefix) {
+				w.Write([]byte(response))
+				return
+			}
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func openTestHTTPDatabase(t *testing.T, hosts ...string) *httpDatabase {
+	u := url.URL{Scheme: "http", Host: hosts[0], RawQuery: url.Values{
+		"username":  {"writer"},
+		"password":  {"secret"},
+		"database":  {"telegraf"},
+		"alt_hosts": {strings.Join(hosts[1:], ",")},
+	}.Encode()}
+
+	d, err := openHTTPDatabase(u.String(), "inserter")
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	return d.(*httpDatabase)
+}
+
+func TestHTTPDatabase(t *testing.T) {
+	s := newHTTPServer(t)
+	s.responses["SELECT name, value"] = "async_insert\t0\nlog_comment\ta\\tb\n"
+	d := openTestHTTPDatabase(t, strings.TrimPrefix(s.URL, "http://"))
+
+	if err := d.Ping(); err != nil {
+		t.Fatalf("ping: %v", err)
+	}
+
+	rows, err := d.Query("SELECT name, value FROM system.settings")
+	if err != nil {
+		t.Fatalf("query: %v", err)
+	}
+	var names, values []string
+	for rows.Next() {
+		var name, value string
+		if err := rows.Scan(&name, &value); err != nil {
+			t.Fatalf("scan: %v", err)
+		}
+		names, values = append(names, name), append(values, value)
+	}
+	if strings.Join(names, ",") != "async_insert,log_comment" || values[1] != "a\tb" {
+		t.Errorf("unexpected result %v %q", names, values)
+	}
+
+	r := s.requests[len(s.requests)-1]
+	if r.Header.Get("X-ClickHouse-User") != "writer" || r.Header.Get("X-ClickHouse-Key") != "secret" {
+		t.Errorf("expected credentials in headers, got %v", r.Header)
+	}
+	if params := r.URL.Query(); params.Get("database") != "telegraf" || params.Get("role") != "inserter" || params.Get("password") != "" {
+		t.Errorf("unexpected parameters %v", params)
+	}
+	if body := s.bodies[len(s.bodies)-1]; body != "SELECT name, value FROM system.settings FORMAT TabSeparated" {
+		t.Errorf("unexpected query %q", body)
+	}
+}
+
+func TestHTTPBatch(t *testing.T) {
+	s := newHTTPServer(t)
+	d := openTestHTTPDatabase(t, strings.TrimPrefix(s.URL, "http://"))
+
+	b, err := d.Batch(context.Background(), "INSERT INTO telegraf.metrics(name,tags,val,ts) SETTINGS async_insert=1 VALUES(?,?,?,?)")
+	if err != nil {
+		t.Fatalf("batch: %v", err)
+	}
+	ts := time.Unix(1600000000, 0)
+	if err := b.Append("cpu", "{}", 1.5, ts); err != nil {
+		t.Fatalf("append: %v", err)
+	}
+	if err := b.Append("cpu", "{}", math.NaN(), dateTime64{Time: ts.Add(5 * time.Millisecond), precision: 3}); err != nil {
+		t.Fatalf("append: %v", err)
+	}
+	if err := b.Append("cpu"); err == nil {
+		t.Error("expected append with missing values to fail")
+	}
+	if err := b.Send(); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+
+	r := s.requests[len(s.requests)-1]
+	if query := r.URL.Query().Get("query"); query != "INSERT INTO telegraf.metrics(name,tags,val,ts) SETTINGS async_insert=1 FORMAT JSONEachRow" {
+		t.Errorf("unexpected query %q", query)
+	}
+	expected := `{"name":"cpu","tags":"{}","ts":1600000000,"val":1.5}` + "\n" +
+		`{"name":"cpu","tags":"{}","ts":1600000000005,"val":"nan"}` + "\n"
+	if body := s.bodies[len(s.bodies)-1]; body != expected {
+		t.Errorf("expected body %q, got %q", expected, body)
+	}
+}
+
+func TestHTTPException(t *testing.T) {
+	s := newHTTPServer(t)
+	s.fail["INSERT"] = http.StatusBadRequest
+	d := openTestHTTPDatabase(t, strings.TrimPrefix(s.URL, "http://"))
+
+	b, _ := d.Batch(context.Background(), "INSERT INTO telegraf.metrics(name) VALUES(?)")
+	b.Append("cpu")
+	err := b.Send()
+	if !isPermanentError(err) {
+		t.Fatalf("expected a TYPE_MISMATCH exception, got %#v", err)
+	}
+}
+
+func TestHTTPFailover(t *testing.T) {
+	s := newHTTPServer(t)
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	d := openTestHTTPDatabase(t, strings.TrimPrefix(down.URL, "http://"), strings.TrimPrefix(s.URL, "http://"))
+	if err := d.Ping(); err != nil {
+		t.Fatalf("expected ping to fail over, got %v", err)
+	}
+}
+
+func TestHTTPRoundRobin(t *testing.T) {
+	a, b := newHTTPServer(t), newHTTPServer(t)
+	d := openTestHTTPDatabase(t, strings.TrimPrefix(a.URL, "http://"), strings.TrimPrefix(b.URL, "http://"))
+	for i := 0; i < 4; i++ {
+		if err := d.Ping(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(a.requests) != 2 || len(b.requests) != 2 {
+		t.Errorf("expected requests spread evenly, got %d and %d", len(a.requests), len(b.requests))
+	}
+
+	d.strategy = "in_order"
+	if err := d.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	if len(a.requests) != 3 {
+		t.Errorf("expected in_order to pick the first host, got %d requests", len(a.requests))
+	}
+}
+
+func TestBuildDsn(t *testing.T) {
+	c := newClickhouse()
+	c.Hosts = []string{"a:8123", "b:8123"}
+	c.User = config.NewSecret([]byte("writer"))
+	c.Password = config.NewSecret([]byte("secret"))
+	c.Database = "telegraf"
+	c.ReadTimeout = 10
+	c.Protocol = "http"
+	c.FormatSettings = map[string]string{"input_format_null_as_default": "1"}
+
+	dsn, err := buildDsn(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "http://a:8123?alt_hosts=b%3A8123&connection_open_strategy=random&debug=false&input_format_null_as_default=1&password=secret&read_timeout=10&username=writer"
+	if dsn != expected {
+		t.Errorf("expected %s, got %s", expected, dsn)
+	}
+
+	c.Protocol = "gopher"
+	if _, err := buildDsn(c); err == nil {
+		t.Error("expected unknown protocol to fail")
+	}
+
+	c.Protocol = "native"
+	c.LoadBalancing = "sticky"
+	if _, err := buildDsn(c); err == nil {
+		t.Error("expected unknown load_balancing to fail")
+	}
+}
+
+func TestBuildDsnFormatSettings(t *testing.T) {
+	c := newClickhouse()
+	c.Hosts = []string{"a:8123"}
+	c.Protocol = "http"
+	c.FormatSettings = map[string]string{"date_time_input_format": "best_effort", "output_format_json_quote_64bit_integers": "0"}
+	dsn, err := buildDsn(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(dsn, "date_time_input_format=best_effort") || !strings.Contains(dsn, "output_format_json_quote_64bit_integers=0") {
+		t.Errorf("expected the format settings in %s", dsn)
+	}
+
+	c.FormatSettings = map[string]string{"password": "other"}
+	if _, err := buildDsn(c); err == nil {
+		t.Error("expected a driver parameter to be rejected")
+	}
+
+	c.Protocol = "native"
+	c.FormatSettings = map[string]string{"input_format_null_as_default": "1"}
+	if _, err := buildDsn(c); err == nil {
+		t.Error("expected format_settings to fail with the native protocol")
+	}
+}
+
+func TestBuildDsnExtraParams(t *testing.T) {
+	c := newClickhouse()
+	c.Hosts = []string{"a:9000"}
+	c.ReadTimeout = 10
+	c.ExtraParams = map[string]string{"block_size": "100000", "read_timeout": "30"}
+
+	dsn, err := buildDsn(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Query().Get("block_size") != "100000" || u.Query()["read_timeout"][0] != "30" || len(u.Query()["read_timeout"]) != 1 {
+		t.Errorf("expected the extra params merged into %s", dsn)
+	}
+}
+
+func TestBuildDsnCompression(t *testing.T) {
+	c := newClickhouse()
+	c.Hosts = []string{"a:9000"}
+	c.Compression = "lz4"
+
+	dsn, err := buildDsn(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(dsn, "compress=true") {
+		t.Errorf("expected compress=true in %s", dsn)
+	}
+
+	for _, compression := range []string{"zstd", "brotli"} {
+		c.Compression = compression
+		if _, err := buildDsn(c); err == nil {
+			t.Errorf("expected compression %s to fail", compression)
+		}
+	}
+
+	c.Compression = "lz4"
+	c.Protocol = "http"
+	if _, err := buildDsn(c); err == nil {
+		t.Error("expected compression over http to fail")
+	}
+}
+
+func TestHTTPBatchDeadline(t *testing.T) {
+	release := make(chan struct{})
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer s.Close()
+	defer close(release)
+
+	d := openTestHTTPDatabase(t, strings.TrimPrefix(s.URL, "http://"))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	b, err := d.Batch(ctx, "INSERT INTO telegraf.metrics(name) VALUES(?)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Append("cpu")
+	if err := b.Send(); err != context.DeadlineExceeded {
+		t.Fatalf("expected the deadline to cancel the request, got %v", err)
+	}
+}
+
+func TestHTTPHeaders(t *testing.T) {
+	s := newHTTPServer(t)
+	c := newClickhouse()
+	c.Hosts = []string{strings.TrimPrefix(s.URL, "http://")}
+	c.Protocol = "http"
+	c.HTTPHeaders = map[string]string{"authorization": "Bearer token", "X-Tenant": "metrics"}
+
+	dsn, err := buildDsn(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := openHTTPDatabase(dsn, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Exec("SELECT 1"); err != nil {
+		t.Fatal(err)
+	}
+
+	req := s.requests[0]
+	if req.Header.Get("Authorization") != "Bearer token" || req.Header.Get("X-Tenant") != "metrics" {
+		t.Errorf("expected the configured headers, got %v", req.Header)
+	}
+	if strings.Contains(req.URL.RawQuery, "http_header") {
+		t.Errorf("expected headers not to be sent as settings, got %s", req.URL.RawQuery)
+	}
+
+	c.Protocol = "native"
+	if _, err := buildDsn(c); err == nil {
+		t.Error("expected http_headers over the native protocol to fail")
+	}
+}
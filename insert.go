@@ -0,0 +1,159 @@
+package clickhouse
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// a row of the metrics table
+type insertRow struct {
+	// the metric the row was converted from
+	metric clickhouseMetric
+	values []interface{}
+	// approximate encoded size in bytes
+	size int
+}
+
+// insert rows into table as a single batch. Rows the driver
+// refuses are counted as failed and sampled, they do not fail the batch.
+func (c *ClickhouseClient) insertBatch(ctx context.Context, table string, columns []string, rows []insertRow, stats *writeStats) ([]rejectedRow, error) {
+	b, err := c.db.Batch(ctx, c.insertQuery(table, columns))
+	if err != nil {
+		return nil, err
+	}
+	stats.prepare += stats.lap()
+
+	var rejected []rejectedRow
+	var appended []insertRow
+	for _, row := range rows {
+		if err := b.Append(row.values...); err != nil {
+			stats.addFailed()
+			if c.PermanentErrors == "reject" {
+				stats.rejectSource(row)
+			}
+			rejected = c.sampleRejected(rejected, row.metric, err)
+			if c.Debug {
+				log.Println(err.Error())
+			}
+		} else {
+			appended = append(appended, row)
+		}
+	}
+	stats.encode += stats.lap()
+
+	if err := b.Send(); err != nil {
+		return nil, err
+	}
+	stats.commit += stats.lap()
+
+	// the rows are written once committed
+	target := c.qualifiedTable(table)
+	for _, row := range appended {
+		stats.addRow(target, row.size)
+	}
+
+	if c.Debug {
+		log.Println("Batch Sent")
+	}
+	return rejected, nil
+}
+
+// insert rows into an auxiliary table of the target database as a single
+// batch.
+func (c *ClickhouseClient) insertRows(table string, columns []string, rows [][]interface{}) error {
+	b, err := c.db.Batch(context.Background(), c.insertQuery(table, columns))
+	if err != nil {
+		return err
+	}
+
+	for _, row := range rows {
+		if err = b.Append(row...); err != nil {
+			b.Abort()
+			return err
+		}
+	}
+
+	return b.Send()
+}
+
+// INSERT statement of columns into table of the target database
+func (c *ClickhouseClient) insertQuery(table string, columns []string) string {
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(columns)), ",")
+	return fmt.Sprintf("INSERT INTO %s(%s)%s VALUES(%s)",
+		c.qualifiedTable(table), strings.Join(columns, ","), c.insertSettings(), placeholders)
+}
+
+// SETTINGS clause of the configured settings and query_settings attached
+// to every INSERT, empty if none are configured.
+func (c *ClickhouseClient) insertSettings() string {
+	merged := make(map[string]string, len(c.Settings)+len(c.QuerySettings)+2)
+	if caps := c.capabilities(); c.AsyncInsert && caps != nil && caps.asyncInsert {
+		merged["async_insert"] = "1"
+		merged["wait_for_async_insert"] = "1"
+	}
+	for name, value := range c.Settings {
+		merged[name] = value
+	}
+	for name, value := range c.QuerySettings {
+		merged[name] = value
+	}
+	if len(merged) == 0 {
+		return ""
+	}
+
+	names := make([]string, 0, len(merged))
+	for name := range merged {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	settings := make([]string, 0, len(names))
+	for _, name := range names {
+		settings = append(settings, name+"="+settingValue(merged[name]))
+	}
+	return " SETTINGS " + strings.Join(settings, ", ")
+}
+
+// literal of a setting value, numbers and booleans are passed as is
+func settingValue(value string) string {
+	if _, err := strconv.ParseFloat(value, 64); err == nil {
+		return value
+	}
+	if _, err := strconv.ParseBool(value); err == nil {
+		return value
+	}
+	return quoteString(value)
+}
+
+// split rows into batches of at most maxBytes approximate encoded size. A
+// single row exceeding maxBytes forms a batch of its own.
+func splitRows(rows []insertRow, maxBytes int64) [][]insertRow {
+	if maxBytes <= 0 {
+		return [][]insertRow{rows}
+	}
+
+	var batches [][]insertRow
+	var size int64
+	start := 0
+	for i, row := range rows {
+		if i > start && size+int64(row.size) > maxBytes {
+			batches = append(batches, rows[start:i])
+			start, size = i, 0
+		}
+		size += int64(row.size)
+	}
+	return append(batches, rows[start:])
+}
+
+// approximate encoded size of rows in bytes
+func rowsSize(rows []insertRow) int64 {
+	var size int64
+	for _, row := range rows {
+		size += int64(row.size)
+	}
+	return size
+}
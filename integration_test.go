@@ -0,0 +1,254 @@
+//go:build integration
+// +build integration
+
+package clickhouse
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/config"
+	"github.com/influxdata/telegraf/metric"
+)
+
+// ClickHouse servers started by docker-compose.yml, overridden by
+// CLICKHOUSE_INTEGRATION_HOSTS="22=host:port,23=host:port,..." and their
+// HTTP interfaces by CLICKHOUSE_INTEGRATION_HTTP_HOSTS alike
+var (
+	integrationHosts = map[string]string{
+		"22": "127.0.0.1:9022",
+		"23": "127.0.0.1:9023",
+		"24": "127.0.0.1:9024",
+	}
+	integrationHTTPHosts = map[string]string{
+		"22": "127.0.0.1:8122",
+		"23": "127.0.0.1:8123",
+		"24": "127.0.0.1:8124",
+	}
+)
+
+func init() {
+	parseHosts := func(env string, hosts *map[string]string) {
+		if env == "" {
+			return
+		}
+		*hosts = make(map[string]string)
+		for _, entry := range strings.Split(env, ",") {
+			parts := strings.SplitN(entry, "=", 2)
+			if len(parts) == 2 {
+				(*hosts)[parts[0]] = parts[1]
+			}
+		}
+	}
+	parseHosts(os.Getenv("CLICKHOUSE_INTEGRATION_HOSTS"), &integrationHosts)
+	parseHosts(os.Getenv("CLICKHOUSE_INTEGRATION_HTTP_HOSTS"), &integrationHTTPHosts)
+}
+
+// run f against every integration server with a freshly connected client
+// writing into its own database.
+func forEachServer(t *testing.T, configure func(c *ClickhouseClient), f func(t *testing.T, c *ClickhouseClient)) {
+	forEachHost(t, integrationHosts, configure, f)
+}
+
+// run f against every HTTP interface of the integration servers
+func forEachHTTPServer(t *testing.T, configure func(c *ClickhouseClient), f func(t *testing.T, c *ClickhouseClient)) {
+	forEachHost(t, integrationHTTPHosts, func(c *ClickhouseClient) {
+		c.Protocol = "http"
+		if configure != nil {
+			configure(c)
+		}
+	}, f)
+}
+
+func forEachHost(t *testing.T, hosts map[string]string, configure func(c *ClickhouseClient), f func(t *testing.T, c *ClickhouseClient)) {
+	for version, host := range hosts {
+		version, host := version, host
+		t.Run("clickhouse-"+version, func(t *testing.T) {
+			c := newClickhouse()
+			c.User = config.NewSecret([]byte("default"))
+			c.Hosts = []string{host}
+			c.Database = fmt.Sprintf("telegraf_it_%d", time.Now().UnixNano())
+			c.TableName = "metrics"
+			c.ReadTimeout = 10
+			c.WriteTimeout = 10
+			if configure != nil {
+				configure(c)
+			}
+
+			if err := c.Connect(); err != nil {
+				t.Fatalf("connect: %v", err)
+			}
+			defer func() {
+				c.db.Exec("DROP DATABASE IF EXISTS " + c.Database)
+				c.Close()
+			}()
+
+			f(t, c)
+		})
+	}
+}
+
+func testMetrics() []telegraf.Metric {
+	now := time.Now().Truncate(time.Second)
+	return []telegraf.Metric{
+		metric.New("cpu",
+			map[string]string{"host": "a", "cpu": "cpu0"},
+			map[string]interface{}{"usage_idle": 99.5, "usage_user": 0.5},
+			now),
+		metric.New("mem",
+			map[string]string{"host": "a"},
+			map[string]interface{}{"used": int64(1024), "available": uint64(2048)},
+			now),
+	}
+}
+
+func countRows(t *testing.T, c *ClickhouseClient, table string) int {
+	var n int
+	if err := c.db.QueryRow(fmt.Sprintf("SELECT count() FROM %s.%s", c.Database, table), &n); err != nil {
+		t.Fatalf("count %s: %v", table, err)
+	}
+	return n
+}
+
+func TestIntegrationCapabilities(t *testing.T) {
+	forEachServer(t, nil, func(t *testing.T, c *ClickhouseClient) {
+		if err := c.ensureCapabilities(); err != nil {
+			t.Fatalf("detect capabilities: %v", err)
+		}
+		caps := c.capabilities()
+		if !caps.modernSyntax || !caps.dateTime64 || !caps.mapType {
+			t.Errorf("unexpected capabilities of %s: %s", caps.version, caps)
+		}
+	})
+}
+
+func TestIntegrationWriteNarrow(t *testing.T) {
+	forEachServer(t, nil, func(t *testing.T, c *ClickhouseClient) {
+		if err := c.Write(testMetrics()); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		if n := countRows(t, c, c.TableName); n != 4 {
+			t.Errorf("expected 4 rows, got %d", n)
+		}
+
+		var tags string
+		if err := c.db.QueryRow(fmt.Sprintf(
+			"SELECT tags FROM %s.%s WHERE name = 'cpu_usage_idle'", c.Database, c.TableName,
+		), &tags); err != nil {
+			t.Fatalf("select tags: %v", err)
+		}
+		if tags != `{"cpu":"cpu0","host":"a"}` {
+			t.Errorf("unexpected tags %s", tags)
+		}
+
+		// the schema is created once, a second flush only inserts
+		if err := c.Write(testMetrics()); err != nil {
+			t.Fatalf("second write: %v", err)
+		}
+		if n := countRows(t, c, c.TableName); n != 8 {
+			t.Errorf("expected 8 rows, got %d", n)
+		}
+	})
+}
+
+func TestIntegrationWriteSeries(t *testing.T) {
+	forEachServer(t, func(c *ClickhouseClient) {
+		c.TableLayout = layoutSeries
+	}, func(t *testing.T, c *ClickhouseClient) {
+		for i := 0; i < 2; i++ {
+			if err := c.Write(testMetrics()); err != nil {
+				t.Fatalf("write: %v", err)
+			}
+		}
+		if n := countRows(t, c, c.TableName); n != 8 {
+			t.Errorf("expected 8 samples, got %d", n)
+		}
+		if n := countRows(t, c, c.SeriesTable); n != 4 {
+			t.Errorf("expected 4 series, got %d", n)
+		}
+	})
+}
+
+func TestIntegrationTTL(t *testing.T) {
+	forEachServer(t, func(c *ClickhouseClient) {
+		c.TTL = "ts + INTERVAL 30 DAY"
+	}, func(t *testing.T, c *ClickhouseClient) {
+		if err := c.Write(testMetrics()); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		ttl, err := c.tableTTL(c.TableName)
+		if err != nil {
+			t.Fatalf("table ttl: %v", err)
+		}
+		if normalizeTTL(ttl) != normalizeTTL(c.TTL) {
+			t.Errorf("expected ttl %q, got %q", c.TTL, ttl)
+		}
+	})
+}
+
+func TestIntegrationAuxiliaryTables(t *testing.T) {
+	forEachServer(t, func(c *ClickhouseClient) {
+		c.SelfStats = true
+		c.Catalog = true
+	}, func(t *testing.T, c *ClickhouseClient) {
+		if err := c.Write(testMetrics()); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		if n := countRows(t, c, c.SelfStatsTable); n != 1 {
+			t.Errorf("expected 1 stats row, got %d", n)
+		}
+		if n := countRows(t, c, c.CatalogTable); n != 4 {
+			t.Errorf("expected 4 catalog rows, got %d", n)
+		}
+	})
+}
+
+// ArrowStream inserts as ClickHouse reads them, rather than as the
+// decoder of the unit tests does
+func TestIntegrationArrowStream(t *testing.T) {
+	forEachHTTPServer(t, func(c *ClickhouseClient) {
+		c.InsertFormat = insertFormatArrow
+		c.TableLayout = layoutWide
+		c.TimestampPrecision = "ms"
+		c.NullableFields = true
+	}, func(t *testing.T, c *ClickhouseClient) {
+		ts := time.Unix(1600000000, 123000000)
+		batch := []telegraf.Metric{
+			metric.New("cpu", map[string]string{"host": "a"},
+				map[string]interface{}{"usage_idle": 99.5, "state": "idle", "up": true}, ts),
+			metric.New("mem", map[string]string{"host": "a"},
+				map[string]interface{}{"used": int64(-1 << 60), "available": uint64(1<<63 + 1)}, ts),
+		}
+		if err := c.Write(batch); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		if n := countRows(t, c, c.TableName); n != 2 {
+			t.Fatalf("expected 2 rows, got %d", n)
+		}
+
+		var millis, idle, state, up string
+		if err := c.db.QueryRow(fmt.Sprintf(
+			"SELECT toString(toUnixTimestamp64Milli(ts)), toString(usage_idle), state, toString(up) FROM %s.%s WHERE name = 'cpu'",
+			c.Database, c.TableName,
+		), &millis, &idle, &state, &up); err != nil {
+			t.Fatalf("select cpu: %v", err)
+		}
+		if millis != "1600000000123" || idle != "99.5" || state != "idle" || up != "1" {
+			t.Errorf("unexpected cpu row %s, %s, %s, %s", millis, idle, state, up)
+		}
+
+		var used, available string
+		if err := c.db.QueryRow(fmt.Sprintf(
+			"SELECT toString(used), toString(available) FROM %s.%s WHERE name = 'mem'", c.Database, c.TableName,
+		), &used, &available); err != nil {
+			t.Fatalf("select mem: %v", err)
+		}
+		if used != "-1152921504606846976" || available != "9223372036854775809" {
+			t.Errorf("expected the integers exact, got %s and %s", used, available)
+		}
+	})
+}
@@ -0,0 +1,116 @@
+package clickhouse
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// a background maintenance task run at most every interval
+type maintenanceTask struct {
+	name     string
+	interval time.Duration
+	run      func()
+
+	lastRun time.Time
+	running int32
+}
+
+// background maintenance tasks enabled by the configuration
+func (c *ClickhouseClient) maintenanceTasks() []*maintenanceTask {
+	var tasks []*maintenanceTask
+	if c.RetentionDays > 0 && c.RetentionInterval > 0 {
+		tasks = append(tasks, &maintenanceTask{
+			name:     "partition drop",
+			interval: time.Duration(c.RetentionInterval),
+			run:      c.dropExpiredPartitions,
+		})
+	}
+	if c.ttlPending != nil {
+		tasks = append(tasks, &maintenanceTask{
+			name:     "TTL materialization",
+			interval: time.Minute,
+			run:      func() { c.materializePendingTTL(time.Now()) },
+		})
+	}
+	if len(c.Purge) > 0 && c.PurgeInterval > 0 {
+		tasks = append(tasks, &maintenanceTask{
+			name:     "tag purge",
+			interval: time.Duration(c.PurgeInterval),
+			run:      c.purgeTags,
+		})
+	}
+	if c.catalog != nil {
+		tasks = append(tasks, &maintenanceTask{
+			name:     "catalog compaction",
+			interval: 24 * time.Hour,
+			run:      c.compactCatalog,
+		})
+	}
+	return tasks
+}
+
+// run the due maintenance tasks while the maintenance window is open, with
+// at most maintenance_concurrency tasks at a time, until the plugin is
+// closed.
+func (c *ClickhouseClient) runMaintenance(tasks []*maintenanceTask) {
+	defer c.wg.Done()
+
+	concurrency := c.MaintenanceConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	slots := make(chan struct{}, concurrency)
+
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case now := <-ticker.C:
+			if c.maintenanceWindow != nil && !c.maintenanceWindow.contains(now) {
+				continue
+			}
+
+			for _, task := range tasks {
+				if now.Sub(task.lastRun) < task.interval || atomic.LoadInt32(&task.running) != 0 {
+					continue
+				}
+
+				select {
+				case slots <- struct{}{}:
+				default:
+					// all slots busy, retry on the next tick
+					continue
+				}
+
+				task.lastRun = now
+				atomic.StoreInt32(&task.running, 1)
+				c.wg.Add(1)
+				go func(task *maintenanceTask) {
+					defer c.wg.Done()
+					defer func() { <-slots }()
+					defer atomic.StoreInt32(&task.running, 0)
+
+					if c.Debug {
+						log.Println("Running maintenance:", task.name)
+					}
+					task.run()
+				}(task)
+			}
+		}
+	}
+}
+
+// collapse the catalog rows superseded by newer updates on every replica.
+// A failure is logged by execDDL.
+func (c *ClickhouseClient) compactCatalog() {
+	if atomic.LoadInt32(&c.insertOnly) != 0 {
+		return
+	}
+	table := fmt.Sprintf("%s.%s", c.Database, c.CatalogTable)
+	c.execDDL(table, fmt.Sprintf("OPTIMIZE TABLE %s%s FINAL", table, c.onCluster()))
+}
@@ -15,15 +15,29 @@ type (
 		Name    string                 `json:"name" db:"name"`
 		Tags    map[string]interface{} `json:"tags" db:"tags"`
 		Val     float64                `json:"val" db:"val"`
+		ValStr  string                 `json:"val_str" db:"val_str"`
 		Ts      time.Time              `json:"ts" db:"ts"`
 		Updated time.Time              `json:"updated" db:"updated"`
+
+		// the metric received from Telegraf, for its delivery tracking
+		source telegraf.Metric
+		// name of the measurement the field belongs to
+		measurement string
+		// table the metric is written to
+		table string
+		// key of the field and whether it is a string, kept in ValStr or
+		// the tags
+		field string
+		str   bool
 	}
 
 	// metrics of clickhouse
 	clickhouseMetrics []clickhouseMetric
 )
 
-func newClickhouseMetrics(metric telegraf.Metric) *clickhouseMetrics {
+// rows of the fields of metric. String fields are kept in valStr if
+// enabled, else as a tag named after the field.
+func newClickhouseMetrics(metric telegraf.Metric, valStr bool) *clickhouseMetrics {
 	//var fieldCount int
 	cm := new(clickhouseMetrics)
 
@@ -43,9 +57,16 @@ func newClickhouseMetrics(metric telegraf.Metric) *clickhouseMetrics {
 			tmpClickhouseMetric.Name = fmt.Sprintf("%s_%s", metric.Name(), field.Key)
 		}
 
+		tmpClickhouseMetric.field = field.Key
+
 		tmpFiledValue := convertField(field.Value)
 		if tmpFiledValue == nil {
-			tags[field.Key] = field.Value.(string)
+			tmpClickhouseMetric.str = true
+			if valStr {
+				tmpClickhouseMetric.ValStr = field.Value.(string)
+			} else {
+				tags[field.Key] = field.Value.(string)
+			}
 			for _, value := range metric.TagList() {
 				tags[value.Key] = value.Value
 			}
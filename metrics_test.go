@@ -0,0 +1,174 @@
+package clickhouse
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/metric"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+var conversionCases = map[string][]telegraf.Metric{
+	"field_types": {
+		metric.New("types",
+			map[string]string{"host": "a"},
+			map[string]interface{}{
+				"float64": float64(1.5),
+				"float32": float32(2.5),
+				"int":     int(-3),
+				"int8":    int8(-8),
+				"int16":   int16(-16),
+				"int32":   int32(-32),
+				"int64":   int64(-64),
+				"uint":    uint(3),
+				"uint8":   uint8(8),
+				"uint16":  uint16(16),
+				"uint32":  uint32(32),
+				"uint64":  uint64(1 << 60),
+				"true":    true,
+				"false":   false,
+			},
+			time.Unix(1600000000, 0).UTC()),
+	},
+	"gauge_field": {
+		metric.New("temperature",
+			map[string]string{"sensor": "s1"},
+			map[string]interface{}{"gauge": 21.5},
+			time.Unix(1600000000, 0).UTC()),
+	},
+	"string_field": {
+		metric.New("system",
+			map[string]string{"host": "a"},
+			map[string]interface{}{"uptime_format": "1 day,  2:03", "uptime": int64(93780)},
+			time.Unix(1600000000, 0).UTC()),
+	},
+	"weird_tags": {
+		metric.New("weird",
+			map[string]string{
+				"quote":     `say "hi"`,
+				"backslash": `C:\temp\`,
+				"unicode":   "zürich 東京",
+				"newline":   "a\nb",
+				"separator": "a=b,c d",
+				"html":      "<b>&amp;</b>",
+			},
+			map[string]interface{}{"value": 1.0},
+			time.Unix(1600000000, 0).UTC()),
+	},
+	"timestamps": {
+		metric.New("ts",
+			map[string]string{"precision": "ns"},
+			map[string]interface{}{"value": 1.0},
+			time.Unix(1600000000, 123456789).UTC()),
+		metric.New("ts",
+			map[string]string{"precision": "zone"},
+			map[string]interface{}{"value": 2.0},
+			time.Unix(1600000000, 0).In(time.FixedZone("UTC+5", 5*60*60))),
+		metric.New("ts",
+			map[string]string{"precision": "epoch"},
+			map[string]interface{}{"value": 3.0},
+			time.Unix(0, 0).UTC()),
+	},
+}
+
+// the converted rows of a batch, as stored in the golden files
+type goldenRows struct {
+	Columns []string        `json:"columns"`
+	Rows    [][]interface{} `json:"rows"`
+}
+
+func convert(c *ClickhouseClient, metrics []telegraf.Metric) goldenRows {
+	var batchMetrics []clickhouseMetrics
+	for _, m := range metrics {
+		batchMetrics = append(batchMetrics, *newClickhouseMetrics(m, c.ValStr))
+	}
+
+	columns, rows := c.narrowRows(batchMetrics)
+	golden := goldenRows{Columns: columns}
+	for _, row := range rows {
+		golden.Rows = append(golden.Rows, row.values)
+	}
+
+	// field order of a metric is not defined
+	sort.SliceStable(golden.Rows, func(i, j int) bool {
+		return fmt.Sprint(golden.Rows[i]...) < fmt.Sprint(golden.Rows[j]...)
+	})
+	return golden
+}
+
+func TestConversionGolden(t *testing.T) {
+	c := newClickhouse()
+
+	for name, metrics := range conversionCases {
+		t.Run(name, func(t *testing.T) {
+			actual, err := json.MarshalIndent(convert(c, metrics), "", "  ")
+			if err != nil {
+				t.Fatal(err)
+			}
+			actual = append(actual, '\n')
+
+			path := filepath.Join("testdata", "conversion", name+".golden")
+			if *update {
+				if err := ioutil.WriteFile(path, actual, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			expected, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatalf("%v (run go test -update to create it)", err)
+			}
+			if !bytes.Equal(actual, expected) {
+				t.Errorf("conversion differs from %s:\n%s", path, actual)
+			}
+		})
+	}
+}
+
+func FuzzConversion(f *testing.F) {
+	f.Add("cpu", "host", "a", "usage", "", 1.5, int64(1))
+	f.Add("weird.name-1", "k\"ey", "v\\al\nue", "gauge", "string value", -0.0, int64(-1))
+	f.Add("", "", "", "", "", 0.0, int64(0))
+
+	f.Fuzz(func(t *testing.T, name, tagKey, tagValue, fieldKey, stringValue string, floatValue float64, intValue int64) {
+		if name == "" || fieldKey == "" {
+			t.Skip()
+		}
+
+		tags := make(map[string]string)
+		if tagKey != "" && tagValue != "" {
+			tags[tagKey] = tagValue
+		}
+		fields := map[string]interface{}{
+			fieldKey:          floatValue,
+			fieldKey + "_int": intValue,
+		}
+		if stringValue != "" {
+			fields[fieldKey+"_str"] = stringValue
+		}
+		m := metric.New(name, tags, fields, time.Unix(1600000000, 0))
+
+		golden := convert(newClickhouse(), []telegraf.Metric{m})
+		if len(golden.Rows) != len(fields) {
+			t.Fatalf("expected %d rows, got %d", len(fields), len(golden.Rows))
+		}
+		for _, row := range golden.Rows {
+			if !strings.HasPrefix(row[0].(string), name) {
+				t.Errorf("row name %q does not start with %q", row[0], name)
+			}
+			if !json.Valid([]byte(row[1].(string))) {
+				t.Errorf("invalid tags %q", row[1])
+			}
+		}
+	})
+}
@@ -0,0 +1,77 @@
+package clickhouse
+
+import "math"
+
+// handling of NaN and ±Inf float fields by nan_handling
+const (
+	nanKeep = "keep"
+	nanDrop = "drop"
+	nanNull = "null"
+	nanZero = "zero"
+)
+
+// whether v is a NaN or infinite float
+func isNonFinite(v interface{}) bool {
+	switch f := v.(type) {
+	case float64:
+		return math.IsNaN(f) || math.IsInf(f, 0)
+	case float32:
+		return math.IsNaN(float64(f)) || math.IsInf(float64(f), 0)
+	}
+	return false
+}
+
+// metrs with their non-finite values dropped or zeroed. Nulls are
+// written by the rows of the layout.
+func (c *ClickhouseClient) finiteMetrics(metrs clickhouseMetrics) clickhouseMetrics {
+	if c.NaNHandling != nanDrop && c.NaNHandling != nanZero {
+		return metrs
+	}
+	kept := metrs[:0]
+	for _, metr := range metrs {
+		if isNonFinite(metr.Val) {
+			if c.NaNHandling == nanDrop {
+				continue
+			}
+			metr.Val = 0
+		}
+		kept = append(kept, metr)
+	}
+	return kept
+}
+
+// metric with its non-finite fields zeroed, or left out for the columns
+// to take their default
+func (c *ClickhouseClient) finiteWideMetric(metric wideMetric) wideMetric {
+	if c.NaNHandling == nanKeep {
+		return metric
+	}
+	for key, value := range metric.fields {
+		if !isNonFinite(value) {
+			continue
+		}
+		if c.NaNHandling == nanZero {
+			metric.fields[key] = float64(0)
+		} else {
+			delete(metric.fields, key)
+		}
+	}
+	return metric
+}
+
+// value of the val column, NULL for non-finite values with nan_handling
+// null
+func (c *ClickhouseClient) valValue(val float64) interface{} {
+	if c.NaNHandling == nanNull && isNonFinite(val) {
+		return nil
+	}
+	return val
+}
+
+// type of the val column, Nullable with nan_handling null
+func (c *ClickhouseClient) valType() string {
+	if c.NaNHandling == nanNull {
+		return "Nullable(Float64)"
+	}
+	return "Float64"
+}
@@ -0,0 +1,134 @@
+package clickhouse
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// note table as a metrics table managed by this plugin
+func (c *ClickhouseClient) manageTable(table string) {
+	c.managedMu.Lock()
+	c.managed[table] = true
+	c.managedMu.Unlock()
+}
+
+// metrics tables managed by this plugin: tablename unless each metric
+// selects a table of its own and the tables created for the measurements,
+// tablename templates and database_tag, in the order of their names
+func (c *ClickhouseClient) metricsTables() []string {
+	var tables []string
+	current := c.metricsTable()
+	if !c.tablesPerMetric() {
+		tables = append(tables, current)
+	}
+	var created []string
+	c.managedMu.Lock()
+	for table := range c.managed {
+		if table != current {
+			created = append(created, table)
+		}
+	}
+	c.managedMu.Unlock()
+	sort.Strings(created)
+	return append(tables, created...)
+}
+
+// tables managed by this plugin, the local tables storing the rows of
+// Distributed tables. Tables of database_tag are qualified with their
+// database.
+func (c *ClickhouseClient) managedTables() []string {
+	var tables []string
+	for _, table := range c.metricsTables() {
+		tables = append(tables, c.localTable(table))
+	}
+	if c.AggregateTable != "" {
+		tables = append(tables, c.localTable(c.AggregateTable))
+	}
+	return tables
+}
+
+// query the maximum number of active parts per partition of each managed
+// table, by its qualified name, and the server's parts_to_throw_insert
+// limit.
+func (c *ClickhouseClient) queryPartsPressure() (map[string]int, int, error) {
+	var limit int
+	if err := c.db.QueryRow(
+		"SELECT toUInt64(value) FROM system.merge_tree_settings WHERE name = 'parts_to_throw_insert'",
+		&limit,
+	); err != nil {
+		return nil, 0, err
+	}
+
+	tables := c.managedTables()
+	quoted := make([]string, 0, len(tables))
+	for _, table := range tables {
+		database, name := c.splitTable(table)
+		quoted = append(quoted, fmt.Sprintf("(%s, %s)", quoteString(database), quoteString(name)))
+	}
+
+	rows, err := c.db.Query(fmt.Sprintf(`
+	SELECT database, table, max(parts) FROM (
+		SELECT database, table, partition_id, count() AS parts
+		FROM system.parts
+		WHERE active AND (database, table) IN (%s)
+		GROUP BY database, table, partition_id
+	) GROUP BY database, table
+	`, strings.Join(quoted, ",")))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	parts := make(map[string]int)
+	for rows.Next() {
+		var database, table string
+		var count int
+		if err := rows.Scan(&database, &table, &count); err != nil {
+			return nil, 0, err
+		}
+		parts[database+"."+table] = count
+	}
+	return parts, limit, rows.Err()
+}
+
+// check the parts pressure of the managed tables and warn about tables
+// approaching parts_to_throw_insert.
+func (c *ClickhouseClient) checkPartsPressure() {
+	parts, limit, err := c.queryPartsPressure()
+	if err != nil {
+		log.Printf("E! [outputs.clickhouse] Unable to check parts pressure: %s", err.Error())
+		return
+	}
+
+	var pressure int32
+	for table, count := range parts {
+		if limit > 0 && float64(count) >= c.PartsWarnRatio*float64(limit) {
+			pressure = 1
+			log.Printf("W! [outputs.clickhouse] Table %s has %d active parts in a partition, parts_to_throw_insert is %d",
+				table, count, limit)
+		}
+	}
+	atomic.StoreInt32(&c.partsPressure, pressure)
+	c.health.partsPressure.Set(int64(pressure))
+}
+
+// check parts pressure every parts_check_interval until the plugin is closed.
+func (c *ClickhouseClient) runPartsCheck(interval time.Duration) {
+	defer c.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			c.checkPartsPressure()
+		}
+	}
+}
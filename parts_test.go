@@ -0,0 +1,146 @@
+package clickhouse
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/influxdata/telegraf/config"
+)
+
+func newPartsDatabase(parts int) *mockDatabase {
+	db := newMockDatabase()
+	db.results["parts_to_throw_insert"] = [][]interface{}{{300}}
+	db.results["system.parts"] = [][]interface{}{{"telegraf", "metrics", parts}}
+	return db
+}
+
+func TestCheckPartsPressureQuery(t *testing.T) {
+	db := newPartsDatabase(10)
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.AggregateTable = "metrics_5m"
+	})
+
+	c.checkPartsPressure()
+
+	queries := db.queriesContaining("system.parts")
+	if len(queries) != 1 {
+		t.Fatalf("expected 1 parts query, got %d", len(queries))
+	}
+	if want := "(database, table) IN (('telegraf', 'metrics'),('telegraf', 'metrics_5m'))"; !strings.Contains(queries[0], want) {
+		t.Errorf("expected the managed tables %s queried, got %s", want, queries[0])
+	}
+}
+
+func TestCheckPartsPressureUnderLimit(t *testing.T) {
+	// below parts_warn_ratio 0.8 of parts_to_throw_insert 300
+	db := newPartsDatabase(239)
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.PartsBackoff = true
+	})
+
+	c.checkPartsPressure()
+
+	if atomic.LoadInt32(&c.partsPressure) != 0 {
+		t.Error("expected no parts pressure")
+	}
+	if v := c.health.partsPressure.Get(); v != 0 {
+		t.Errorf("expected parts_pressure 0, got %d", v)
+	}
+	if err := c.Write(testBatch()); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if n := len(db.sentBatches("telegraf.metrics")); n != 1 {
+		t.Errorf("expected 1 batch, got %d", n)
+	}
+}
+
+func TestCheckPartsPressureOverLimit(t *testing.T) {
+	db := newPartsDatabase(240)
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.PartsBackoff = true
+	})
+
+	c.checkPartsPressure()
+
+	if atomic.LoadInt32(&c.partsPressure) != 1 {
+		t.Error("expected parts pressure")
+	}
+	if v := c.health.partsPressure.Get(); v != 1 {
+		t.Errorf("expected parts_pressure 1, got %d", v)
+	}
+
+	// the write is throttled, Telegraf keeps the metrics buffered
+	err := c.Write(testBatch())
+	if err == nil || !strings.Contains(err.Error(), "too many active parts") {
+		t.Fatalf("expected the write to back off, got %v", err)
+	}
+	if n := len(db.batches); n != 0 {
+		t.Errorf("expected no inserts while backing off, got %d", n)
+	}
+
+	// the merges caught up, the next check lifts the backoff
+	db.results["system.parts"] = [][]interface{}{{"telegraf", "metrics", 12}}
+	c.checkPartsPressure()
+
+	if v := c.health.partsPressure.Get(); v != 0 {
+		t.Errorf("expected parts_pressure 0, got %d", v)
+	}
+	if err := c.Write(testBatch()); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if n := len(db.sentBatches("telegraf.metrics")); n != 1 {
+		t.Errorf("expected 1 batch, got %d", n)
+	}
+}
+
+func TestCheckPartsPressureWithoutBackoff(t *testing.T) {
+	db := newPartsDatabase(290)
+	c := newTestClient(t, db, nil)
+
+	c.checkPartsPressure()
+
+	// only warned about, writes continue
+	if v := c.health.partsPressure.Get(); v != 1 {
+		t.Errorf("expected parts_pressure 1, got %d", v)
+	}
+	if err := c.Write(testBatch()); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if n := len(db.sentBatches("telegraf.metrics")); n != 1 {
+		t.Errorf("expected 1 batch, got %d", n)
+	}
+}
+
+func TestCheckPartsPressureWarnRatio(t *testing.T) {
+	db := newPartsDatabase(160)
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.PartsWarnRatio = 0.5
+	})
+
+	c.checkPartsPressure()
+
+	if atomic.LoadInt32(&c.partsPressure) != 1 {
+		t.Error("expected parts pressure at half of parts_to_throw_insert")
+	}
+}
+
+func TestRunPartsCheck(t *testing.T) {
+	db := newPartsDatabase(280)
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.PartsBackoff = true
+		c.PartsCheckInterval = config.Duration(10 * time.Millisecond)
+	})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&c.partsPressure) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the parts check to record parts pressure")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := c.Write(testBatch()); err == nil {
+		t.Error("expected the write to back off")
+	}
+}
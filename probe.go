@@ -0,0 +1,111 @@
+package clickhouse
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// dial timeout of a health check without dial_timeout, the driver's default
+const defaultProbeTimeout = 5 * time.Second
+
+var (
+	// cooldowns shared by the health checks of a client and its HTTP
+	// database, which only knows the DSN
+	hostCooldownsMu sync.RWMutex
+	hostCooldowns   = map[string]*hostCooldown{}
+
+	// connect to host within timeout, through proxy if not nil
+	probeHost = func(host string, proxy *url.URL, timeout time.Duration) error {
+		dialer := &net.Dialer{Timeout: timeout}
+		var conn net.Conn
+		var err error
+		if proxy != nil {
+			conn, err = dialProxy(dialer, proxy, host)
+		} else {
+			conn, err = dialer.Dial("tcp", host)
+		}
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+)
+
+// register the cooldown of the client for the DSN, the name it is
+// referenced by is left in cooldownName
+func (c *ClickhouseClient) registerCooldown() {
+	c.deregisterCooldown()
+	if c.cooldown == nil {
+		return
+	}
+	name := fmt.Sprintf("outputs.clickhouse.%p", c)
+	hostCooldownsMu.Lock()
+	hostCooldowns[name] = c.cooldown
+	hostCooldownsMu.Unlock()
+	c.cooldownName = name
+}
+
+func (c *ClickhouseClient) deregisterCooldown() {
+	if c.cooldownName == "" {
+		return
+	}
+	hostCooldownsMu.Lock()
+	delete(hostCooldowns, c.cooldownName)
+	hostCooldownsMu.Unlock()
+	c.cooldownName = ""
+}
+
+// cooldown registered under name, nil if unknown
+func lookupHostCooldown(name string) *hostCooldown {
+	hostCooldownsMu.RLock()
+	defer hostCooldownsMu.RUnlock()
+	return hostCooldowns[name]
+}
+
+// connect to every host, quarantining the unreachable ones and returning
+// the recovered ones to the rotation
+func (c *ClickhouseClient) checkHosts() {
+	timeout := time.Duration(c.DialTimeout)
+	if timeout <= 0 {
+		timeout = defaultProbeTimeout
+	}
+	var proxy *url.URL
+	if c.dialSettings != nil {
+		proxy = c.dialSettings.proxy
+	}
+
+	var wg sync.WaitGroup
+	for _, host := range c.hosts() {
+		wg.Add(1)
+		go func(host string) {
+			defer wg.Done()
+			if err := probeHost(host, proxy, timeout); err != nil {
+				c.cooldown.quarantine(host, err)
+			} else {
+				c.cooldown.recover(host)
+			}
+		}(host)
+	}
+	wg.Wait()
+}
+
+// check the hosts every interval until the plugin is closed
+func (c *ClickhouseClient) runHealthChecks(interval time.Duration) {
+	defer c.wg.Done()
+
+	c.checkHosts()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			c.checkHosts()
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package clickhouse
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+// rows to delete from the managed tables by tag value, e.g. of a
+// decommissioned host
+type purgeRule struct {
+	Tag    string   `toml:"tag"`
+	Values []string `toml:"values"`
+}
+
+func (r *purgeRule) init() error {
+	if r.Tag == "" || len(r.Values) == 0 {
+		return fmt.Errorf("purge rule needs a tag and at least one value")
+	}
+	return nil
+}
+
+// condition on the tag expression tag matching the rule
+func (r *purgeRule) condition(tag string) string {
+	values := make([]string, 0, len(r.Values))
+	for _, value := range r.Values {
+		values = append(values, quoteString(value))
+	}
+	return fmt.Sprintf("%s IN (%s)", tag, strings.Join(values, ", "))
+}
+
+// a table and the condition of the rows to purge from it
+type purgeTarget struct {
+	table string
+	where string
+}
+
+// tables to purge of rule, the managed metrics tables, samples before
+// the series they refer to
+func (c *ClickhouseClient) purgeTargets(r *purgeRule) []purgeTarget {
+	if c.TableLayout == layoutSeries {
+		return []purgeTarget{
+			{table: c.metricsTable(), where: fmt.Sprintf("series_id IN (SELECT series_id FROM %s.%s WHERE %s)", c.Database, c.SeriesTable, r.condition(c.tagExpr(r.Tag)))},
+			{table: c.SeriesTable, where: r.condition(c.tagExpr(r.Tag))},
+		}
+	}
+	var targets []purgeTarget
+	for _, table := range c.metricsTables() {
+		targets = append(targets, purgeTarget{table: table, where: r.condition(c.tagExpr(r.Tag))})
+	}
+	return targets
+}
+
+// DELETE statement of the rows of table matching where, a lightweight
+// delete if the server supports it and a mutation otherwise, on every
+// node of the cluster. Rows of Distributed tables are deleted from their
+// local tables.
+func (c *ClickhouseClient) deleteStatement(table string, where string) string {
+	table = c.localTable(table)
+	caps := c.capabilities()
+	switch {
+	case caps != nil && caps.version.atLeast(23, 3):
+		return fmt.Sprintf("DELETE FROM %s%s WHERE %s", c.qualifiedTable(table), c.onCluster(), where)
+	case caps != nil && caps.version.atLeast(22, 8):
+		return fmt.Sprintf("DELETE FROM %s%s WHERE %s SETTINGS allow_experimental_lightweight_delete=1", c.qualifiedTable(table), c.onCluster(), where)
+	}
+	return fmt.Sprintf("ALTER TABLE %s%s DELETE WHERE %s", c.qualifiedTable(table), c.onCluster(), where)
+}
+
+// delete the rows matching the purge rules from the managed tables,
+// reporting the progress per table.
+func (c *ClickhouseClient) purgeTags() {
+	if atomic.LoadInt32(&c.insertOnly) != 0 {
+		log.Printf("W! [outputs.clickhouse] Not purging, the user lacks DDL privileges")
+		return
+	}
+
+	var targets []purgeTarget
+	for _, rule := range c.Purge {
+		targets = append(targets, c.purgeTargets(rule)...)
+	}
+
+	for i, target := range targets {
+		var count uint64
+		if err := c.db.QueryRow(fmt.Sprintf("SELECT count() FROM %s WHERE %s", c.qualifiedTable(target.table), target.where), &count); err != nil {
+			log.Printf("E! [outputs.clickhouse] Unable to count rows to purge of %s: %s", c.qualifiedTable(target.table), err.Error())
+			continue
+		}
+		if count == 0 {
+			continue
+		}
+
+		stmt := c.deleteStatement(target.table, target.where)
+		if c.PurgeDryRun {
+			log.Printf("I! [outputs.clickhouse] Dry run, would purge %d rows of %s (%d/%d): %s", count, c.qualifiedTable(target.table), i+1, len(targets), stmt)
+			continue
+		}
+
+		if err := c.execDDL(c.qualifiedTable(target.table), stmt); err != nil {
+			continue
+		}
+		if atomic.LoadInt32(&c.insertOnly) != 0 {
+			// denied, as would be the remaining tables
+			return
+		}
+		log.Printf("I! [outputs.clickhouse] Purged %d rows of %s (%d/%d): %s", count, c.qualifiedTable(target.table), i+1, len(targets), stmt)
+	}
+}
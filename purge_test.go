@@ -0,0 +1,129 @@
+package clickhouse
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ClickHouse/clickhouse-go"
+)
+
+func TestPurgeTags(t *testing.T) {
+	db := newMockDatabase()
+	db.results["SELECT count()"] = [][]interface{}{{uint64(42)}}
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.Purge = []*purgeRule{{Tag: "host", Values: []string{"old-1", "o'ld-2"}}}
+	})
+
+	c.purgeTags()
+
+	expected := `DELETE FROM telegraf.metrics WHERE JSONExtractString(tags, 'host') IN ('old-1', 'o\'ld-2')`
+	if deletes := db.execsWithPrefix("DELETE FROM"); len(deletes) != 1 || deletes[0] != expected {
+		t.Errorf("expected %q, got %q", expected, deletes)
+	}
+}
+
+func TestPurgeTagsTablePerMeasurement(t *testing.T) {
+	db := newMockDatabase()
+	db.results["SELECT count()"] = [][]interface{}{{uint64(1)}}
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.TablePerMeasurement = true
+		c.Purge = []*purgeRule{{Tag: "host", Values: []string{"old-1"}}}
+	})
+	if err := c.Write(testBatch()); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	c.purgeTags()
+
+	deletes := db.execsWithPrefix("DELETE FROM")
+	if len(deletes) != 2 || !strings.HasPrefix(deletes[0], "DELETE FROM telegraf.cpu WHERE") ||
+		!strings.HasPrefix(deletes[1], "DELETE FROM telegraf.mem WHERE") {
+		t.Errorf("expected the tables of the measurements purged, got %q", deletes)
+	}
+}
+
+func TestPurgeTagsSeriesLayout(t *testing.T) {
+	db := newMockDatabase()
+	db.results["SELECT version()"] = [][]interface{}{{"22.8.1.1"}}
+	db.results["SELECT count()"] = [][]interface{}{{uint64(1)}}
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.TableLayout = layoutSeries
+		c.Purge = []*purgeRule{{Tag: "host", Values: []string{"old-1"}}}
+	})
+	if err := c.ensureCapabilities(); err != nil {
+		t.Fatal(err)
+	}
+
+	c.purgeTags()
+
+	deletes := db.execsWithPrefix("DELETE FROM")
+	if len(deletes) != 2 {
+		t.Fatalf("expected 2 DELETEs, got %q", deletes)
+	}
+	if !strings.HasPrefix(deletes[0], "DELETE FROM telegraf.metrics WHERE series_id IN (SELECT series_id FROM telegraf.series WHERE") ||
+		!strings.HasPrefix(deletes[1], "DELETE FROM telegraf.series WHERE") {
+		t.Errorf("expected samples purged before series, got %q", deletes)
+	}
+	for _, stmt := range deletes {
+		if !strings.HasSuffix(stmt, "SETTINGS allow_experimental_lightweight_delete=1") {
+			t.Errorf("expected experimental setting on 22.8, got %q", stmt)
+		}
+	}
+}
+
+func TestPurgeTagsDryRun(t *testing.T) {
+	db := newMockDatabase()
+	db.results["SELECT count()"] = [][]interface{}{{uint64(42)}}
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.Purge = []*purgeRule{{Tag: "host", Values: []string{"old-1"}}}
+		c.PurgeDryRun = true
+	})
+
+	c.purgeTags()
+
+	if deletes := db.execsWithPrefix("DELETE FROM"); len(deletes) != 0 {
+		t.Errorf("expected no DELETE in dry run, got %q", deletes)
+	}
+}
+
+func TestPurgeTagsOnCluster(t *testing.T) {
+	db := newMockDatabase()
+	db.results["SELECT count()"] = [][]interface{}{{uint64(42)}}
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.Cluster = "metrics"
+		c.Purge = []*purgeRule{{Tag: "host", Values: []string{"old-1"}}}
+	})
+	if err := c.ensureCapabilities(); err != nil {
+		t.Fatal(err)
+	}
+
+	c.purgeTags()
+
+	expected := "DELETE FROM telegraf.metrics ON CLUSTER `metrics` WHERE JSONExtractString(tags, 'host') IN ('old-1')"
+	if deletes := db.execsWithPrefix("DELETE FROM"); len(deletes) != 1 || deletes[0] != expected {
+		t.Errorf("expected %q, got %q", expected, deletes)
+	}
+}
+
+func TestPurgeTagsDenied(t *testing.T) {
+	db := newMockDatabase()
+	db.results["SELECT count()"] = [][]interface{}{{uint64(1)}}
+	db.execErrs["DELETE FROM"] = &clickhouse.Exception{Code: accessDenied, Message: "Not enough privileges"}
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.TableLayout = layoutSeries
+		c.Purge = []*purgeRule{{Tag: "host", Values: []string{"old-1"}}}
+	})
+	if err := c.ensureCapabilities(); err != nil {
+		t.Fatal(err)
+	}
+
+	c.purgeTags()
+
+	if deletes := db.execsWithPrefix("DELETE FROM"); len(deletes) != 1 {
+		t.Errorf("expected the purge to stop at the denied DELETE, got %q", deletes)
+	}
+	if atomic.LoadInt32(&c.insertOnly) == 0 {
+		t.Error("expected the denied DELETE to switch to insert-only")
+	}
+}
@@ -0,0 +1,52 @@
+package clickhouse
+
+import (
+	"log"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go"
+)
+
+// server error code of QUOTA_EXCEEDED
+const quotaExceeded = 201
+
+var (
+	// e.g. "Quota for user `telegraf` for 3600s has been exceeded: ...
+	// Interval will end at 2023-08-01 12:00:00."
+	quotaEndRe      = regexp.MustCompile(`Interval will end at (\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2})`)
+	quotaIntervalRe = regexp.MustCompile(`for (\d+)s? has been exceeded`)
+)
+
+// time at which an exceeded quota resets, false if err is not a
+// QUOTA_EXCEEDED error.
+func quotaReset(err error, now time.Time) (time.Time, bool) {
+	exception, ok := err.(*clickhouse.Exception)
+	if !ok || exception.Code != quotaExceeded {
+		return time.Time{}, false
+	}
+
+	if m := quotaEndRe.FindStringSubmatch(exception.Message); m != nil {
+		if end, err := time.ParseInLocation("2006-01-02 15:04:05", m[1], time.Local); err == nil && end.After(now) {
+			return end, true
+		}
+	}
+	if m := quotaIntervalRe.FindStringSubmatch(exception.Message); m != nil {
+		if seconds, err := strconv.Atoi(m[1]); err == nil {
+			return now.Add(time.Duration(seconds) * time.Second), true
+		}
+	}
+	return now.Add(time.Minute), true
+}
+
+// pause writes until the quota window resets if err is QUOTA_EXCEEDED.
+func (c *ClickhouseClient) checkQuota(err error) {
+	until, ok := quotaReset(err, time.Now())
+	if !ok {
+		return
+	}
+
+	c.quotaUntil = until
+	log.Printf("W! [outputs.clickhouse] Quota exceeded, pausing writes until %s", until.Format(time.RFC3339))
+}
@@ -0,0 +1,92 @@
+package clickhouse
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/influxdata/telegraf"
+)
+
+// a regex-based redaction of tag values and string fields
+type redactRule struct {
+	// tag and string field keys the rule applies to, "*" for all. Without
+	// any keys the rule applies to all tags and string fields.
+	Tags   []string `toml:"tags"`
+	Fields []string `toml:"fields"`
+
+	Pattern     string `toml:"pattern"`
+	Replacement string `toml:"replacement"`
+
+	re *regexp.Regexp
+}
+
+func (r *redactRule) init() error {
+	re, err := regexp.Compile(r.Pattern)
+	if err != nil {
+		return fmt.Errorf("invalid redact pattern %q: %s", r.Pattern, err.Error())
+	}
+	r.re = re
+	return nil
+}
+
+func matchesKey(keys []string, key string) bool {
+	for _, k := range keys {
+		if k == "*" || k == key {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *redactRule) appliesToTag(key string) bool {
+	return (len(r.Tags) == 0 && len(r.Fields) == 0) || matchesKey(r.Tags, key)
+}
+
+func (r *redactRule) appliesToField(key string) bool {
+	return (len(r.Tags) == 0 && len(r.Fields) == 0) || matchesKey(r.Fields, key)
+}
+
+// apply the redaction rules to the tags and string fields of metric,
+// returning a redacted copy if anything changed.
+func (c *ClickhouseClient) redact(metric telegraf.Metric) telegraf.Metric {
+	var redacted telegraf.Metric
+
+	for _, tag := range metric.TagList() {
+		value := tag.Value
+		for _, rule := range c.Redact {
+			if rule.appliesToTag(tag.Key) {
+				value = rule.re.ReplaceAllString(value, rule.Replacement)
+			}
+		}
+		if value != tag.Value {
+			if redacted == nil {
+				redacted = metric.Copy()
+			}
+			redacted.AddTag(tag.Key, value)
+		}
+	}
+
+	for _, field := range metric.FieldList() {
+		original, ok := field.Value.(string)
+		if !ok {
+			continue
+		}
+		value := original
+		for _, rule := range c.Redact {
+			if rule.appliesToField(field.Key) {
+				value = rule.re.ReplaceAllString(value, rule.Replacement)
+			}
+		}
+		if value != original {
+			if redacted == nil {
+				redacted = metric.Copy()
+			}
+			redacted.AddField(field.Key, value)
+		}
+	}
+
+	if redacted == nil {
+		return metric
+	}
+	return redacted
+}
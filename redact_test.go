@@ -0,0 +1,101 @@
+package clickhouse
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/influxdata/telegraf/metric"
+)
+
+func TestMatchesKey(t *testing.T) {
+	for _, test := range []struct {
+		keys     []string
+		key      string
+		expected bool
+	}{
+		{nil, "host", false},
+		{[]string{"host"}, "host", true},
+		{[]string{"host"}, "hostname", false},
+		{[]string{"user", "host"}, "host", true},
+		{[]string{"*"}, "anything", true},
+	} {
+		if matchesKey(test.keys, test.key) != test.expected {
+			t.Errorf("expected %q in %v to be %v", test.key, test.keys, test.expected)
+		}
+	}
+}
+
+func TestRedactScope(t *testing.T) {
+	c := newClickhouse()
+	c.Redact = []*redactRule{
+		{Tags: []string{"url"}, Pattern: `token=\w+`, Replacement: "token=xxx"},
+		{Fields: []string{"*"}, Pattern: `\d{4}-\d{4}`, Replacement: "####"},
+	}
+	for _, rule := range c.Redact {
+		if err := rule.init(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m := metric.New("http",
+		map[string]string{"url": "/a?token=s3cret", "path": "/b?token=s3cret"},
+		map[string]interface{}{"url": "/c?token=s3cret", "card": "1234-5678", "code": int64(12345678)},
+		time.Unix(1600000000, 0))
+	redacted := c.redact(m)
+
+	if v, _ := redacted.GetTag("url"); v != "/a?token=xxx" {
+		t.Errorf("expected the url tag redacted, got %q", v)
+	}
+	// the tag rule leaves other tags and fields of the same key alone
+	if v, _ := redacted.GetTag("path"); v != "/b?token=s3cret" {
+		t.Errorf("expected the path tag untouched, got %q", v)
+	}
+	if v, _ := redacted.GetField("url"); v != "/c?token=s3cret" {
+		t.Errorf("expected the url field untouched, got %q", v)
+	}
+	// the wildcard field rule applies to every string field only
+	if v, _ := redacted.GetField("card"); v != "####" {
+		t.Errorf("expected the card field redacted, got %q", v)
+	}
+	if v, _ := redacted.GetField("code"); v != int64(12345678) {
+		t.Errorf("expected the integer field untouched, got %v", v)
+	}
+	if v, _ := m.GetTag("url"); v != "/a?token=s3cret" {
+		t.Errorf("expected the original metric untouched, got %q", v)
+	}
+
+	clean := metric.New("http", map[string]string{"url": "/"}, map[string]interface{}{"card": "none"}, time.Unix(1600000000, 0))
+	if c.redact(clean) != clean {
+		t.Error("expected a metric without matches returned as is")
+	}
+}
+
+func TestRedactWithoutKeys(t *testing.T) {
+	rule := &redactRule{Pattern: `s3cret`, Replacement: "xxx"}
+	if err := rule.init(); err != nil {
+		t.Fatal(err)
+	}
+	if !rule.appliesToTag("any") || !rule.appliesToField("any") {
+		t.Error("expected a rule without keys to apply to all tags and fields")
+	}
+
+	rule.Tags = []string{"user"}
+	if rule.appliesToField("user") || rule.appliesToTag("host") || !rule.appliesToTag("user") {
+		t.Error("expected a rule with tag keys to apply to those tags only")
+	}
+}
+
+func TestRedactInvalidPattern(t *testing.T) {
+	rule := &redactRule{Pattern: `token=(\w+`}
+	if err := rule.init(); err == nil || !strings.Contains(err.Error(), "invalid redact pattern") {
+		t.Errorf("expected the pattern to be rejected, got %v", err)
+	}
+
+	c := newClickhouse()
+	c.Hosts = []string{"a:9000"}
+	c.Redact = []*redactRule{rule}
+	if err := c.Connect(); err == nil {
+		t.Error("expected Connect to reject the pattern")
+	}
+}
@@ -0,0 +1,73 @@
+package clickhouse
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+// a metric row the server refused to accept
+type rejectedRow struct {
+	ts     time.Time
+	metric string
+	err    string
+}
+
+// remember a rejected row if the sample limit of this flush allows it.
+func (c *ClickhouseClient) sampleRejected(samples []rejectedRow, metr clickhouseMetric, err error) []rejectedRow {
+	if !c.RejectedRows || len(samples) >= c.RejectedRowsSamples {
+		return samples
+	}
+
+	serialized, marshalErr := json.Marshal(metr)
+	if marshalErr != nil {
+		serialized = []byte(fmt.Sprintf("%+v", metr))
+	}
+
+	return append(samples, rejectedRow{
+		ts:     time.Now(),
+		metric: string(serialized),
+		err:    err.Error(),
+	})
+}
+
+// create the rejected rows table if it does not exist.
+func (c *ClickhouseClient) createRejectedTable() error {
+	stmt := fmt.Sprintf(`
+	CREATE TABLE IF NOT EXISTS %s.%s%s(
+		date Date DEFAULT toDate(ts),
+		ts DateTime,
+		host String,
+		metric String,
+		error String
+	) ENGINE=%s
+	`, c.Database, c.RejectedRowsTable, c.onCluster(), c.mergeTreeEngine("host,ts"))
+
+	return c.execDDL(fmt.Sprintf("%s.%s", c.Database, c.RejectedRowsTable), stmt)
+}
+
+// write samples of rejected rows into the rejected rows table. Failures
+// are only logged.
+func (c *ClickhouseClient) writeRejected(samples []rejectedRow) {
+	if len(samples) == 0 {
+		return
+	}
+
+	if !c.rejectedReady {
+		if err := c.createRejectedTable(); err != nil {
+			return
+		}
+		c.rejectedReady = true
+	}
+
+	rows := make([][]interface{}, 0, len(samples))
+	for _, sample := range samples {
+		rows = append(rows, []interface{}{sample.ts, c.hostname, sample.metric, sample.err})
+	}
+
+	if err := c.insertRows(c.RejectedRowsTable, []string{"ts", "host", "metric", "error"}, rows); err != nil {
+		c.rejectedReady = false
+		log.Printf("E! [outputs.clickhouse] Unable to write rejected rows: %s", err.Error())
+	}
+}
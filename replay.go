@@ -0,0 +1,262 @@
+package clickhouse
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/influxdata/telegraf/config"
+)
+
+// ReplayOptions configure the re-ingestion of spool files by Replay.
+type ReplayOptions struct {
+	Hosts    []string
+	Database string
+	User     string
+	Password string
+
+	// maximum rows inserted per second, unlimited when zero
+	RowsPerSecond float64
+	// rows per INSERT
+	BatchSize int
+	// keep the spool files after replaying them
+	Keep bool
+
+	// receives a line per inserted batch, if set
+	Progress io.Writer
+}
+
+// Replay inserts the rows of the spool files of the given manifests into
+// the tables they were spooled for. Files replayed completely are removed
+// unless opts.Keep is set, files replayed partly resume after the rows
+// recorded in their manifest.
+func Replay(opts ReplayOptions, manifests ...string) error {
+	c := newClickhouse()
+	c.Hosts = opts.Hosts
+	c.Database = opts.Database
+	c.User = config.NewSecret([]byte(opts.User))
+	c.Password = config.NewSecret([]byte(opts.Password))
+	if err := c.Connect(); err != nil {
+		return err
+	}
+	defer c.Close()
+
+	for i, path := range manifests {
+		if err := c.replaySpool(path, opts); err != nil {
+			return fmt.Errorf("replay %s: %s", path, err.Error())
+		}
+		if opts.Progress != nil {
+			fmt.Fprintf(opts.Progress, "%s: done (%d/%d files)\n", path, i+1, len(manifests))
+		}
+	}
+	return nil
+}
+
+// replay a single spool file through the insert path
+func (c *ClickhouseClient) replaySpool(path string, opts ReplayOptions) error {
+	manifest, err := readSpoolManifest(path)
+	if err != nil {
+		return err
+	}
+	data := filepath.Join(filepath.Dir(path), manifest.Data)
+	defer c.health.recordSpool(filepath.Dir(path))
+
+	f, err := os.Open(data)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = 10000
+	}
+
+	database := c.Database
+	c.Database = manifest.Database
+	defer func() { c.Database = database }()
+
+	// rows inserted by an interrupted replay are skipped
+	for i := 0; i < manifest.Replayed; i++ {
+		if _, err := decodeRowBinary(r, manifest.Types); err != nil {
+			return fmt.Errorf("row %d: %s", i+1, err.Error())
+		}
+	}
+	if manifest.Replayed > 0 && opts.Progress != nil {
+		fmt.Fprintf(opts.Progress, "%s: resuming after %d/%d rows\n", path, manifest.Replayed, manifest.Rows)
+	}
+
+	start := time.Now()
+	resumed := manifest.Replayed
+	replayed := resumed
+	for replayed < manifest.Rows {
+		var rows [][]interface{}
+		for len(rows) < batchSize && replayed+len(rows) < manifest.Rows {
+			row, err := decodeRowBinary(r, manifest.Types)
+			if err != nil {
+				return fmt.Errorf("row %d: %s", replayed+len(rows)+1, err.Error())
+			}
+			rows = append(rows, row)
+		}
+
+		if err := c.insertRows(manifest.Table, manifest.Columns, rows); err != nil {
+			return err
+		}
+		replayed += len(rows)
+		manifest.Replayed = replayed
+		if err := writeSpoolManifest(path, manifest); err != nil {
+			return err
+		}
+		if opts.Progress != nil {
+			fmt.Fprintf(opts.Progress, "%s: %d/%d rows into %s.%s\n", path, replayed, manifest.Rows, manifest.Database, manifest.Table)
+		}
+
+		if opts.RowsPerSecond > 0 {
+			due := time.Duration(float64(replayed-resumed) / opts.RowsPerSecond * float64(time.Second))
+			if wait := due - time.Since(start); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+	}
+
+	if opts.Keep {
+		return nil
+	}
+	if err := os.Remove(data); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+func readSpoolManifest(path string) (*spoolManifest, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var manifest spoolManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, err
+	}
+	if manifest.Format != spoolFormat {
+		return nil, fmt.Errorf("unsupported format %q", manifest.Format)
+	}
+	if len(manifest.Columns) != len(manifest.Types) {
+		return nil, fmt.Errorf("%d columns but %d types", len(manifest.Columns), len(manifest.Types))
+	}
+	return &manifest, nil
+}
+
+// decode a row of the given column types from RowBinary format, the
+// inverse of encodeRowBinary
+func decodeRowBinary(r *bufio.Reader, types []string) ([]interface{}, error) {
+	row := make([]interface{}, 0, len(types))
+	for _, typ := range types {
+		// dictionary encoding is transparent to RowBinary
+		typ, _ = unwrapType(typ, "LowCardinality")
+		// nullable values are preceded by whether they are NULL
+		if inner, ok := unwrapType(typ, "Nullable"); ok {
+			null, err := r.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			if null != 0 {
+				row = append(row, nil)
+				continue
+			}
+			typ = inner
+		}
+		v, err := decodeValue(r, typ)
+		if err != nil {
+			return nil, err
+		}
+		row = append(row, v)
+	}
+	return row, nil
+}
+
+// decode a single value of typ, as encoded by encodeRowBinary
+func decodeValue(r *bufio.Reader, typ string) (interface{}, error) {
+	var buf [16]byte
+	if precision, ok := dateTime64Precision(typ); ok {
+		if _, err := io.ReadFull(r, buf[:8]); err != nil {
+			return nil, err
+		}
+		ticks := int64(binary.LittleEndian.Uint64(buf[:8]))
+		return dateTime64{Time: time.Unix(0, ticks*int64(math.Pow10(9-precision))), precision: precision}, nil
+	}
+	// the timezone of DateTime columns only affects their text form
+	if _, ok := unwrapType(typ, "DateTime"); ok {
+		typ = "DateTime"
+	}
+	switch typ {
+	case "String":
+		n, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		s := make([]byte, n)
+		if _, err := io.ReadFull(r, s); err != nil {
+			return nil, err
+		}
+		return string(s), nil
+	case "Float64":
+		if _, err := io.ReadFull(r, buf[:8]); err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.LittleEndian.Uint64(buf[:8])), nil
+	case "Int64":
+		if _, err := io.ReadFull(r, buf[:8]); err != nil {
+			return nil, err
+		}
+		return int64(binary.LittleEndian.Uint64(buf[:8])), nil
+	case "UInt8":
+		// booleans of the wide layout, inserted as int64
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		return int64(b), nil
+	case "Bool":
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		return b != 0, nil
+	case "UInt32":
+		if _, err := io.ReadFull(r, buf[:4]); err != nil {
+			return nil, err
+		}
+		return binary.LittleEndian.Uint32(buf[:4]), nil
+	case "UInt64":
+		if _, err := io.ReadFull(r, buf[:8]); err != nil {
+			return nil, err
+		}
+		return binary.LittleEndian.Uint64(buf[:8]), nil
+	case "DateTime":
+		if _, err := io.ReadFull(r, buf[:4]); err != nil {
+			return nil, err
+		}
+		return time.Unix(int64(binary.LittleEndian.Uint32(buf[:4])), 0), nil
+	case "UUID":
+		if _, err := io.ReadFull(r, buf[:16]); err != nil {
+			return nil, err
+		}
+		var b [16]byte
+		for i := 0; i < 8; i++ {
+			b[i] = buf[7-i]
+			b[8+i] = buf[15-i]
+		}
+		h := hex.EncodeToString(b[:])
+		return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:32], nil
+	}
+	return nil, fmt.Errorf("cannot decode %s", typ)
+}
@@ -0,0 +1,163 @@
+package clickhouse
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// the TTL clause within system.tables.engine_full
+	engineTTLRe = regexp.MustCompile(`(?i)\sTTL\s+(.*?)(?:\s+SETTINGS\s|$)`)
+	// INTERVAL n UNIT, which the server formats as toIntervalUnit(n)
+	intervalRe = regexp.MustCompile(`(?i)interval\s*(\d+)\s*(second|minute|hour|day|week|month|quarter|year)s?`)
+)
+
+// normalize a TTL expression for comparing the configured one with the
+// one reported by the server.
+func normalizeTTL(ttl string) string {
+	ttl = intervalRe.ReplaceAllStringFunc(ttl, func(m string) string {
+		parts := intervalRe.FindStringSubmatch(m)
+		return fmt.Sprintf("tointerval%s(%s)", parts[2], parts[1])
+	})
+	return strings.ToLower(strings.Join(strings.Fields(ttl), ""))
+}
+
+// TTL expression currently set on a table, empty if none
+func (c *ClickhouseClient) tableTTL(table string) (string, error) {
+	database, name := c.splitTable(table)
+	var engineFull string
+	if err := c.db.QueryRow(fmt.Sprintf(
+		"SELECT engine_full FROM system.tables WHERE database = %s AND name = %s",
+		quoteString(database), quoteString(name),
+	), &engineFull); err != nil {
+		return "", err
+	}
+
+	if m := engineTTLRe.FindStringSubmatch(engineFull); m != nil {
+		return m[1], nil
+	}
+	return "", nil
+}
+
+// bring the TTL of table in line with the configured ttl.
+func (c *ClickhouseClient) syncTTL(table string, ttl string) error {
+	if ttl == "" || atomic.LoadInt32(&c.insertOnly) != 0 {
+		return nil
+	}
+	// the rows expire from the local tables
+	table = c.localTable(table)
+
+	current, err := c.tableTTL(table)
+	if err != nil {
+		return err
+	}
+	if normalizeTTL(current) == normalizeTTL(ttl) {
+		return nil
+	}
+
+	materialize := 0
+	if c.TTLMaterialize {
+		materialize = 1
+	}
+	stmt := fmt.Sprintf("ALTER TABLE %s%s MODIFY TTL %s SETTINGS materialize_ttl_after_modify=%d",
+		c.qualifiedTable(table), c.onCluster(), ttl, materialize)
+
+	if err := c.execDDL(c.qualifiedTable(table), stmt); err != nil {
+		return err
+	}
+
+	if !c.TTLMaterialize && c.ttlPending != nil {
+		c.ttlMu.Lock()
+		c.ttlPending[table] = true
+		c.ttlMu.Unlock()
+	}
+	return nil
+}
+
+// materialize the TTL of tables whose TTL changed, once the
+// ttl_materialize_window is open.
+func (c *ClickhouseClient) materializePendingTTL(now time.Time) {
+	if c.ttlWindow != nil && !c.ttlWindow.contains(now) {
+		return
+	}
+
+	c.ttlMu.Lock()
+	pending := make([]string, 0, len(c.ttlPending))
+	for table := range c.ttlPending {
+		pending = append(pending, table)
+	}
+	c.ttlMu.Unlock()
+
+	for _, table := range pending {
+		stmt := fmt.Sprintf("ALTER TABLE %s%s MATERIALIZE TTL", c.qualifiedTable(table), c.onCluster())
+		if err := c.execDDL(c.qualifiedTable(table), stmt); err != nil {
+			continue
+		}
+
+		c.ttlMu.Lock()
+		delete(c.ttlPending, table)
+		c.ttlMu.Unlock()
+	}
+}
+
+// a partition of a managed table
+type partition struct {
+	id      string
+	name    string
+	maxDate string
+}
+
+// partitions of table whose newest row is older than days, judged by the
+// date or time the partition key derives from. Partitions keyed by
+// neither are kept.
+func (c *ClickhouseClient) expiredPartitions(table string, days int) ([]partition, error) {
+	database, name := c.splitTable(table)
+	rows, err := c.db.Query(fmt.Sprintf(`
+	WITH greatest(max(max_date), toDate(max(max_time))) AS newest
+	SELECT partition_id, partition, toString(newest)
+	FROM system.parts
+	WHERE active AND database = %s AND table = %s
+	GROUP BY partition_id, partition
+	HAVING newest > toDate(0) AND newest < today() - %d
+	ORDER BY partition_id
+	`, quoteString(database), quoteString(name), days))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var partitions []partition
+	for rows.Next() {
+		var p partition
+		if err := rows.Scan(&p.id, &p.name, &p.maxDate); err != nil {
+			return nil, err
+		}
+		partitions = append(partitions, p)
+	}
+	return partitions, rows.Err()
+}
+
+// drop the partitions of all managed tables older than retention_days.
+func (c *ClickhouseClient) dropExpiredPartitions() {
+	for _, table := range c.managedTables() {
+		partitions, err := c.expiredPartitions(table, c.RetentionDays)
+		if err != nil {
+			log.Printf("E! [outputs.clickhouse] Unable to list partitions of %s: %s", c.qualifiedTable(table), err.Error())
+			continue
+		}
+
+		for _, p := range partitions {
+			stmt := fmt.Sprintf("ALTER TABLE %s%s DROP PARTITION ID %s", c.qualifiedTable(table), c.onCluster(), quoteString(p.id))
+			if c.RetentionDryRun {
+				log.Printf("I! [outputs.clickhouse] Dry run, would drop partition %s (newest row %s): %s", p.name, p.maxDate, stmt)
+				continue
+			}
+			// failures are logged by the audit
+			c.execDDL(c.qualifiedTable(table), stmt)
+		}
+	}
+}
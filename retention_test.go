@@ -0,0 +1,196 @@
+package clickhouse
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go"
+)
+
+func TestExpiredPartitionsQuery(t *testing.T) {
+	db := newMockDatabase()
+	c := newTestClient(t, db, nil)
+
+	db.results["FROM system.parts"] = [][]interface{}{{"202001", "202001", "2020-01-31"}}
+	partitions, err := c.expiredPartitions("metrics", 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(partitions) != 1 || partitions[0].id != "202001" || partitions[0].maxDate != "2020-01-31" {
+		t.Errorf("unexpected partitions %v", partitions)
+	}
+
+	queries := db.queriesContaining("FROM system.parts")
+	if len(queries) != 1 {
+		t.Fatalf("expected 1 query of the parts, got %q", queries)
+	}
+	query := strings.Join(strings.Fields(queries[0]), " ")
+	// newest must be the Date compared in HAVING, not its string
+	for _, expected := range []string{
+		"greatest(max(max_date), toDate(max(max_time))) AS newest",
+		"SELECT partition_id, partition, toString(newest)",
+		"database = 'telegraf' AND table = 'metrics'",
+		"HAVING newest > toDate(0) AND newest < today() - 30",
+	} {
+		if !strings.Contains(query, expected) {
+			t.Errorf("expected %q in %s", expected, query)
+		}
+	}
+	if strings.Contains(query, "toString(greatest") {
+		t.Errorf("expected the alias on the Date expression, got %s", query)
+	}
+}
+
+func TestNormalizeTTL(t *testing.T) {
+	for _, test := range []struct {
+		configured string
+		server     string
+		same       bool
+	}{
+		{"ts + INTERVAL 30 DAY", "ts + toIntervalDay(30)", true},
+		{"ts + interval 1 week", "ts + toIntervalWeek(1)", true},
+		{"ts + INTERVAL 12 HOURS", "ts + toIntervalHour(12)", true},
+		{"ts + INTERVAL 30 DAY", "ts + toIntervalDay(31)", false},
+		{"date + INTERVAL 30 DAY", "ts + toIntervalDay(30)", false},
+	} {
+		if same := normalizeTTL(test.configured) == normalizeTTL(test.server); same != test.same {
+			t.Errorf("expected %q and %q to compare %v", test.configured, test.server, test.same)
+		}
+	}
+}
+
+func TestSyncTTLUnchanged(t *testing.T) {
+	db := newMockDatabase()
+	db.results["SELECT engine_full"] = [][]interface{}{{"MergeTree PARTITION BY toYYYYMM(date) ORDER BY (name, tags, ts) TTL ts + toIntervalDay(30) SETTINGS index_granularity = 8192"}}
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.TTL = "ts + INTERVAL 30 DAY"
+	})
+
+	for i := 0; i < 2; i++ {
+		c.schemaReady = false
+		if err := c.Write(testBatch()); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	if alters := db.execsWithPrefix("ALTER TABLE"); len(alters) != 0 {
+		t.Errorf("expected no ALTER of an unchanged TTL, got %q", alters)
+	}
+}
+
+func TestSyncTTLChangedOnCluster(t *testing.T) {
+	db := newMockDatabase()
+	db.results["SELECT engine_full"] = [][]interface{}{{"MergeTree PARTITION BY toYYYYMM(date) ORDER BY (name, tags, ts) TTL ts + toIntervalDay(7) SETTINGS index_granularity = 8192"}}
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.TTL = "ts + INTERVAL 30 DAY"
+		c.Distributed = true
+		c.Cluster = "main"
+		c.ShardingKey = "rand()"
+	})
+
+	if err := c.Write(testBatch()); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if queries := db.queriesContaining("SELECT engine_full"); len(queries) != 1 || !strings.Contains(queries[0], "name = 'metrics"+c.LocalTableSuffix+"'") {
+		t.Errorf("expected the TTL of the local table queried, got %q", queries)
+	}
+	stmt := "ALTER TABLE telegraf.metrics" + c.LocalTableSuffix + " ON CLUSTER `main` MODIFY TTL ts + INTERVAL 30 DAY SETTINGS materialize_ttl_after_modify=0"
+	if alters := db.execsWithPrefix("ALTER TABLE"); len(alters) != 1 || alters[0] != stmt {
+		t.Errorf("expected %q, got %q", stmt, alters)
+	}
+}
+
+func TestMaterializePendingTTL(t *testing.T) {
+	db := newMockDatabase()
+	db.results["SELECT engine_full"] = [][]interface{}{{"MergeTree PARTITION BY toYYYYMM(date) ORDER BY (name, tags, ts) TTL ts + toIntervalDay(7) SETTINGS index_granularity = 8192"}}
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.TTL = "ts + INTERVAL 30 DAY"
+		c.TTLMaterializeWindow = "02:00-04:00"
+	})
+
+	if err := c.Write(testBatch()); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if alters := db.execsWithPrefix("ALTER TABLE telegraf.metrics MODIFY TTL"); len(alters) != 1 || !strings.HasSuffix(alters[0], "materialize_ttl_after_modify=0") {
+		t.Fatalf("expected the TTL modified without materializing, got %q", alters)
+	}
+
+	day := time.Date(2020, 9, 13, 0, 0, 0, 0, time.Local)
+	c.materializePendingTTL(day.Add(12 * time.Hour))
+	if n := len(db.execsWithPrefix("ALTER TABLE telegraf.metrics MATERIALIZE TTL")); n != 0 {
+		t.Errorf("expected no MATERIALIZE TTL outside the window, got %d", n)
+	}
+
+	c.materializePendingTTL(day.Add(3 * time.Hour))
+	c.materializePendingTTL(day.Add(3*time.Hour + time.Minute))
+	if n := len(db.execsWithPrefix("ALTER TABLE telegraf.metrics MATERIALIZE TTL")); n != 1 {
+		t.Errorf("expected 1 MATERIALIZE TTL within the window, got %d", n)
+	}
+}
+
+func TestDropExpiredPartitions(t *testing.T) {
+	db := newMockDatabase()
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.RetentionDays = 30
+		c.Cluster = "main"
+	})
+	if err := c.Write(testBatch()); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	db.results["FROM system.parts"] = [][]interface{}{
+		{"202001", "202001", "2020-01-31"},
+		{"202002", "202002", "2020-02-29"},
+	}
+
+	c.RetentionDryRun = true
+	c.dropExpiredPartitions()
+	if drops := db.execsWithPrefix("ALTER TABLE"); len(drops) != 0 {
+		t.Errorf("expected no drops in a dry run, got %q", drops)
+	}
+
+	c.RetentionDryRun = false
+	c.dropExpiredPartitions()
+	drops := db.execsWithPrefix("ALTER TABLE")
+	expected := []string{
+		"ALTER TABLE telegraf.metrics ON CLUSTER `main` DROP PARTITION ID '202001'",
+		"ALTER TABLE telegraf.metrics ON CLUSTER `main` DROP PARTITION ID '202002'",
+	}
+	if strings.Join(drops, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected %q, got %q", expected, drops)
+	}
+	// partitions are judged by the Date of their newest row
+	for _, query := range db.queriesContaining("FROM system.parts") {
+		if !strings.Contains(query, "greatest(max(max_date), toDate(max(max_time))) AS newest") || !strings.Contains(query, "newest < today() - 30") {
+			t.Errorf("expected the expired partitions selected by date, got %s", query)
+		}
+	}
+}
+
+func TestDropExpiredPartitionsDenied(t *testing.T) {
+	db := newMockDatabase()
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.RetentionDays = 30
+	})
+	if err := c.Write(testBatch()); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	db.results["FROM system.parts"] = [][]interface{}{
+		{"202001", "202001", "2020-01-31"},
+		{"202002", "202002", "2020-02-29"},
+	}
+	db.execErrs["ALTER TABLE"] = &clickhouse.Exception{Code: accessDenied, Message: "Not enough privileges"}
+
+	c.dropExpiredPartitions()
+	if drops := db.execsWithPrefix("ALTER TABLE"); len(drops) != 1 {
+		t.Errorf("expected the drops to stop at the denied one, got %q", drops)
+	}
+	if atomic.LoadInt32(&c.insertOnly) == 0 {
+		t.Error("expected the plugin to continue insert-only")
+	}
+
+	c.dropExpiredPartitions()
+	if drops := db.execsWithPrefix("ALTER TABLE"); len(drops) != 1 {
+		t.Errorf("expected no drops once insert-only, got %q", drops)
+	}
+}
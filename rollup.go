@@ -0,0 +1,86 @@
+package clickhouse
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/influxdata/telegraf/config"
+)
+
+// a table of the min, max, sum, count and avg of each series per
+// interval, filled by a materialized view over the metrics table
+type rollup struct {
+	Table    string          `toml:"table"`
+	Interval config.Duration `toml:"interval"`
+	TTL      string          `toml:"ttl"`
+}
+
+func (r *rollup) init() error {
+	interval := time.Duration(r.Interval)
+	if r.Table == "" || interval < time.Second {
+		return fmt.Errorf("rollup %q needs a table and an interval of at least a second", r.Table)
+	}
+	if interval%time.Second != 0 {
+		return fmt.Errorf("interval of rollup %q must be whole seconds", r.Table)
+	}
+	return nil
+}
+
+// the stored tags columns grouped by, whose values the view copies
+func (c *ClickhouseClient) rollupTagColumns() []columnDef {
+	var columns []columnDef
+	for _, col := range c.tagsColumnDefs() {
+		if !col.ephemeral {
+			columns = append(columns, columnDef{name: col.name, typ: col.typ})
+		}
+	}
+	return columns
+}
+
+// create the table of r and the materialized view aggregating the rows
+// inserted into the metrics table into it. Rows of an interval inserted
+// by several flushes are merged in the background, readers combine them
+// with min(min), max(max), sum(sum), sum(count) and avgMerge(avg).
+func (c *ClickhouseClient) createRollup(r *rollup) error {
+	if caps := c.capabilities(); caps != nil && !caps.modernSyntax {
+		return fmt.Errorf("rollup %s needs ClickHouse 1.1.54310 or later, connected to %s", r.Table, caps.version)
+	}
+
+	tags := c.rollupTagColumns()
+	key := []string{"name"}
+	for _, col := range tags {
+		key = append(key, col.name)
+	}
+	columns := []columnDef{
+		{name: "date", typ: "Date", defaultExpr: "toDate(ts)"},
+		{name: "name", typ: c.stringType()},
+	}
+	columns = append(columns, tags...)
+	columns = append(columns, []columnDef{
+		{name: "ts", typ: c.dateTimeType()},
+		{name: "min", typ: "SimpleAggregateFunction(min, Float64)"},
+		{name: "max", typ: "SimpleAggregateFunction(max, Float64)"},
+		{name: "sum", typ: "SimpleAggregateFunction(sum, Float64)"},
+		{name: "count", typ: "SimpleAggregateFunction(sum, UInt64)"},
+		{name: "avg", typ: "AggregateFunction(avg, Float64)"},
+	}...)
+	engine := fmt.Sprintf("%s PARTITION BY toYYYYMM(date) ORDER BY (%s,ts)", c.engineFamily("AggregatingMergeTree"), strings.Join(key, ","))
+	if r.TTL != "" {
+		engine += " TTL " + r.TTL
+	}
+	if err := c.createShardedTable(r.Table, columns, engine+" SETTINGS index_granularity=8192"); err != nil {
+		return err
+	}
+
+	// the view of each node aggregates the rows inserted there
+	target := c.localTable(r.Table)
+	view := target + "_mv"
+	group := strings.Join(key, ",")
+	stmt := fmt.Sprintf("CREATE MATERIALIZED VIEW IF NOT EXISTS %s.%s%s TO %s.%s AS SELECT %s, "+
+		"toStartOfInterval(m.ts, INTERVAL %d SECOND) AS ts, min(val) AS min, max(val) AS max, sum(val) AS sum, "+
+		"count() AS count, avgState(val) AS avg FROM %s.%s AS m WHERE isFinite(val) GROUP BY %s, ts",
+		c.Database, view, c.onCluster(), c.Database, target, group,
+		int64(time.Duration(r.Interval)/time.Second), c.Database, c.localTable(c.metricsTable()), group)
+	return c.execDDL(fmt.Sprintf("%s.%s", c.Database, view), stmt)
+}
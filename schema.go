@@ -0,0 +1,335 @@
+package clickhouse
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	layoutNarrow   = "narrow"
+	layoutSeries   = "series"
+	layoutWide     = "wide"
+	layoutGraphite = "graphite"
+)
+
+// create the database (if enabled) and tables if they do not exist.
+func (c *ClickhouseClient) createSchema() error {
+	if caps := c.capabilities(); c.TagsFormat == tagsJSONType && caps != nil && !caps.jsonType {
+		return fmt.Errorf("tags_format json_type needs ClickHouse 25.3 or later, connected to %s", caps.version)
+	}
+	if caps := c.capabilities(); c.TagsFormat == tagsMap && caps != nil && !caps.mapType {
+		return fmt.Errorf("tags_format map needs the Map type of ClickHouse 21.8 or later, connected to %s", caps.version)
+	}
+	if caps := c.capabilities(); c.tagsEphemeral() && caps != nil && !caps.version.atLeast(22, 4) {
+		return fmt.Errorf("tags_format %s needs ClickHouse 22.4 or later, connected to %s", c.TagsFormat, caps.version)
+	}
+	if caps := c.capabilities(); timestampPrecisions[c.TimestampPrecision] > 0 && caps != nil && !caps.dateTime64 {
+		return fmt.Errorf("timestamp_precision %s needs ClickHouse 20.1 or later, connected to %s", c.TimestampPrecision, caps.version)
+	}
+
+	// create database, unless it is managed elsewhere
+	if c.CreateDatabase {
+		stmtCreateDatabase := fmt.Sprintf("CREATE DATABASE IF NOT EXISTS %s%s", c.Database, c.onCluster())
+		if err := c.execDDL(c.Database, stmtCreateDatabase); err != nil {
+			return err
+		}
+	}
+
+	// the tables of the measurements are created as they show up
+	c.createdTables = make(map[string]bool)
+	c.createdDatabases = make(map[string]bool)
+	if !c.tablesPerMetric() {
+		// every connection resolves the table starting from tablename
+		c.setMetricsTable(c.TableName)
+		if err := c.createMetricsTable(c.TableName); err != nil {
+			return err
+		}
+
+		if c.SchemaFallback {
+			if err := c.fallbackOnIncompatibleSchema(c.createMetricsTable); err != nil {
+				return err
+			}
+		} else if err := c.checkSchema(c.TableName); err != nil {
+			return err
+		}
+
+		table := c.metricsTable()
+		if err := c.syncTTL(table, c.TTL); err != nil {
+			return err
+		}
+		c.createdTables[table] = true
+	}
+
+	for _, r := range c.Rollup {
+		if err := c.createRollup(r); err != nil {
+			return err
+		}
+		if err := c.syncTTL(r.Table, r.TTL); err != nil {
+			return err
+		}
+	}
+
+	if c.AggregateTable != "" {
+		if err := c.createAggregateTable(); err != nil {
+			return err
+		}
+		return c.syncTTL(c.AggregateTable, c.AggregateTTL)
+	}
+	return nil
+}
+
+// a column of a generated table
+type columnDef struct {
+	name         string
+	typ          string
+	defaultExpr  string
+	materialized string
+	// only inserted to compute other columns, never stored
+	ephemeral bool
+	comment   string
+}
+
+// column definition including its default and codec
+func (c *ClickhouseClient) columnDDL(col columnDef) string {
+	ddl := col.name + " " + col.typ
+	if col.ephemeral {
+		ddl += " EPHEMERAL"
+	} else if col.defaultExpr != "" {
+		ddl += " DEFAULT " + col.defaultExpr
+	} else if col.materialized != "" {
+		ddl += " MATERIALIZED " + col.materialized
+	}
+	if col.comment != "" {
+		ddl += " COMMENT " + quoteString(col.comment)
+	}
+	if codec := c.columnCodec(col.name); codec != "" {
+		ddl += " CODEC(" + codec + ")"
+	}
+	return ddl
+}
+
+// codec of a metrics column by column_codecs, followed by the encryption
+// codec if encrypted, empty for the server default
+func (c *ClickhouseClient) columnCodec(column string) string {
+	codec := c.ColumnCodecs[column]
+	if matchesKey(c.EncryptColumns, column) {
+		if codec != "" {
+			return codec + ", " + c.EncryptionCodec
+		}
+		return c.EncryptionCodec
+	}
+	return codec
+}
+
+// create table with columns and engine if it does not exist, with the
+// statement of the create_table_template if configured.
+func (c *ClickhouseClient) createTable(table string, columns []columnDef, engine string) error {
+	defs := make([]string, 0, len(columns))
+	for _, col := range columns {
+		defs = append(defs, c.columnDDL(col))
+	}
+
+	stmt := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s%s(\n\t\t%s\n\t) ENGINE=%s",
+		c.qualifiedTable(table), c.onCluster(), strings.Join(defs, ",\n\t\t"), engine)
+	if c.createTemplate != nil {
+		var buf strings.Builder
+		database, name := c.splitTable(table)
+		data := createTableData{
+			Database:  database,
+			Table:     name,
+			OnCluster: c.onCluster(),
+			Columns:   strings.Join(defs, ",\n\t\t"),
+			Engine:    engine,
+		}
+		if err := c.createTemplate.Execute(&buf, data); err != nil {
+			return fmt.Errorf("create_table_template of %s: %s", c.qualifiedTable(table), err.Error())
+		}
+		stmt = buf.String()
+	}
+
+	return c.execDDL(c.qualifiedTable(table), stmt)
+}
+
+// create the metrics table of the configured layout, then learn the
+// columns of the table as it exists if they vary
+func (c *ClickhouseClient) createMetricsTable(table string) error {
+	if c.TableLayout == layoutWide || c.TagsAsColumns {
+		if err := c.seedColumnNames(table); err != nil {
+			return err
+		}
+	}
+
+	var err error
+	switch c.TableLayout {
+	case layoutSeries:
+		err = c.createSeriesTables(table)
+	case layoutWide:
+		err = c.createWideTable(table)
+	case layoutGraphite:
+		err = c.createGraphiteTable(table)
+	default:
+		err = c.createNarrowTable(table)
+	}
+	if err == nil {
+		err = c.createBufferTable(table)
+	}
+	if err != nil || (c.TableLayout != layoutWide && !c.TagsAsColumns) {
+		return err
+	}
+
+	existing, err := c.tableColumns(table)
+	if err != nil {
+		return err
+	}
+	c.knownColumns[table] = existing
+	return nil
+}
+
+// seed the namer with the columns of the fields and tags of table as it
+// exists, so they keep their columns whatever order they show up in
+func (c *ClickhouseClient) seedColumnNames(table string) error {
+	database, name := c.splitTable(table)
+	rows, err := c.db.Query(fmt.Sprintf(
+		"SELECT name, comment FROM system.columns WHERE database = %s AND table = %s AND comment != ''",
+		quoteString(database), quoteString(name),
+	))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var column, comment string
+		if err := rows.Scan(&column, &comment); err != nil {
+			return err
+		}
+		c.fieldNamer.seed(comment, column)
+	}
+	return rows.Err()
+}
+
+// add col to table unless it has the column already
+func (c *ClickhouseClient) addColumn(table string, col columnDef) error {
+	if _, ok := c.knownColumns[table][col.name]; ok {
+		return nil
+	}
+	if err := c.alterShardedTable(table, col); err != nil {
+		return err
+	}
+	if err := c.alterBufferTable(table, col); err != nil {
+		return err
+	}
+	if atomic.LoadInt32(&c.insertOnly) != 0 {
+		// the statement was skipped
+		return nil
+	}
+	if c.knownColumns[table] == nil {
+		c.knownColumns[table] = make(map[string]string)
+	}
+	c.knownColumns[table][col.name] = col.typ
+	return nil
+}
+
+// create the table of the narrow layout, one row per field.
+func (c *ClickhouseClient) createNarrowTable(table string) error {
+	return c.createShardedTable(table, c.metricsTableColumns(), c.metricsEngine(c.metricsSortKey()))
+}
+
+// columns of the metrics table of the configured layout
+func (c *ClickhouseClient) metricsTableColumns() []columnDef {
+	var columns []columnDef
+	switch c.TableLayout {
+	case layoutSeries:
+		columns = []columnDef{
+			{name: "date", typ: "Date", defaultExpr: "toDate(ts)"},
+			{name: "series_id", typ: "UInt64"},
+			{name: "val", typ: "Float64"},
+			{name: "ts", typ: c.timestampType()},
+		}
+		return append(columns, c.extraColumnDefs()...)
+	case layoutGraphite:
+		columns = []columnDef{
+			{name: "Path", typ: "String"},
+			{name: "Value", typ: "Float64"},
+			{name: "Time", typ: "UInt32"},
+			{name: "Date", typ: "Date", defaultExpr: "toDate(toDateTime(Time))"},
+			{name: "Timestamp", typ: "UInt32"},
+		}
+		return append(columns, c.extraColumnDefs()...)
+	case layoutWide:
+		// the field columns come and go with the fields written
+		columns = []columnDef{
+			{name: "date", typ: "Date", defaultExpr: "toDate(ts)"},
+			{name: "name", typ: c.stringType()},
+		}
+		columns = append(columns, c.tagsColumnDefs()...)
+		columns = append(columns, []columnDef{
+			{name: "ts", typ: c.timestampType()},
+			{name: "updated", typ: c.dateTimeType(), defaultExpr: "now()"},
+		}...)
+		columns = append(columns, c.extraColumnDefs()...)
+		return append(columns, c.dictionaryColumnDefs()...)
+	default:
+		columns = []columnDef{
+			{name: "date", typ: "Date", defaultExpr: "toDate(ts)"},
+			{name: "name", typ: c.stringType()},
+		}
+		columns = append(columns, c.tagsColumnDefs()...)
+		columns = append(columns, columnDef{name: "val", typ: c.valType()})
+		if c.ValStr {
+			columns = append(columns, columnDef{name: "val_str", typ: "String"})
+		}
+		columns = append(columns, []columnDef{
+			{name: "ts", typ: c.timestampType()},
+			{name: "updated", typ: c.dateTimeType(), defaultExpr: "now()"},
+		}...)
+		columns = append(columns, c.extraColumnDefs()...)
+		return append(columns, c.dictionaryColumnDefs()...)
+	}
+}
+
+// rows of the narrow layout
+func (c *ClickhouseClient) narrowRows(batchMetrics []clickhouseMetrics) ([]string, []insertRow) {
+	var rows []insertRow
+	for _, metrs := range batchMetrics {
+		for _, metr := range metrs {
+			tags, _ := json.Marshal(metr.Tags)
+			if c.Debug {
+				log.Println(
+					"Name:", metr.Name,
+					"Tags:", string(tags),
+					"Val:", metr.Val,
+					"Ts:", metr.Ts,
+				)
+			}
+			row := insertRow{
+				metric: metr,
+				values: []interface{}{metr.Name, string(tags), c.valValue(metr.Val), c.timestampValue(metr.Ts)},
+				// name + tags + val(Float64) + ts
+				size: len(metr.Name) + len(tags) + 8 + c.timestampSize(),
+			}
+			if c.ValStr {
+				row.values = append(row.values, metr.ValStr)
+				row.size += len(metr.ValStr)
+			}
+			rows = append(rows, row)
+		}
+	}
+	if c.ValStr {
+		return []string{"name", c.tagsInsertColumn(), "val", "ts", "val_str"}, rows
+	}
+	return []string{"name", c.tagsInsertColumn(), "val", "ts"}, rows
+}
+
+// quote s as a ClickHouse string literal
+func quoteString(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
+
+// quote s as a ClickHouse identifier
+func quoteIdentifier(s string) string {
+	return "`" + strings.NewReplacer(`\`, `\\`, "`", "\\`").Replace(s) + "`"
+}
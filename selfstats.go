@@ -0,0 +1,70 @@
+package clickhouse
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// create the self-monitoring table if it does not exist.
+func (c *ClickhouseClient) createSelfStatsTable() error {
+	stmt := fmt.Sprintf(`
+	CREATE TABLE IF NOT EXISTS %s.%s%s(
+		date Date DEFAULT toDate(ts),
+		ts DateTime,
+		host String,
+		tables String,
+		batch_size UInt64,
+		rows UInt64,
+		failed UInt64,
+		spooled UInt64,
+		spool_rows UInt64,
+		bytes UInt64,
+		retries UInt64,
+		duration_ms UInt64,
+		error String
+	) ENGINE=%s
+	`, c.Database, c.SelfStatsTable, c.onCluster(), c.mergeTreeEngine("host,ts"))
+
+	return c.execDDL(fmt.Sprintf("%s.%s", c.Database, c.SelfStatsTable), stmt)
+}
+
+// write the statistics of a flush into the self-monitoring table, with the
+// rows queued in the spool awaiting replay. Failures are only logged, the
+// stats must never fail the flush itself.
+func (c *ClickhouseClient) writeSelfStats(stats *writeStats, batchSize int, flushErr error) {
+	if !c.selfStatsReady {
+		if err := c.createSelfStatsTable(); err != nil {
+			return
+		}
+		c.selfStatsReady = true
+	}
+
+	var errMsg string
+	if flushErr != nil {
+		errMsg = flushErr.Error()
+	}
+
+	err := c.insertRows(c.SelfStatsTable,
+		[]string{"ts", "host", "tables", "batch_size", "rows", "failed", "spooled", "spool_rows", "bytes", "retries", "duration_ms", "error"},
+		[][]interface{}{{
+			time.Now(),
+			c.hostname,
+			strings.Join(stats.tableList(), ","),
+			uint64(batchSize),
+			uint64(stats.rows),
+			uint64(stats.failed),
+			uint64(stats.spooled),
+			uint64(c.health.spoolRows.Get()),
+			uint64(stats.bytes),
+			uint64(stats.retries),
+			uint64(time.Since(stats.start) / time.Millisecond),
+			errMsg,
+		}},
+	)
+	if err != nil {
+		c.selfStatsReady = false
+		log.Printf("E! [outputs.clickhouse] Unable to write self-monitoring stats: %s", err.Error())
+	}
+}
@@ -0,0 +1,168 @@
+package clickhouse
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+var selfStatsColumns = []string{"ts", "host", "tables", "batch_size", "rows", "failed", "spooled", "spool_rows", "bytes", "retries", "duration_ms", "error"}
+
+// the last row written into the stats table by its columns
+func lastSelfStats(t *testing.T, db *mockDatabase) map[string]interface{} {
+	t.Helper()
+
+	batches := db.sentBatches("telegraf.telegraf_writer_stats")
+	if len(batches) == 0 {
+		t.Fatal("expected the stats written")
+	}
+	b := batches[len(batches)-1]
+	if want := "INSERT INTO telegraf.telegraf_writer_stats(" + strings.Join(selfStatsColumns, ",") + ")"; !strings.HasPrefix(b.query, want) {
+		t.Fatalf("expected %q, got %q", want, b.query)
+	}
+	if len(b.rows) != 1 {
+		t.Fatalf("expected 1 stats row per flush, got %d", len(b.rows))
+	}
+	row := make(map[string]interface{}, len(selfStatsColumns))
+	for i, column := range selfStatsColumns {
+		row[column] = b.rows[0][i]
+	}
+	return row
+}
+
+func TestSelfStatsTable(t *testing.T) {
+	db := newMockDatabase()
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.SelfStats = true
+		c.Cluster = "main"
+	})
+
+	for i := 0; i < 2; i++ {
+		if err := c.Write(testBatch()); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+
+	creates := db.execsWithPrefix("CREATE TABLE IF NOT EXISTS telegraf.telegraf_writer_stats")
+	if len(creates) != 1 {
+		t.Fatalf("expected the stats table created once, got %d", len(creates))
+	}
+	stmt := strings.Join(strings.Fields(creates[0]), " ")
+	expected := "CREATE TABLE IF NOT EXISTS telegraf.telegraf_writer_stats ON CLUSTER `main`( " +
+		"date Date DEFAULT toDate(ts), ts DateTime, host String, tables String, " +
+		"batch_size UInt64, rows UInt64, failed UInt64, spooled UInt64, spool_rows UInt64, " +
+		"bytes UInt64, retries UInt64, duration_ms UInt64, error String ) " +
+		"ENGINE=MergeTree PARTITION BY toYYYYMM(date) ORDER BY (host,ts)"
+	if !strings.HasPrefix(stmt, expected) {
+		t.Errorf("expected %q, got %q", expected, stmt)
+	}
+	if n := len(db.sentBatches("telegraf.telegraf_writer_stats")); n != 2 {
+		t.Errorf("expected a stats row per flush, got %d", n)
+	}
+}
+
+func TestSelfStatsCounters(t *testing.T) {
+	db := newMockDatabase()
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.SelfStats = true
+	})
+
+	if err := c.Write(testBatch()); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	row := lastSelfStats(t, db)
+	expected := map[string]interface{}{
+		"host":       c.hostname,
+		"tables":     "telegraf.metrics",
+		"batch_size": uint64(2),
+		"rows":       uint64(3),
+		"failed":     uint64(0),
+		"spooled":    uint64(0),
+		"spool_rows": uint64(0),
+		"retries":    uint64(0),
+		"error":      "",
+	}
+	for column, want := range expected {
+		if row[column] != want {
+			t.Errorf("expected %s %v, got %v", column, want, row[column])
+		}
+	}
+	if row["bytes"].(uint64) == 0 {
+		t.Error("expected the written bytes counted")
+	}
+}
+
+func TestSelfStatsCountsFailedRows(t *testing.T) {
+	db := newMockDatabase()
+	db.appendErr = func(values []interface{}) error {
+		if values[0] == "mem_used" {
+			return errors.New("bad value")
+		}
+		return nil
+	}
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.SelfStats = true
+	})
+
+	if err := c.Write(testBatch()); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	row := lastSelfStats(t, db)
+	if row["rows"] != uint64(2) || row["failed"] != uint64(1) {
+		t.Errorf("expected 2 rows and 1 failed, got %v and %v", row["rows"], row["failed"])
+	}
+}
+
+func TestSelfStatsCountsRetries(t *testing.T) {
+	db := newMockDatabase()
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.SelfStats = true
+	})
+
+	db.sendErrs = []error{errors.New("connection reset by peer")}
+	if err := c.Write(testBatch()); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	row := lastSelfStats(t, db)
+	if row["retries"] != uint64(1) || row["rows"] != uint64(3) {
+		t.Errorf("expected 1 retry and the rows counted once, got %v and %v", row["retries"], row["rows"])
+	}
+}
+
+func TestSelfStatsCountsSpooledRows(t *testing.T) {
+	db := newMockDatabase()
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.SpoolDir = t.TempDir()
+		c.SelfStats = true
+		c.FailoverRetries = 0
+	})
+
+	// the insert and the stats of its flush fail, the next flush writes
+	// its own stats with the spooled rows still pending
+	db.sendErrs = []error{errors.New("code: 241, message: Memory limit exceeded"), errors.New("code: 241, message: Memory limit exceeded")}
+	if err := c.Write(testBatch()); err != nil {
+		t.Fatalf("expected spooled write to succeed, got %v", err)
+	}
+	if n := len(db.sentBatches("telegraf.telegraf_writer_stats")); n != 0 {
+		t.Fatalf("expected the stats of the failed flush lost, got %d", n)
+	}
+
+	db.sendErrs = []error{errors.New("code: 241, message: Memory limit exceeded")}
+	if err := c.Write(testBatch()); err != nil {
+		t.Fatalf("expected spooled write to succeed, got %v", err)
+	}
+
+	row := lastSelfStats(t, db)
+	if row["spooled"] != uint64(3) || row["rows"] != uint64(0) {
+		t.Errorf("expected 3 spooled and no written rows, got %v and %v", row["spooled"], row["rows"])
+	}
+	if row["spool_rows"] != uint64(6) {
+		t.Errorf("expected 6 rows pending in the spool, got %v", row["spool_rows"])
+	}
+	if row["error"] != "" {
+		t.Errorf("expected the spooled flush to succeed, got %v", row["error"])
+	}
+}
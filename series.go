@@ -0,0 +1,94 @@
+package clickhouse
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"log"
+	"time"
+)
+
+// identifier of a unique (name, tags) combination
+func seriesID(name string, tags []byte) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	h.Write([]byte{0})
+	h.Write(tags)
+	return h.Sum64()
+}
+
+// create the series and samples tables of the series layout.
+func (c *ClickhouseClient) createSeriesTables(table string) error {
+	// the tags and their dictionary lookups live in the series table
+	series := []columnDef{
+		{name: "date", typ: "Date", defaultExpr: "toDate(updated)"},
+		{name: "series_id", typ: "UInt64"},
+		{name: "name", typ: c.stringType()},
+	}
+	series = append(series, c.tagsColumnDefs()...)
+	series = append(series, columnDef{name: "updated", typ: c.dateTimeType(), defaultExpr: "now()"})
+	series = append(series, c.dictionaryColumnDefs()...)
+	if err := c.createTable(c.SeriesTable, series, c.replacingMergeTreeEngine("series_id", "updated")); err != nil {
+		return err
+	}
+
+	return c.createTable(table, c.metricsTableColumns(), c.metricsEngine("series_id,ts"))
+}
+
+// write the series of the batch not yet written by this process. The
+// series table deduplicates rows written by other agents or before a
+// restart on merge.
+func (c *ClickhouseClient) writeNewSeries(batchMetrics []clickhouseMetrics) error {
+	if c.knownSeries == nil {
+		c.knownSeries = make(map[uint64]struct{})
+	}
+
+	var rows [][]interface{}
+	added := make(map[uint64]struct{})
+	now := time.Now()
+	for _, metrs := range batchMetrics {
+		for _, metr := range metrs {
+			tags, _ := json.Marshal(metr.Tags)
+			id := seriesID(metr.Name, tags)
+			if _, ok := c.knownSeries[id]; ok {
+				continue
+			}
+			if _, ok := added[id]; ok {
+				continue
+			}
+			added[id] = struct{}{}
+			rows = append(rows, []interface{}{id, metr.Name, string(tags), now})
+		}
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+
+	if c.Debug {
+		log.Println("New Series:", len(rows))
+	}
+	if err := c.insertRows(c.SeriesTable, []string{"series_id", "name", c.tagsInsertColumn(), "updated"}, rows); err != nil {
+		return err
+	}
+
+	for id := range added {
+		c.knownSeries[id] = struct{}{}
+	}
+	return nil
+}
+
+// rows of the samples table of the series layout
+func (c *ClickhouseClient) seriesSampleRows(batchMetrics []clickhouseMetrics) ([]string, []insertRow) {
+	var rows []insertRow
+	for _, metrs := range batchMetrics {
+		for _, metr := range metrs {
+			tags, _ := json.Marshal(metr.Tags)
+			rows = append(rows, insertRow{
+				metric: metr,
+				values: []interface{}{seriesID(metr.Name, tags), metr.Val, c.timestampValue(metr.Ts)},
+				// series_id(UInt64) + val(Float64) + ts
+				size: 8 + 8 + c.timestampSize(),
+			})
+		}
+	}
+	return []string{"series_id", "val", "ts"}, rows
+}
@@ -0,0 +1,242 @@
+package clickhouse
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// a ClickHouse server version such as 23.8.2.7
+type serverVersion []int
+
+// parse the leading numeric components of a version, ignoring suffixes of
+// vendor builds such as 23.8.16.41.altinitystable or 22.3.1.1-lts
+func parseServerVersion(s string) (serverVersion, error) {
+	var v serverVersion
+	for _, part := range strings.Split(strings.TrimSpace(s), ".") {
+		digits := part
+		if i := strings.IndexFunc(part, func(r rune) bool { return r < '0' || r > '9' }); i >= 0 {
+			digits = part[:i]
+		}
+		if digits == "" {
+			break
+		}
+		n, err := strconv.Atoi(digits)
+		if err != nil {
+			return nil, fmt.Errorf("invalid server version %q", s)
+		}
+		v = append(v, n)
+		if digits != part {
+			break
+		}
+	}
+	if len(v) == 0 {
+		return nil, fmt.Errorf("invalid server version %q", s)
+	}
+	return v, nil
+}
+
+// report whether v is at least the version given by parts
+func (v serverVersion) atLeast(parts ...int) bool {
+	for i, want := range parts {
+		var have int
+		if i < len(v) {
+			have = v[i]
+		}
+		if have != want {
+			return have > want
+		}
+	}
+	return true
+}
+
+func (v serverVersion) String() string {
+	parts := make([]string, 0, len(v))
+	for _, n := range v {
+		parts = append(parts, strconv.Itoa(n))
+	}
+	return strings.Join(parts, ".")
+}
+
+// features of the connected server the plugin adapts to
+type serverCapabilities struct {
+	version serverVersion
+
+	// PARTITION BY/ORDER BY engine clauses instead of MergeTree(date,...)
+	modernSyntax bool
+	mapType      bool
+	dateTime64   bool
+	jsonType     bool
+	asyncInsert  bool
+}
+
+// query the server version and settings and derive the supported features.
+func (c *ClickhouseClient) detectCapabilities() (*serverCapabilities, error) {
+	var version string
+	if err := c.db.QueryRow("SELECT version()", &version); err != nil {
+		return nil, err
+	}
+
+	v, err := parseServerVersion(version)
+	if err != nil {
+		return nil, err
+	}
+
+	caps := &serverCapabilities{
+		version:      v,
+		modernSyntax: v.atLeast(1, 1, 54310),
+		mapType:      v.atLeast(21, 8),
+		dateTime64:   v.atLeast(20, 1),
+		jsonType:     v.atLeast(25, 3),
+	}
+
+	rows, err := c.db.Query("SELECT name, value FROM system.settings WHERE name IN ('async_insert', 'allow_experimental_map_type')")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name, value string
+		if err := rows.Scan(&name, &value); err != nil {
+			return nil, err
+		}
+		switch name {
+		case "async_insert":
+			caps.asyncInsert = true
+		case "allow_experimental_map_type":
+			caps.mapType = caps.mapType || value == "1"
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return caps, nil
+}
+
+// detect the server capabilities once per connection.
+func (c *ClickhouseClient) ensureCapabilities() error {
+	if c.capabilities() != nil {
+		return nil
+	}
+
+	caps, err := c.detectCapabilities()
+	if err != nil {
+		return err
+	}
+
+	c.capsMu.Lock()
+	c.caps = caps
+	c.capsMu.Unlock()
+
+	log.Printf("I! [outputs.clickhouse] Connected to ClickHouse %s: %s", caps.version, caps)
+	if c.AsyncInsert && !caps.asyncInsert {
+		log.Printf("W! [outputs.clickhouse] ClickHouse %s does not support async_insert, inserting synchronously", caps.version)
+	}
+	return nil
+}
+
+// capabilities of the connected server or nil if not yet detected
+func (c *ClickhouseClient) capabilities() *serverCapabilities {
+	c.capsMu.Lock()
+	defer c.capsMu.Unlock()
+	return c.caps
+}
+
+func (caps *serverCapabilities) String() string {
+	feature := func(name string, enabled bool) string {
+		if enabled {
+			return name + "=enabled"
+		}
+		return name + "=disabled"
+	}
+
+	return strings.Join([]string{
+		feature("modern_ddl_syntax", caps.modernSyntax),
+		feature("map_type", caps.mapType),
+		feature("datetime64", caps.dateTime64),
+		feature("json_type", caps.jsonType),
+		feature("async_insert", caps.asyncInsert),
+	}, " ")
+}
+
+// MergeTree engine clause partitioned by month of date, matching the
+// layout of the legacy MergeTree(date,(...),8192) syntax.
+func (c *ClickhouseClient) mergeTreeEngine(orderBy string) string {
+	if caps := c.capabilities(); caps != nil && !caps.modernSyntax {
+		return c.engineFamily("MergeTree", "date", "("+orderBy+")", "8192")
+	}
+	return fmt.Sprintf("%s PARTITION BY toYYYYMM(date) ORDER BY (%s) SETTINGS index_granularity=8192",
+		c.engineFamily("MergeTree"), orderBy)
+}
+
+// engine clause of the tables of the metrics: the configured engine,
+// given partition_by, the sorting key and the ttl of the MergeTree
+// family, or a MergeTree by default.
+func (c *ClickhouseClient) metricsEngine(orderBy string) string {
+	engine := c.Engine
+	switch {
+	case engine == "":
+		if caps := c.capabilities(); caps != nil && !caps.modernSyntax {
+			return c.mergeTreeEngine(orderBy)
+		}
+		engine = c.engineFamily("MergeTree")
+	case !isMergeTree(engine):
+		return engine
+	case !strings.HasPrefix(engine, "Replicated") && !strings.HasPrefix(engine, "Shared"):
+		name, params := strings.TrimSpace(engine), ""
+		if i := strings.IndexByte(name, '('); i >= 0 {
+			name, params = strings.TrimSpace(name[:i]), strings.TrimSuffix(name[i+1:], ")")
+		}
+		if params == "" {
+			engine = c.engineFamily(name)
+		} else {
+			engine = c.engineFamily(name, params)
+		}
+	}
+
+	clause := fmt.Sprintf("%s PARTITION BY %s ORDER BY (%s)", engine, c.PartitionBy, orderBy)
+	if c.TTL != "" {
+		clause += " TTL " + c.TTL
+	}
+	return clause + " SETTINGS index_granularity=8192"
+}
+
+// whether engine, with or without its parameters, is of the MergeTree
+// family
+func isMergeTree(engine string) bool {
+	if i := strings.IndexByte(engine, '('); i >= 0 {
+		engine = engine[:i]
+	}
+	return strings.HasSuffix(strings.TrimSpace(engine), "MergeTree")
+}
+
+// ReplacingMergeTree engine clause keeping the row with the highest
+// version per sorting key.
+func (c *ClickhouseClient) replacingMergeTreeEngine(orderBy string, version string) string {
+	if caps := c.capabilities(); caps != nil && !caps.modernSyntax {
+		return c.engineFamily("ReplacingMergeTree", "date", "("+orderBy+")", "8192", version)
+	}
+	return fmt.Sprintf("%s PARTITION BY toYYYYMM(date) ORDER BY (%s) SETTINGS index_granularity=8192",
+		c.engineFamily("ReplacingMergeTree", version), orderBy)
+}
+
+// a MergeTree family engine with its parameters. The Replicated variant
+// comes first with replica_path and replica_name, else the SharedMergeTree
+// variant of ClickHouse Cloud if configured. Without it Cloud converts
+// MergeTree engines to their shared variant by itself.
+func (c *ClickhouseClient) engineFamily(engine string, params ...string) string {
+	switch {
+	case c.Replicated:
+		engine = "Replicated" + engine
+		params = append([]string{quoteString(c.ReplicaPath), quoteString(c.ReplicaName)}, params...)
+	case c.SharedMergeTree:
+		engine = "Shared" + engine
+	}
+	if len(params) == 0 {
+		return engine
+	}
+	return engine + "(" + strings.Join(params, ",") + ")"
+}
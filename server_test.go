@@ -0,0 +1,141 @@
+package clickhouse
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseServerVersion(t *testing.T) {
+	for _, test := range []struct {
+		version  string
+		expected serverVersion
+	}{
+		{"23.8.2.7", serverVersion{23, 8, 2, 7}},
+		{" 24.3.1.2672\n", serverVersion{24, 3, 1, 2672}},
+		{"23.8.16.41.altinitystable", serverVersion{23, 8, 16, 41}},
+		{"22.3.1.1-lts", serverVersion{22, 3, 1, 1}},
+		{"24.1.2.3+build", serverVersion{24, 1, 2, 3}},
+		{"21.8-stable", serverVersion{21, 8}},
+	} {
+		v, err := parseServerVersion(test.version)
+		if err != nil || !reflect.DeepEqual(v, test.expected) {
+			t.Errorf("expected %q to parse as %v, got %v, %v", test.version, test.expected, v, err)
+		}
+	}
+
+	for _, version := range []string{"", "unknown", "v23.8"} {
+		if v, err := parseServerVersion(version); err == nil {
+			t.Errorf("expected %q to be rejected, got %v", version, v)
+		}
+	}
+}
+
+func TestWriteVendorServerVersion(t *testing.T) {
+	db := newMockDatabase()
+	db.results["SELECT version()"] = [][]interface{}{{"23.8.16.41.altinitystable"}}
+	c := newTestClient(t, db, nil)
+
+	if err := c.Write(testBatch()); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if caps := c.capabilities(); caps == nil || !caps.version.atLeast(23, 8, 16, 41) {
+		t.Errorf("expected the capabilities of 23.8.16.41, got %v", caps)
+	}
+}
+
+func TestEngineFamily(t *testing.T) {
+	for _, test := range []struct {
+		replicated, shared bool
+		params             []string
+		expected           string
+	}{
+		{false, false, nil, "MergeTree"},
+		{false, false, []string{"version"}, "ReplacingMergeTree(version)"},
+		{true, false, nil, "ReplicatedMergeTree('/clickhouse/tables/{shard}/{database}/{table}','{replica}')"},
+		{true, false, []string{"version"}, "ReplicatedReplacingMergeTree('/clickhouse/tables/{shard}/{database}/{table}','{replica}',version)"},
+		{false, true, nil, "SharedMergeTree"},
+		{false, true, []string{"version"}, "SharedReplacingMergeTree(version)"},
+		// the Replicated variant takes precedence
+		{true, true, nil, "ReplicatedMergeTree('/clickhouse/tables/{shard}/{database}/{table}','{replica}')"},
+		{true, true, []string{"version"}, "ReplicatedReplacingMergeTree('/clickhouse/tables/{shard}/{database}/{table}','{replica}',version)"},
+	} {
+		c := newClickhouse()
+		c.Replicated = test.replicated
+		c.SharedMergeTree = test.shared
+
+		engine := "MergeTree"
+		if len(test.params) > 0 {
+			engine = "ReplacingMergeTree"
+		}
+		if got := c.engineFamily(engine, test.params...); got != test.expected {
+			t.Errorf("replicated=%v shared=%v: expected %q, got %q", test.replicated, test.shared, test.expected, got)
+		}
+	}
+}
+
+func TestMetricsEngine(t *testing.T) {
+	for _, test := range []struct {
+		engine             string
+		replicated, shared bool
+		expected           string
+	}{
+		{"", false, false,
+			"MergeTree PARTITION BY toYYYYMM(date) ORDER BY (name,ts) SETTINGS index_granularity=8192"},
+		{"", true, false,
+			"ReplicatedMergeTree('/clickhouse/tables/{shard}/{database}/{table}','{replica}') PARTITION BY toYYYYMM(date) ORDER BY (name,ts) SETTINGS index_granularity=8192"},
+		{"", false, true,
+			"SharedMergeTree PARTITION BY toYYYYMM(date) ORDER BY (name,ts) SETTINGS index_granularity=8192"},
+		{"ReplacingMergeTree(updated)", false, false,
+			"ReplacingMergeTree(updated) PARTITION BY toYYYYMM(date) ORDER BY (name,ts) SETTINGS index_granularity=8192"},
+		{"ReplacingMergeTree(updated)", true, false,
+			"ReplicatedReplacingMergeTree('/clickhouse/tables/{shard}/{database}/{table}','{replica}',updated) PARTITION BY toYYYYMM(date) ORDER BY (name,ts) SETTINGS index_granularity=8192"},
+		{"ReplacingMergeTree(updated)", false, true,
+			"SharedReplacingMergeTree(updated) PARTITION BY toYYYYMM(date) ORDER BY (name,ts) SETTINGS index_granularity=8192"},
+		{"ReplacingMergeTree()", false, true,
+			"SharedReplacingMergeTree PARTITION BY toYYYYMM(date) ORDER BY (name,ts) SETTINGS index_granularity=8192"},
+		// configured variants are kept as they are
+		{"ReplicatedMergeTree('/tables/metrics','{replica}')", false, true,
+			"ReplicatedMergeTree('/tables/metrics','{replica}') PARTITION BY toYYYYMM(date) ORDER BY (name,ts) SETTINGS index_granularity=8192"},
+		{"SharedMergeTree", true, false,
+			"SharedMergeTree PARTITION BY toYYYYMM(date) ORDER BY (name,ts) SETTINGS index_granularity=8192"},
+		// engines outside the MergeTree family verbatim
+		{"Memory", true, false, "Memory"},
+	} {
+		c := newClickhouse()
+		c.Engine = test.engine
+		c.Replicated = test.replicated
+		c.SharedMergeTree = test.shared
+		if got := c.metricsEngine("name,ts"); got != test.expected {
+			t.Errorf("engine %q replicated=%v shared=%v: expected %q, got %q",
+				test.engine, test.replicated, test.shared, test.expected, got)
+		}
+	}
+}
+
+func TestMetricsEngineLegacySyntax(t *testing.T) {
+	c := newClickhouse()
+	c.caps = &serverCapabilities{version: serverVersion{1, 1, 54300}}
+
+	if got, expected := c.metricsEngine("name,ts"), "MergeTree(date,(name,ts),8192)"; got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+
+	c.Replicated = true
+	expected := "ReplicatedMergeTree('/clickhouse/tables/{shard}/{database}/{table}','{replica}',date,(name,ts),8192)"
+	if got := c.metricsEngine("name,ts"); got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
+
+func TestConnectRejectsReplicatedSharedMergeTree(t *testing.T) {
+	c := newClickhouse()
+	c.Hosts = []string{"127.0.0.1:9000"}
+	c.Replicated = true
+	c.SharedMergeTree = true
+	c.openDatabase = func(string, string) (database, error) { return newMockDatabase(), nil }
+
+	if err := c.Connect(); err == nil {
+		c.Close()
+		t.Fatal("expected replicated and shared_merge_tree rejected")
+	}
+}
@@ -0,0 +1,127 @@
+package clickhouse
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+)
+
+// a size-capped, rotating newline-delimited JSON copy of every batch
+// inserted into the metrics table
+type shadowWriter struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+func newShadowWriter(path string, maxSize int64, maxBackups int) *shadowWriter {
+	return &shadowWriter{path: path, maxSize: maxSize, maxBackups: maxBackups}
+}
+
+// append rows of columns as one JSON object per line
+func (s *shadowWriter) write(columns []string, rows []insertRow) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var buf []byte
+	for _, row := range rows {
+		obj := make(map[string]interface{}, len(columns))
+		for i, column := range columns {
+			obj[column] = row.values[i]
+		}
+		line, err := json.Marshal(obj)
+		if err != nil {
+			// e.g. NaN values, which the insert may still accept
+			line, _ = json.Marshal(map[string]string{"error": err.Error()})
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+
+	if s.f == nil {
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+	if s.maxSize > 0 && s.size > 0 && s.size+int64(len(buf)) > s.maxSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	w := bufio.NewWriter(s.f)
+	n, err := w.Write(buf)
+	s.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func (s *shadowWriter) open() error {
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.f, s.size = f, info.Size()
+	return nil
+}
+
+// shift path.N to path.N+1, dropping the oldest, and start a new file
+func (s *shadowWriter) rotate() error {
+	if err := s.f.Close(); err != nil {
+		return err
+	}
+	s.f = nil
+
+	if s.maxBackups <= 0 {
+		if err := os.Remove(s.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return s.open()
+	}
+
+	os.Remove(fmt.Sprintf("%s.%d", s.path, s.maxBackups))
+	for i := s.maxBackups - 1; i > 0; i-- {
+		if err := os.Rename(fmt.Sprintf("%s.%d", s.path, i), fmt.Sprintf("%s.%d", s.path, i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(s.path, s.path+".1"); err != nil {
+		return err
+	}
+	return s.open()
+}
+
+func (s *shadowWriter) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+	return err
+}
+
+// copy a batch to the shadow file, failures do not fail the insert
+func (c *ClickhouseClient) writeShadow(columns []string, rows []insertRow) {
+	if c.shadow == nil {
+		return
+	}
+	if err := c.shadow.write(columns, rows); err != nil {
+		log.Printf("E! [outputs.clickhouse] Unable to write shadow file %s: %s", c.ShadowFile, err.Error())
+	}
+}
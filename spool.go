@@ -0,0 +1,295 @@
+package clickhouse
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// format of the spool files, readable by INSERT ... FORMAT RowBinary
+const spoolFormat = "RowBinary"
+
+// description of a spool file, written next to it once it is complete
+type spoolManifest struct {
+	Created  time.Time `json:"created"`
+	Database string    `json:"database"`
+	Table    string    `json:"table"`
+	Columns  []string  `json:"columns"`
+	Types    []string  `json:"types"`
+	Format   string    `json:"format"`
+	Rows     int       `json:"rows"`
+	Data     string    `json:"data"`
+	// rows inserted by a replay so far, skipped when it is resumed
+	Replayed int `json:"replayed,omitempty"`
+	// command replaying the file with clickhouse-client
+	Replay string `json:"replay"`
+}
+
+// number of spool files in dir with rows not replayed yet, and the number
+// of those rows
+func spoolDepth(dir string) (int, int, error) {
+	manifests, err := filepath.Glob(filepath.Join(dir, "*.manifest.json"))
+	if err != nil {
+		return 0, 0, err
+	}
+	files, rows := 0, 0
+	for _, path := range manifests {
+		manifest, err := readSpoolManifest(path)
+		if err != nil {
+			// removed by a concurrent replay
+			if os.IsNotExist(err) {
+				continue
+			}
+			return 0, 0, err
+		}
+		if pending := manifest.Rows - manifest.Replayed; pending > 0 {
+			files++
+			rows += pending
+		}
+	}
+	return files, rows, nil
+}
+
+// manifest file of a spooled data file
+func manifestPath(data string) string {
+	return strings.TrimSuffix(data, filepath.Ext(data)) + ".manifest.json"
+}
+
+// types of the columns inserted into table, as the server has them where
+// the columns of the table are known, e.g. the field columns of the wide
+// layout and the tag columns of tags_as_columns, else as defs create them
+func (c *ClickhouseClient) columnTypes(table string, defs []columnDef, columns []string) ([]string, error) {
+	types := make(map[string]string)
+	for _, col := range defs {
+		types[col.name] = col.typ
+	}
+	for name, typ := range c.knownColumns[table] {
+		types[name] = typ
+	}
+	columnTypes := make([]string, 0, len(columns))
+	for _, column := range columns {
+		typ, ok := types[column]
+		if !ok {
+			return nil, fmt.Errorf("unknown type of column %s", column)
+		}
+		columnTypes = append(columnTypes, typ)
+	}
+	return columnTypes, nil
+}
+
+// write rows of a failed insert into table, whose columns defs creates,
+// to the spool directory.
+func (c *ClickhouseClient) spool(table string, defs []columnDef, columns []string, rows []insertRow) (string, error) {
+	columnTypes, err := c.columnTypes(table, defs, columns)
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(c.SpoolDir, 0750); err != nil {
+		return "", err
+	}
+	name := fmt.Sprintf("%d-%s", time.Now().UnixNano(), table)
+	data := filepath.Join(c.SpoolDir, name+".rowbinary")
+
+	if err := writeFileAtomic(data, func(w io.Writer) error {
+		for _, row := range rows {
+			if err := encodeRowBinary(w, columnTypes, row.values); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return "", err
+	}
+
+	database, name := c.splitTable(table)
+	query := fmt.Sprintf("INSERT INTO %s.%s(%s) FORMAT %s", database, name, strings.Join(columns, ","), spoolFormat)
+	manifest := &spoolManifest{
+		Created:  time.Now().UTC(),
+		Database: database,
+		Table:    name,
+		Columns:  columns,
+		Types:    columnTypes,
+		Format:   spoolFormat,
+		Rows:     len(rows),
+		Data:     filepath.Base(data),
+		Replay:   fmt.Sprintf("clickhouse-client --query %q < %s", query, filepath.Base(data)),
+	}
+	if err := writeSpoolManifest(manifestPath(data), manifest); err != nil {
+		os.Remove(data)
+		return "", err
+	}
+	return data, nil
+}
+
+func writeSpoolManifest(path string, manifest *spoolManifest) error {
+	return writeFileAtomic(path, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(manifest)
+	})
+}
+
+// write path through a temporary file renamed into place once complete
+func writeFileAtomic(path string, write func(w io.Writer) error) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), ".spool-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	w := bufio.NewWriter(f)
+	if err := write(w); err != nil {
+		f.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// encode a row of values of the given column types in RowBinary format
+func encodeRowBinary(w io.Writer, types []string, values []interface{}) error {
+	var buf [binary.MaxVarintLen64]byte
+	for i, typ := range types {
+		// dictionary encoding is transparent to RowBinary
+		typ, _ = unwrapType(typ, "LowCardinality")
+		// nullable values are preceded by whether they are NULL
+		if inner, ok := unwrapType(typ, "Nullable"); ok {
+			typ = inner
+			null := values[i] == nil
+			buf[0] = 0
+			if null {
+				buf[0] = 1
+			}
+			if _, err := w.Write(buf[:1]); err != nil {
+				return err
+			}
+			if null {
+				continue
+			}
+		}
+		var err error
+		switch v := values[i].(type) {
+		case string:
+			switch typ {
+			case "String":
+				n := binary.PutUvarint(buf[:], uint64(len(v)))
+				if _, err = w.Write(buf[:n]); err == nil {
+					_, err = io.WriteString(w, v)
+				}
+			case "UUID":
+				err = writeUUID(w, v)
+			default:
+				err = fmt.Errorf("cannot encode string as %s", typ)
+			}
+		case float64:
+			if typ != "Float64" {
+				return fmt.Errorf("cannot encode float64 as %s", typ)
+			}
+			binary.LittleEndian.PutUint64(buf[:8], math.Float64bits(v))
+			_, err = w.Write(buf[:8])
+		case int64:
+			switch typ {
+			case "Int64":
+				binary.LittleEndian.PutUint64(buf[:8], uint64(v))
+				_, err = w.Write(buf[:8])
+			case "UInt8":
+				// booleans of the wide layout
+				if v < 0 || v > math.MaxUint8 {
+					return fmt.Errorf("%d out of range of UInt8", v)
+				}
+				_, err = w.Write([]byte{byte(v)})
+			default:
+				err = fmt.Errorf("cannot encode int64 as %s", typ)
+			}
+		case bool:
+			if typ != "UInt8" && typ != "Bool" {
+				return fmt.Errorf("cannot encode bool as %s", typ)
+			}
+			buf[0] = 0
+			if v {
+				buf[0] = 1
+			}
+			_, err = w.Write(buf[:1])
+		case uint32:
+			if typ != "UInt32" {
+				return fmt.Errorf("cannot encode uint32 as %s", typ)
+			}
+			binary.LittleEndian.PutUint32(buf[:4], v)
+			_, err = w.Write(buf[:4])
+		case uint64:
+			if typ != "UInt64" {
+				return fmt.Errorf("cannot encode uint64 as %s", typ)
+			}
+			binary.LittleEndian.PutUint64(buf[:8], v)
+			_, err = w.Write(buf[:8])
+		case time.Time:
+			if _, ok := unwrapType(typ, "DateTime"); typ != "DateTime" && !ok {
+				return fmt.Errorf("cannot encode time as %s", typ)
+			}
+			binary.LittleEndian.PutUint32(buf[:4], uint32(v.Unix()))
+			_, err = w.Write(buf[:4])
+		case dateTime64:
+			if precision, ok := dateTime64Precision(typ); !ok || precision != v.precision {
+				return fmt.Errorf("cannot encode time as %s", typ)
+			}
+			binary.LittleEndian.PutUint64(buf[:8], uint64(v.ticks()))
+			_, err = w.Write(buf[:8])
+		default:
+			err = fmt.Errorf("cannot encode %T as %s", v, typ)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// type wrapped in wrapper(...), typ itself if it is not wrapped
+func unwrapType(typ, wrapper string) (string, bool) {
+	if !strings.HasPrefix(typ, wrapper+"(") || !strings.HasSuffix(typ, ")") {
+		return typ, false
+	}
+	return typ[len(wrapper)+1 : len(typ)-1], true
+}
+
+// precision of a DateTime64 type, with or without a timezone
+func dateTime64Precision(typ string) (int, bool) {
+	args, ok := unwrapType(typ, "DateTime64")
+	if !ok {
+		return 0, false
+	}
+	precision, err := strconv.Atoi(strings.TrimSpace(strings.SplitN(args, ",", 2)[0]))
+	return precision, err == nil && precision >= 0 && precision <= 9
+}
+
+// a UUID in RowBinary is its two 64-bit halves, each little-endian
+func writeUUID(w io.Writer, s string) error {
+	b, err := hex.DecodeString(strings.Replace(s, "-", "", -1))
+	if err != nil || len(b) != 16 {
+		return fmt.Errorf("invalid UUID %q", s)
+	}
+	var out [16]byte
+	for i := 0; i < 8; i++ {
+		out[i] = b[7-i]
+		out[8+i] = b[15-i]
+	}
+	_, err = w.Write(out[:])
+	return err
+}
@@ -0,0 +1,349 @@
+package clickhouse
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEncodeRowBinary(t *testing.T) {
+	var buf bytes.Buffer
+	err := encodeRowBinary(&buf,
+		[]string{"String", "Float64", "DateTime", "UInt64", "UUID"},
+		[]interface{}{"cpu", 1.5, time.Unix(1600000000, 0), uint64(7), "00112233-4455-6677-8899-aabbccddeeff"})
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	expected := []byte{
+		3, 'c', 'p', 'u',
+		0, 0, 0, 0, 0, 0, 0xf8, 0x3f,
+		0x00, 0x10, 0x5e, 0x5f,
+		7, 0, 0, 0, 0, 0, 0, 0,
+		0x77, 0x66, 0x55, 0x44, 0x33, 0x22, 0x11, 0x00,
+		0xff, 0xee, 0xdd, 0xcc, 0xbb, 0xaa, 0x99, 0x88,
+	}
+	if !bytes.Equal(buf.Bytes(), expected) {
+		t.Errorf("expected % x, got % x", expected, buf.Bytes())
+	}
+
+	buf.Reset()
+	ts := dateTime64{Time: time.Unix(1600000000, 123456789), precision: 3}
+	if err := encodeRowBinary(&buf, []string{"DateTime64(3)"}, []interface{}{ts}); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	if expected := []byte{0x7b, 0x80, 0x6e, 0x87, 0x74, 0x01, 0, 0}; !bytes.Equal(buf.Bytes(), expected) {
+		t.Errorf("expected % x, got % x", expected, buf.Bytes())
+	}
+
+	buf.Reset()
+	if err := encodeRowBinary(&buf, []string{"Nullable(Float64)", "Nullable(Float64)"}, []interface{}{nil, 1.5}); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	if expected := []byte{1, 0, 0, 0, 0, 0, 0, 0, 0xf8, 0x3f}; !bytes.Equal(buf.Bytes(), expected) {
+		t.Errorf("expected % x, got % x", expected, buf.Bytes())
+	}
+
+	if err := encodeRowBinary(&buf, []string{"Float64"}, []interface{}{"x"}); err == nil {
+		t.Error("expected mismatched type to fail")
+	}
+}
+
+func TestRowBinaryRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		typ   string
+		value interface{}
+	}{
+		{"String", "cpu"},
+		{"LowCardinality(String)", "cpu"},
+		{"Float64", 1.5},
+		{"Nullable(Float64)", 1.5},
+		{"Nullable(Float64)", nil},
+		{"Int64", int64(-7)},
+		{"UInt8", int64(1)},
+		{"Bool", true},
+		{"UInt32", uint32(1600000000)},
+		{"UInt64", uint64(7)},
+		{"DateTime", time.Unix(1600000000, 0)},
+		{"DateTime('Europe/Berlin')", time.Unix(1600000000, 0)},
+		{"DateTime64(3)", dateTime64{Time: time.Unix(1600000000, 123000000), precision: 3}},
+		{"DateTime64(9)", dateTime64{Time: time.Unix(1600000000, 123456789), precision: 9}},
+		{"DateTime64(6, 'Europe/Berlin')", dateTime64{Time: time.Unix(1600000000, 123456000), precision: 6}},
+		{"UUID", "00112233-4455-6677-8899-aabbccddeeff"},
+	} {
+		var buf bytes.Buffer
+		if err := encodeRowBinary(&buf, []string{tc.typ}, []interface{}{tc.value}); err != nil {
+			t.Fatalf("%s: encode: %v", tc.typ, err)
+		}
+		encoded := append([]byte(nil), buf.Bytes()...)
+
+		r := bufio.NewReader(bytes.NewReader(encoded))
+		row, err := decodeRowBinary(r, []string{tc.typ})
+		if err != nil {
+			t.Fatalf("%s: decode: %v", tc.typ, err)
+		}
+		if _, err := r.ReadByte(); err != io.EOF {
+			t.Errorf("%s: expected the value decoded completely", tc.typ)
+		}
+		if !sameValue(row[0], tc.value) {
+			t.Errorf("%s: expected %#v, got %#v", tc.typ, tc.value, row[0])
+		}
+
+		buf.Reset()
+		if err := encodeRowBinary(&buf, []string{tc.typ}, row); err != nil || !bytes.Equal(buf.Bytes(), encoded) {
+			t.Errorf("%s: expected the decoded value to encode as % x, got % x (%v)", tc.typ, encoded, buf.Bytes(), err)
+		}
+	}
+
+	// booleans of the wide layout are stored as UInt8
+	var buf bytes.Buffer
+	if err := encodeRowBinary(&buf, []string{"UInt8", "UInt8"}, []interface{}{true, false}); err != nil || !bytes.Equal(buf.Bytes(), []byte{1, 0}) {
+		t.Errorf("expected booleans encoded as 1 and 0, got % x (%v)", buf.Bytes(), err)
+	}
+}
+
+// whether the decoded value got is the value expected, times by instant
+func sameValue(got, expected interface{}) bool {
+	switch e := expected.(type) {
+	case time.Time:
+		g, ok := got.(time.Time)
+		return ok && g.Equal(e)
+	case dateTime64:
+		g, ok := got.(dateTime64)
+		return ok && g.Equal(e.Time) && g.precision == e.precision
+	}
+	return got == expected
+}
+
+func TestWriteSpoolsFailedInserts(t *testing.T) {
+	dir := t.TempDir()
+
+	db := newMockDatabase()
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.SpoolDir = dir
+	})
+
+	db.sendErr = errors.New("connection reset")
+	written := c.health.rowsWritten.Get()
+	if err := c.Write(testBatch()); err != nil {
+		t.Fatalf("expected spooled write to succeed, got %v", err)
+	}
+	if rows := c.health.rowsWritten.Get() - written; rows != 0 {
+		t.Errorf("expected the spooled rows not counted as written, got %d", rows)
+	}
+	if files, rows := c.health.spoolFiles.Get(), c.health.spoolRows.Get(); files != 1 || rows != 3 {
+		t.Errorf("expected a spool depth of 1 file and 3 rows, got %d and %d", files, rows)
+	}
+
+	manifests, _ := filepath.Glob(filepath.Join(dir, "*.manifest.json"))
+	if len(manifests) != 1 {
+		t.Fatalf("expected 1 manifest, got %v", manifests)
+	}
+	data, err := ioutil.ReadFile(manifests[0])
+	if err != nil {
+		t.Fatalf("read manifest: %v", err)
+	}
+	var manifest spoolManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		t.Fatalf("decode manifest: %v", err)
+	}
+	if manifest.Table != "metrics" || manifest.Rows != 3 || manifest.Format != "RowBinary" {
+		t.Errorf("unexpected manifest %+v", manifest)
+	}
+
+	rows, err := ioutil.ReadFile(filepath.Join(dir, manifest.Data))
+	if err != nil {
+		t.Fatalf("read spool file: %v", err)
+	}
+	if len(rows) == 0 {
+		t.Error("expected spooled rows")
+	}
+}
+
+func TestSelfStatsRecordSpoolRows(t *testing.T) {
+	db := newMockDatabase()
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.SpoolDir = t.TempDir()
+		c.SelfStats = true
+	})
+
+	db.sendErr = errors.New("connection reset")
+	if err := c.Write(testBatch()); err != nil {
+		t.Fatalf("expected spooled write to succeed, got %v", err)
+	}
+	db.sendErr = nil
+	if err := c.Write(testBatch()); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	creates := db.execsWithPrefix("CREATE TABLE IF NOT EXISTS telegraf.telegraf_writer_stats")
+	if len(creates) == 0 || !strings.Contains(creates[0], "spool_rows UInt64") {
+		t.Errorf("expected the stats table created with spool_rows, got %q", creates)
+	}
+	if n := len(db.execsWithPrefix("ALTER TABLE telegraf.telegraf_writer_stats")); n != 0 {
+		t.Errorf("expected no ALTER of the stats table, got %d", n)
+	}
+	// the stats of the failed flush failed to insert as well
+	batches := db.sentBatches("telegraf.telegraf_writer_stats")
+	if len(batches) == 0 || batches[len(batches)-1].rows[0][7] != uint64(3) {
+		t.Errorf("expected 3 spooled rows pending in the stats, got %v", batches)
+	}
+}
+
+func TestWriteSpoolsWideLayout(t *testing.T) {
+	dir := t.TempDir()
+
+	db := newMockDatabase()
+	db.results["system.columns"] = [][]interface{}{
+		{"name", "String"}, {"tags", "String"}, {"ts", "DateTime"},
+		{"usage_idle", "Float64"}, {"usage_user", "Float64"}, {"used", "Int64"},
+	}
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.SpoolDir = dir
+		c.TableLayout = layoutWide
+	})
+
+	db.sendErr = errors.New("connection reset")
+	if err := c.Write(testBatch()); err != nil {
+		t.Fatalf("expected spooled write to succeed, got %v", err)
+	}
+	spooled := db.batches[len(db.batches)-1].rows
+
+	manifests, _ := filepath.Glob(filepath.Join(dir, "*.manifest.json"))
+	if len(manifests) != 1 {
+		t.Fatalf("expected 1 manifest, got %v", manifests)
+	}
+	manifest, err := readSpoolManifest(manifests[0])
+	if err != nil {
+		t.Fatalf("read manifest: %v", err)
+	}
+	expected := "name String tags String ts DateTime usage_idle Float64 usage_user Float64 used Int64"
+	var got []string
+	for i := range manifest.Columns {
+		got = append(got, manifest.Columns[i], manifest.Types[i])
+	}
+	if strings.Join(got, " ") != expected {
+		t.Errorf("expected the columns of the fields in the manifest, got %v", got)
+	}
+
+	db.sendErr = nil
+	if err := c.replaySpool(manifests[0], ReplayOptions{}); err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	batches := db.sentBatches("telegraf.metrics")
+	if len(batches) != 1 || len(batches[0].rows) != len(spooled) {
+		t.Fatalf("expected the spooled rows replayed, got %v", batches)
+	}
+	for i, row := range batches[0].rows {
+		if row[5] != spooled[i][5] {
+			t.Errorf("row %d: expected used %v, got %v", i, spooled[i][5], row[5])
+		}
+	}
+}
+
+func TestReplaySpool(t *testing.T) {
+	dir := t.TempDir()
+
+	db := newMockDatabase()
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.SpoolDir = dir
+		c.BatchID = true
+	})
+
+	db.sendErr = errors.New("connection reset")
+	if err := c.Write(testBatch()); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	spooled := db.batches[len(db.batches)-1].rows
+
+	db.sendErr = nil
+	manifests, _ := filepath.Glob(filepath.Join(dir, "*.manifest.json"))
+	var progress bytes.Buffer
+	if err := c.replaySpool(manifests[0], ReplayOptions{BatchSize: 2, Progress: &progress}); err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+
+	batches := db.sentBatches("telegraf.metrics")
+	if len(batches) != 2 {
+		t.Fatalf("expected 2 batches, got %d", len(batches))
+	}
+	replayed := append(batches[0].rows, batches[1].rows...)
+	if len(replayed) != len(spooled) {
+		t.Fatalf("expected %d rows, got %d", len(spooled), len(replayed))
+	}
+	for i := range spooled {
+		for j := range spooled[i] {
+			expected, got := spooled[i][j], replayed[i][j]
+			if ts, ok := expected.(time.Time); ok {
+				expected, got = ts.Unix(), got.(time.Time).Unix()
+			}
+			if expected != got {
+				t.Errorf("row %d column %d: expected %v, got %v", i, j, expected, got)
+			}
+		}
+	}
+
+	if files, _ := filepath.Glob(filepath.Join(dir, "*")); len(files) != 0 {
+		t.Errorf("expected replayed files removed, got %v", files)
+	}
+	if !bytes.Contains(progress.Bytes(), []byte("3/3 rows into telegraf.metrics")) {
+		t.Errorf("unexpected progress %q", progress.String())
+	}
+}
+
+func TestReplaySpoolResumes(t *testing.T) {
+	dir := t.TempDir()
+
+	db := newMockDatabase()
+	c := newTestClient(t, db, func(c *ClickhouseClient) {
+		c.SpoolDir = dir
+	})
+
+	db.sendErr = errors.New("connection reset")
+	if err := c.Write(testBatch()); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	db.sendErr = nil
+	manifests, _ := filepath.Glob(filepath.Join(dir, "*.manifest.json"))
+
+	// the second batch fails after the first one has been inserted
+	appended := 0
+	db.appendErr = func([]interface{}) error {
+		if appended++; appended > 2 {
+			return errors.New("connection reset")
+		}
+		return nil
+	}
+	if err := c.replaySpool(manifests[0], ReplayOptions{BatchSize: 2}); err == nil {
+		t.Fatal("expected the interrupted replay to fail")
+	}
+	manifest, err := readSpoolManifest(manifests[0])
+	if err != nil {
+		t.Fatalf("read manifest: %v", err)
+	}
+	if manifest.Replayed != 2 {
+		t.Errorf("expected 2 rows recorded as replayed, got %d", manifest.Replayed)
+	}
+	if rows := c.health.spoolRows.Get(); rows != 1 {
+		t.Errorf("expected 1 row left in the spool, got %d", rows)
+	}
+
+	db.appendErr = nil
+	if err := c.replaySpool(manifests[0], ReplayOptions{BatchSize: 2}); err != nil {
+		t.Fatalf("resume: %v", err)
+	}
+	batches := db.sentBatches("telegraf.metrics")
+	if len(batches) != 2 || len(batches[0].rows) != 2 || len(batches[1].rows) != 1 {
+		t.Errorf("expected the resumed replay to insert the remaining row only, got %v", batches)
+	}
+	if files, rows := c.health.spoolFiles.Get(), c.health.spoolRows.Get(); files != 0 || rows != 0 {
+		t.Errorf("expected an empty spool, got %d files and %d rows", files, rows)
+	}
+}
@@ -0,0 +1,43 @@
+package clickhouse
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// create an empty table of the structure of the metrics table target
+// receiving a single flush
+func (c *ClickhouseClient) createStaging(target string) (string, error) {
+	table := fmt.Sprintf("%s_staging_%d", target, time.Now().UnixNano())
+	stmt := fmt.Sprintf("CREATE TABLE %s%s AS %s", c.qualifiedTable(table), c.onCluster(), c.qualifiedTable(target))
+	if err := c.execDDL(c.qualifiedTable(table), stmt); err != nil {
+		return "", err
+	}
+	// execDDL skips the statement once DDL turned out to be denied
+	if atomic.LoadInt32(&c.insertOnly) != 0 {
+		return "", errors.New("staging_inserts needs DDL privileges to create the staging tables")
+	}
+	return table, nil
+}
+
+// move the rows of a staging table into the metrics table target with a
+// single INSERT ... SELECT, making the whole flush visible at once
+func (c *ClickhouseClient) promoteStaging(target string, table string, columns []string) error {
+	stmt := fmt.Sprintf("INSERT INTO %s(%s)%s SELECT %s FROM %s",
+		c.qualifiedTable(target), strings.Join(columns, ","), c.insertSettings(),
+		strings.Join(columns, ","), c.qualifiedTable(table))
+	if c.Debug {
+		log.Println(stmt)
+	}
+	return c.db.Exec(stmt)
+}
+
+// drop a staging table, a failure is logged by execDDL
+func (c *ClickhouseClient) dropStaging(table string) {
+	stmt := fmt.Sprintf("DROP TABLE IF EXISTS %s%s", c.qualifiedTable(table), c.onCluster())
+	c.execDDL(c.qualifiedTable(table), stmt)
+}
@@ -0,0 +1,109 @@
+package clickhouse
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/influxdata/telegraf"
+)
+
+// statistics of a single flush
+type writeStats struct {
+	rows    int
+	failed  int
+	spooled int
+	bytes   int
+	retries int
+	tables  map[string]struct{}
+	start   time.Time
+	// identifier written into every row, empty unless batch_id is enabled
+	batchID string
+	// metrics whose tracked delivery was rejected
+	rejectedSources map[telegraf.Metric]struct{}
+
+	// timing breakdown of the insert. The driver buffers rows
+	// client-side until commit, so network and server time are
+	// both accounted to prepare (query round trip) and commit
+	// (block upload and server-side processing).
+	last       time.Time
+	conversion time.Duration
+	prepare    time.Duration
+	encode     time.Duration
+	commit     time.Duration
+}
+
+func newWriteStats() *writeStats {
+	now := time.Now()
+	return &writeStats{
+		tables:          make(map[string]struct{}),
+		start:           now,
+		last:            now,
+		rejectedSources: make(map[telegraf.Metric]struct{}),
+	}
+}
+
+// duration since the previous lap (or the start of the flush)
+func (s *writeStats) lap() time.Duration {
+	now := time.Now()
+	d := now.Sub(s.last)
+	s.last = now
+	return d
+}
+
+// time spent converting and inserting rows, excluding schema management
+func (s *writeStats) insertDuration() time.Duration {
+	return s.conversion + s.prepare + s.encode + s.commit
+}
+
+func (s *writeStats) timing() string {
+	return fmt.Sprintf("conversion=%s prepare=%s encode=%s commit=%s",
+		s.conversion.Round(time.Microsecond),
+		s.prepare.Round(time.Microsecond),
+		s.encode.Round(time.Microsecond),
+		s.commit.Round(time.Microsecond),
+	)
+}
+
+// record a row successfully written into table
+func (s *writeStats) addRow(table string, size int) {
+	s.rows++
+	s.bytes += size
+	s.tables[table] = struct{}{}
+}
+
+// record a row rejected by the server
+func (s *writeStats) addFailed() {
+	s.failed++
+}
+
+// record rows written to the spool directory instead of the server
+func (s *writeStats) addSpooled(rows int) {
+	s.spooled += rows
+}
+
+func (s *writeStats) tableList() []string {
+	tables := make([]string, 0, len(s.tables))
+	for table := range s.tables {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	return tables
+}
+
+func (s *writeStats) String() string {
+	str := fmt.Sprintf("rows=%d failed=%d spooled=%d bytes=%d tables=[%s] duration=%s retries=%d",
+		s.rows,
+		s.failed,
+		s.spooled,
+		s.bytes,
+		strings.Join(s.tableList(), ","),
+		time.Since(s.start).Round(time.Millisecond),
+		s.retries,
+	)
+	if s.batchID != "" {
+		str += " batch_id=" + s.batchID
+	}
+	return str
+}
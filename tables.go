@@ -0,0 +1,162 @@
+package clickhouse
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"text/template"
+
+	"github.com/influxdata/telegraf"
+)
+
+// metrics written to the same metrics table
+type writeTarget struct {
+	table       string
+	metrics     []clickhouseMetrics
+	wideMetrics []wideMetric
+}
+
+// placeholders of a tablename template
+type tableNameData struct {
+	// name of the measurement
+	Name   string
+	metric telegraf.Metric
+}
+
+// value of the tag key of the metric, empty if it lacks the tag
+func (d tableNameData) Tag(key string) string {
+	value, _ := d.metric.GetTag(key)
+	return value
+}
+
+// template of tablename if it holds placeholders, nil otherwise
+func (c *ClickhouseClient) loadTableNameTemplate() (*template.Template, error) {
+	if !strings.Contains(c.TableName, "{{") {
+		return nil, nil
+	}
+	return template.New("tablename").Parse(c.TableName)
+}
+
+// database and name of table, which the tables of database_tag are
+// qualified with as they are written to databases of their own
+func (c *ClickhouseClient) splitTable(table string) (string, string) {
+	if i := strings.IndexByte(table, '.'); i >= 0 {
+		return table[:i], table[i+1:]
+	}
+	return c.Database, table
+}
+
+// table qualified with its database, e.g. telegraf.metrics
+func (c *ClickhouseClient) qualifiedTable(table string) string {
+	database, name := c.splitTable(table)
+	return database + "." + name
+}
+
+// whether the metrics are written to tables of their own rather than to
+// tablename
+func (c *ClickhouseClient) tablesPerMetric() bool {
+	return c.TablePerMeasurement || c.tableTemplate != nil
+}
+
+// table the rows of metric are written to: tablename unless the
+// tablename template or each measurement selects a table of its own, in
+// the database of the database_tag of the metric if it has the tag
+func (c *ClickhouseClient) metricTable(metric telegraf.Metric) string {
+	table := c.metricTableName(metric)
+	if c.DatabaseTag == "" {
+		return table
+	}
+	if database, ok := metric.GetTag(c.DatabaseTag); ok && database != "" {
+		return sanitizeColumnName(database, c.IdentifierReplacement[0]) + "." + table
+	}
+	return table
+}
+
+// table of metric within its database
+func (c *ClickhouseClient) metricTableName(metric telegraf.Metric) string {
+	switch {
+	case c.tableTemplate != nil:
+		var buf strings.Builder
+		if err := c.tableTemplate.Execute(&buf, tableNameData{Name: metric.Name(), metric: metric}); err != nil {
+			log.Printf("W! [outputs.clickhouse] Unable to evaluate tablename for %s, writing to its measurement table: %s", metric.Name(), err.Error())
+			return sanitizeColumnName(metric.Name(), c.IdentifierReplacement[0])
+		}
+		return sanitizeColumnName(buf.String(), c.IdentifierReplacement[0])
+	case c.TablePerMeasurement:
+		return sanitizeColumnName(metric.Name(), c.IdentifierReplacement[0])
+	}
+	return c.metricsTable()
+}
+
+// metrics table written to without per-metric tables, tablename unless
+// schema_fallback switched to a successor of it
+func (c *ClickhouseClient) metricsTable() string {
+	c.managedMu.Lock()
+	defer c.managedMu.Unlock()
+	if c.table != "" {
+		return c.table
+	}
+	return c.TableName
+}
+
+// switch the metrics table written to, read by the background tasks
+func (c *ClickhouseClient) setMetricsTable(table string) {
+	c.managedMu.Lock()
+	c.table = table
+	c.managedMu.Unlock()
+}
+
+// group the metrics of a batch by their table in the order the tables
+// first show up
+func (c *ClickhouseClient) writeTargets(batchMetrics []clickhouseMetrics, wideMetrics []wideMetric) []writeTarget {
+	if !c.tablesPerMetric() && c.DatabaseTag == "" {
+		return []writeTarget{{table: c.metricsTable(), metrics: batchMetrics, wideMetrics: wideMetrics}}
+	}
+
+	var targets []writeTarget
+	index := make(map[string]int)
+	target := func(table string) *writeTarget {
+		i, ok := index[table]
+		if !ok {
+			i = len(targets)
+			index[table] = i
+			targets = append(targets, writeTarget{table: table})
+		}
+		return &targets[i]
+	}
+	for _, metrs := range batchMetrics {
+		if len(metrs) > 0 {
+			t := target(metrs[0].table)
+			t.metrics = append(t.metrics, metrs)
+		}
+	}
+	for _, metr := range wideMetrics {
+		t := target(metr.metric.table)
+		t.wideMetrics = append(t.wideMetrics, metr)
+	}
+	return targets
+}
+
+// create the metrics table on its first write since the schema was
+// created
+func (c *ClickhouseClient) ensureTable(table string) error {
+	if c.createdTables[table] {
+		return nil
+	}
+	if database, _ := c.splitTable(table); database != c.Database && c.CreateDatabase && !c.createdDatabases[database] {
+		stmt := fmt.Sprintf("CREATE DATABASE IF NOT EXISTS %s%s", database, c.onCluster())
+		if err := c.execDDL(database, stmt); err != nil {
+			return err
+		}
+		c.createdDatabases[database] = true
+	}
+	if err := c.createMetricsTable(table); err != nil {
+		return err
+	}
+	if err := c.syncTTL(table, c.TTL); err != nil {
+		return err
+	}
+	c.createdTables[table] = true
+	c.manageTable(table)
+	return nil
+}
@@ -0,0 +1,169 @@
+package clickhouse
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	tagsJSON     = "json"
+	tagsMap      = "map"
+	tagsJSONType = "json_type"
+	tagsNested   = "nested"
+)
+
+// columns holding the tags. Map, JSON typed and nested tags are inserted
+// as JSON into an ephemeral column the tags columns are computed from,
+// sparing the native driver the types and the rows an extra column.
+func (c *ClickhouseClient) tagsColumnDefs() []columnDef {
+	switch c.TagsFormat {
+	case tagsMap:
+		typ := "Map(" + c.stringType() + ", " + c.stringType() + ")"
+		return []columnDef{
+			{name: "tags_json", typ: "String", ephemeral: true},
+			{name: "tags", typ: typ, defaultExpr: "CAST(JSONExtractKeysAndValues(tags_json, 'String'), " + quoteString(typ) + ")"},
+		}
+	case tagsJSONType:
+		return []columnDef{
+			{name: "tags_json", typ: "String", ephemeral: true},
+			{name: "tags", typ: "JSON", defaultExpr: "CAST(tags_json, 'JSON')"},
+		}
+	case tagsNested:
+		// the arrays of a Nested(key String, value String) column
+		pairs := "JSONExtractKeysAndValues(tags_json, 'String')"
+		return []columnDef{
+			{name: "tags_json", typ: "String", ephemeral: true},
+			{name: "tags.key", typ: "Array(" + c.stringType() + ")", defaultExpr: "arrayMap(t -> t.1, " + pairs + ")"},
+			{name: "tags.value", typ: "Array(" + c.stringType() + ")", defaultExpr: "arrayMap(t -> t.2, " + pairs + ")"},
+		}
+	}
+	return []columnDef{{name: "tags", typ: c.stringType()}}
+}
+
+// whether the tags are inserted into the ephemeral tags_json column
+func (c *ClickhouseClient) tagsEphemeral() bool {
+	return c.TagsFormat == tagsMap || c.TagsFormat == tagsJSONType || c.TagsFormat == tagsNested
+}
+
+// type of the name and tags columns, dictionary encoded with
+// low_cardinality
+func (c *ClickhouseClient) stringType() string {
+	if c.LowCardinality {
+		return "LowCardinality(String)"
+	}
+	return "String"
+}
+
+// column the JSON encoded tags are inserted into
+func (c *ClickhouseClient) tagsInsertColumn() string {
+	if c.tagsEphemeral() {
+		return "tags_json"
+	}
+	return "tags"
+}
+
+// expression of the value of the tag key in the tags column
+func (c *ClickhouseClient) tagExpr(key string) string {
+	switch c.TagsFormat {
+	case tagsMap:
+		return "tags[" + quoteString(key) + "]"
+	case tagsJSONType:
+		return "CAST(tags." + quoteIdentifier(key) + ", 'String')"
+	case tagsNested:
+		return "tags.value[indexOf(tags.key, " + quoteString(key) + ")]"
+	}
+	return "JSONExtractString(tags, " + quoteString(key) + ")"
+}
+
+// sorting key of the tables of the metrics, order_by if configured. Maps
+// and JSON are not comparable, the arrays of nested tags are.
+func (c *ClickhouseClient) metricsSortKey() string {
+	if c.OrderBy != "" {
+		return trimParens(strings.TrimSpace(c.OrderBy))
+	}
+	switch c.TagsFormat {
+	case tagsNested:
+		return "name,tags.key,tags.value,ts"
+	case tagsMap, tagsJSONType:
+		return "name,ts"
+	}
+	return "name,tags,ts"
+}
+
+// expr without the parentheses enclosing all of it
+func trimParens(expr string) string {
+	for strings.HasPrefix(expr, "(") && strings.HasSuffix(expr, ")") {
+		depth := 0
+		for i, r := range expr {
+			switch r {
+			case '(':
+				depth++
+			case ')':
+				depth--
+			}
+			if depth == 0 && i < len(expr)-1 {
+				// closed before the end, as in (a)+(b)
+				return expr
+			}
+		}
+		expr = strings.TrimSpace(expr[1 : len(expr)-1])
+	}
+	return expr
+}
+
+// rows with a column per tag key of table appended, adding the columns of
+// tag keys not seen before to the table
+func (c *ClickhouseClient) withTagColumns(table string, columns []string, rows []insertRow) ([]string, []insertRow, error) {
+	tagKeys := make(map[string]bool)
+	for _, row := range rows {
+		for key := range row.metric.Tags {
+			tagKeys[key] = true
+		}
+	}
+	// named in the order of their keys
+	sorted := make([]string, 0, len(tagKeys))
+	for key := range tagKeys {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+	for _, key := range sorted {
+		name, ok := c.tagColumns[key]
+		if !ok {
+			name = c.fieldNamer.nameFor(tagComment(key), key)
+			c.tagColumns[key] = name
+		}
+		if err := c.addColumn(table, columnDef{name: name, typ: "LowCardinality(String)", comment: tagComment(key)}); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var keys []string
+	for key, name := range c.tagColumns {
+		if _, ok := c.knownColumns[table][name]; ok {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return columns, rows, nil
+	}
+	sort.Slice(keys, func(i, j int) bool { return c.tagColumns[keys[i]] < c.tagColumns[keys[j]] })
+
+	names := make([]string, 0, len(keys))
+	for _, key := range keys {
+		names = append(names, c.tagColumns[key])
+	}
+	for i := range rows {
+		values := rows[i].values[:len(rows[i].values):len(rows[i].values)]
+		for _, key := range keys {
+			value := ""
+			if v, ok := rows[i].metric.Tags[key]; ok {
+				value = fmt.Sprint(v)
+			}
+			values = append(values, value)
+			rows[i].size += len(value)
+		}
+		rows[i].values = values
+	}
+	return append(columns[:len(columns):len(columns)], names...), rows, nil
+}
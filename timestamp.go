@@ -0,0 +1,68 @@
+package clickhouse
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"math"
+	"time"
+)
+
+// digits of the sub-second part of the metric timestamps by
+// timestamp_precision
+var timestampPrecisions = map[string]int{"s": 0, "ms": 3, "us": 6, "ns": 9}
+
+// a timestamp of a DateTime64 column. The native driver takes the time
+// itself, JSONEachRow and RowBinary take the ticks of the precision.
+type dateTime64 struct {
+	time.Time
+	precision int
+}
+
+func (t dateTime64) Value() (driver.Value, error) {
+	return t.Time, nil
+}
+
+// the timestamp in units of the precision
+func (t dateTime64) ticks() int64 {
+	return t.UnixNano() / int64(math.Pow10(9-t.precision))
+}
+
+// type of the ts column of the metrics tables
+func (c *ClickhouseClient) timestampType() string {
+	if precision := timestampPrecisions[c.TimestampPrecision]; precision > 0 {
+		if c.Timezone != "" {
+			return fmt.Sprintf("DateTime64(%d, %s)", precision, quoteString(c.Timezone))
+		}
+		return fmt.Sprintf("DateTime64(%d)", precision)
+	}
+	return c.dateTimeType()
+}
+
+// type of the DateTime columns of the metrics and series tables, in the
+// configured timezone if any
+func (c *ClickhouseClient) dateTimeType() string {
+	if c.Timezone != "" {
+		return "DateTime(" + quoteString(c.Timezone) + ")"
+	}
+	return "DateTime"
+}
+
+// value of the ts column of the metrics tables, truncated to seconds by
+// DateTime columns
+func (c *ClickhouseClient) timestampValue(ts time.Time) interface{} {
+	if c.location != nil {
+		ts = ts.In(c.location)
+	}
+	if precision := timestampPrecisions[c.TimestampPrecision]; precision > 0 {
+		return dateTime64{Time: ts, precision: precision}
+	}
+	return ts
+}
+
+// bytes of the ts column per row
+func (c *ClickhouseClient) timestampSize() int {
+	if timestampPrecisions[c.TimestampPrecision] > 0 {
+		return 8
+	}
+	return 4
+}
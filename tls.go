@@ -0,0 +1,124 @@
+package clickhouse
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go"
+)
+
+var (
+	// TLS configurations registered with the driver, also consulted by
+	// the HTTP transport which cannot read the driver's registry
+	tlsConfigsMu sync.RWMutex
+	tlsConfigs   = map[string]*tls.Config{}
+)
+
+// register the TLS configuration of the client's tls_* options with the
+// driver, the name referenced by the DSN is left in tlsConfigName
+func (c *ClickhouseClient) registerTLSConfig() error {
+	tlsConfig, err := c.ClientConfig.TLSConfig()
+	if err != nil {
+		return err
+	}
+	c.deregisterTLSConfig()
+	if tlsConfig == nil {
+		return nil
+	}
+	if c.TLSCert != "" && c.TLSKey != "" {
+		// serve the client certificate from the files on every handshake,
+		// picking up renewed certificates without a restart
+		reloader := &certReloader{certFile: c.TLSCert, keyFile: c.TLSKey}
+		if _, err = reloader.certificate(); err != nil {
+			return err
+		}
+		tlsConfig.Certificates = nil
+		tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return reloader.certificate()
+		}
+	}
+
+	name := fmt.Sprintf("outputs.clickhouse.%p", c)
+	if err = clickhouse.RegisterTLSConfig(name, tlsConfig); err != nil {
+		return err
+	}
+	tlsConfigsMu.Lock()
+	tlsConfigs[name] = tlsConfig
+	tlsConfigsMu.Unlock()
+	c.tlsConfigName = name
+	return nil
+}
+
+func (c *ClickhouseClient) deregisterTLSConfig() {
+	if c.tlsConfigName == "" {
+		return
+	}
+	clickhouse.DeregisterTLSConfig(c.tlsConfigName)
+	tlsConfigsMu.Lock()
+	delete(tlsConfigs, c.tlsConfigName)
+	tlsConfigsMu.Unlock()
+	c.tlsConfigName = ""
+}
+
+// copy of the TLS configuration registered under name, nil if unknown
+func lookupTLSConfig(name string) *tls.Config {
+	tlsConfigsMu.RLock()
+	defer tlsConfigsMu.RUnlock()
+	if tlsConfig, ok := tlsConfigs[name]; ok {
+		return tlsConfig.Clone()
+	}
+	return nil
+}
+
+// client certificate loaded from a certificate and key file, loaded again
+// when either file changes or the certificate expired
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	notAfter time.Time
+	modTimes [2]time.Time
+}
+
+func (r *certReloader) certificate() (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var modTimes [2]time.Time
+	for i, path := range []string{r.certFile, r.keyFile} {
+		if info, err := os.Stat(path); err == nil {
+			modTimes[i] = info.ModTime()
+		}
+	}
+	if r.cert != nil && modTimes == r.modTimes && time.Now().Before(r.notAfter) {
+		return r.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		if r.cert == nil {
+			return nil, err
+		}
+		log.Printf("W! [outputs.clickhouse] Unable to reload client certificate %s, keeping the previous one: %s", r.certFile, err.Error())
+		return r.cert, nil
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	if r.cert != nil {
+		log.Printf("I! [outputs.clickhouse] Reloaded client certificate %s valid until %s", r.certFile, leaf.NotAfter.Format(time.RFC3339))
+	}
+	cert.Leaf = leaf
+	r.cert = &cert
+	r.notAfter = leaf.NotAfter
+	r.modTimes = modTimes
+	return r.cert, nil
+}
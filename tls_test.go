@@ -0,0 +1,168 @@
+package clickhouse
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildDsnTLS(t *testing.T) {
+	c := newClickhouse()
+	c.Hosts = []string{"a:9440"}
+	c.InsecureSkipVerify = true
+	if err := c.registerTLSConfig(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.deregisterTLSConfig()
+
+	dsn, err := buildDsn(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := u.Query()
+	if query.Get("secure") != "true" || query.Get("skip_verify") != "true" || query.Get("tls_config") != c.tlsConfigName {
+		t.Errorf("expected a secure DSN using %s, got %s", c.tlsConfigName, dsn)
+	}
+	if lookupTLSConfig(c.tlsConfigName) == nil {
+		t.Errorf("expected %s to be registered", c.tlsConfigName)
+	}
+}
+
+func TestBuildDsnSecure(t *testing.T) {
+	c := newClickhouse()
+	c.Hosts = []string{"a:9440"}
+	c.Secure = true
+
+	dsn, err := buildDsn(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(dsn, "secure=true") || !strings.Contains(dsn, "skip_verify=false") || strings.Contains(dsn, "tls_config") {
+		t.Errorf("expected a secure DSN verifying against the system roots, got %s", dsn)
+	}
+
+	c.Protocol = "http"
+	if dsn, err = buildDsn(c); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(dsn, "https://") {
+		t.Errorf("expected secure to upgrade http to https, got %s", dsn)
+	}
+}
+
+func TestTLSConfigMissingCA(t *testing.T) {
+	c := newClickhouse()
+	c.TLSCA = "/nonexistent/ca.pem"
+	if err := c.registerTLSConfig(); err == nil {
+		t.Error("expected a missing tls_ca to fail")
+	}
+	if c.tlsConfigName != "" {
+		t.Errorf("expected nothing registered, got %s", c.tlsConfigName)
+	}
+}
+
+func TestHTTPSDatabase(t *testing.T) {
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Ok.\n"))
+	}))
+	defer s.Close()
+
+	c := newClickhouse()
+	c.Hosts = []string{strings.TrimPrefix(s.URL, "https://")}
+	c.Protocol = "https"
+	c.InsecureSkipVerify = true
+	if err := c.registerTLSConfig(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.deregisterTLSConfig()
+
+	dsn, err := buildDsn(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := openHTTPDatabase(dsn, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Ping(); err != nil {
+		t.Fatalf("expected ping over https to succeed, got %v", err)
+	}
+	if _, ok := d.(*httpDatabase).params["tls_config"]; ok {
+		t.Error("expected tls_config not to be sent to the server")
+	}
+}
+
+// write a self-signed client certificate and its key into dir
+func writeClientCert(t *testing.T, dir string, serial int64) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "telegraf"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	mod := time.Now().Add(time.Duration(serial) * time.Minute)
+	os.Chtimes(certFile, mod, mod)
+	os.Chtimes(keyFile, mod, mod)
+	return certFile, keyFile
+}
+
+func TestClientCertificateReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeClientCert(t, dir, 1)
+
+	c := newClickhouse()
+	c.TLSCert = certFile
+	c.TLSKey = keyFile
+	if err := c.registerTLSConfig(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.deregisterTLSConfig()
+
+	tlsConfig := lookupTLSConfig(c.tlsConfigName)
+	if tlsConfig.GetClientCertificate == nil || len(tlsConfig.Certificates) != 0 {
+		t.Fatal("expected the client certificate to be served on handshake")
+	}
+	cert, err := tlsConfig.GetClientCertificate(nil)
+	if err != nil || cert.Leaf.SerialNumber.Int64() != 1 {
+		t.Fatalf("expected the first certificate, got %v", err)
+	}
+
+	writeClientCert(t, dir, 2)
+	if cert, err = tlsConfig.GetClientCertificate(nil); err != nil || cert.Leaf.SerialNumber.Int64() != 2 {
+		t.Errorf("expected the renewed certificate, got %v", err)
+	}
+}
@@ -0,0 +1,75 @@
+package clickhouse
+
+import (
+	"math"
+
+	"github.com/influxdata/telegraf"
+)
+
+// a linear transformation of numeric field values, value*scale+offset,
+// optionally rounded to a number of decimals
+type transformRule struct {
+	// measurement the rule applies to, all if empty or "*"
+	Measurement string `toml:"measurement"`
+	// field keys the rule applies to, "*" for all
+	Fields []string `toml:"fields"`
+
+	Scale  *float64 `toml:"scale"`
+	Offset float64  `toml:"offset"`
+	Round  *int     `toml:"round"`
+}
+
+func (r *transformRule) appliesTo(measurement, field string) bool {
+	if r.Measurement != "" && r.Measurement != "*" && r.Measurement != measurement {
+		return false
+	}
+	return matchesKey(r.Fields, field)
+}
+
+func (r *transformRule) apply(v float64) float64 {
+	if r.Scale != nil {
+		v *= *r.Scale
+	}
+	v += r.Offset
+	if r.Round != nil {
+		factor := math.Pow(10, float64(*r.Round))
+		v = math.Round(v*factor) / factor
+	}
+	return v
+}
+
+// apply the transformation rules to the numeric fields of metric,
+// returning a transformed copy if any rule applies.
+func (c *ClickhouseClient) transform(metric telegraf.Metric) telegraf.Metric {
+	var transformed telegraf.Metric
+
+	for _, field := range metric.FieldList() {
+		var rules []*transformRule
+		for _, rule := range c.Transform {
+			if rule.appliesTo(metric.Name(), field.Key) {
+				rules = append(rules, rule)
+			}
+		}
+		if len(rules) == 0 {
+			continue
+		}
+
+		value, ok := convertField(field.Value).(float64)
+		if !ok {
+			continue
+		}
+		for _, rule := range rules {
+			value = rule.apply(value)
+		}
+
+		if transformed == nil {
+			transformed = metric.Copy()
+		}
+		transformed.AddField(field.Key, value)
+	}
+
+	if transformed == nil {
+		return metric
+	}
+	return transformed
+}
@@ -0,0 +1,38 @@
+package clickhouse
+
+import (
+	"testing"
+	"time"
+
+	"github.com/influxdata/telegraf/metric"
+)
+
+func TestTransform(t *testing.T) {
+	scale := 1.8
+	round := 1
+	c := newClickhouse()
+	c.Transform = []*transformRule{
+		{Measurement: "temp", Fields: []string{"temp"}, Scale: &scale, Offset: 32, Round: &round},
+	}
+
+	m := metric.New("temp",
+		map[string]string{"sensor": "s1"},
+		map[string]interface{}{"temp": int64(21), "humidity": 40.0, "state": "ok"},
+		time.Unix(1600000000, 0))
+
+	transformed := c.transform(m)
+	if v, _ := transformed.GetField("temp"); v != 69.8 {
+		t.Errorf("expected temp 69.8, got %v", v)
+	}
+	if v, _ := transformed.GetField("humidity"); v != 40.0 {
+		t.Errorf("expected humidity untouched, got %v", v)
+	}
+	if v, _ := m.GetField("temp"); v != int64(21) {
+		t.Errorf("expected the original metric untouched, got %v", v)
+	}
+
+	other := metric.New("cpu", nil, map[string]interface{}{"temp": 1.0}, time.Unix(1600000000, 0))
+	if c.transform(other) != other {
+		t.Error("expected metrics of other measurements untouched")
+	}
+}
@@ -0,0 +1,273 @@
+package clickhouse
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/influxdata/telegraf"
+)
+
+// a metric of the wide layout, its fields kept with their types
+type wideMetric struct {
+	metric clickhouseMetric
+	fields map[string]interface{}
+}
+
+// wide metric of the preprocessed metric, source being the metric
+// received from Telegraf
+func newWideMetric(metric telegraf.Metric, source telegraf.Metric) wideMetric {
+	tags := make(map[string]interface{}, len(metric.TagList()))
+	for _, tag := range metric.TagList() {
+		tags[tag.Key] = tag.Value
+	}
+	fields := make(map[string]interface{}, len(metric.FieldList()))
+	for _, field := range metric.FieldList() {
+		fields[field.Key] = field.Value
+	}
+	return wideMetric{
+		metric: clickhouseMetric{Name: metric.Name(), Tags: tags, Ts: metric.Time(), source: source},
+		fields: fields,
+	}
+}
+
+// column type of a field value, empty if unsupported
+func wideColumnType(v interface{}) string {
+	switch v.(type) {
+	case float64, float32:
+		return "Float64"
+	case int64, int32, int16, int8, int:
+		return "Int64"
+	case uint64, uint32, uint16, uint8, uint:
+		return "UInt64"
+	case bool:
+		return "UInt8"
+	case string:
+		return "String"
+	default:
+		return ""
+	}
+}
+
+// value of a field converted to the column type typ, false if it does
+// not convert. Fields the metric lacks are the column's zero value.
+// Integers are converted exactly when in range, rather than through a
+// float losing precision above 2^53, floats only if integral and in range.
+func wideValue(v interface{}, typ string) (interface{}, bool) {
+	switch {
+	case strings.HasPrefix(typ, "Float"):
+		if v == nil {
+			return float64(0), true
+		}
+		f, ok := convertField(v).(float64)
+		return f, ok
+	case strings.HasPrefix(typ, "UInt8"):
+		if v == nil {
+			return int64(0), true
+		}
+		if f, ok := convertField(v).(float64); ok && isIntegral(f, 0, 1<<8) {
+			return int64(f), true
+		}
+		return int64(0), false
+	case strings.HasPrefix(typ, "UInt"):
+		switch i := v.(type) {
+		case nil:
+			return uint64(0), true
+		case uint64:
+			return i, true
+		case int64:
+			if i >= 0 {
+				return uint64(i), true
+			}
+			return uint64(0), false
+		}
+		if f, ok := convertField(v).(float64); ok && isIntegral(f, 0, 1<<64) {
+			return uint64(f), true
+		}
+		return uint64(0), false
+	case strings.HasPrefix(typ, "Int"):
+		switch i := v.(type) {
+		case nil:
+			return int64(0), true
+		case int64:
+			return i, true
+		case uint64:
+			if i <= math.MaxInt64 {
+				return int64(i), true
+			}
+			return int64(0), false
+		}
+		if f, ok := convertField(v).(float64); ok && isIntegral(f, math.MinInt64, 1<<63) {
+			return int64(f), true
+		}
+		return int64(0), false
+	default:
+		if v == nil {
+			return "", true
+		}
+		s, ok := v.(string)
+		return s, ok
+	}
+}
+
+// whether f is a whole number with min <= f < max, max exclusive as the
+// largest integers of 64 bits have no exact float
+func isIntegral(f float64, min float64, max float64) bool {
+	return f == math.Trunc(f) && f >= min && f < max
+}
+
+// note the fields of metric as fields of its table, with their column
+// types if not seen before. Their columns are named by nameWideFields
+// once the names of the existing columns are known.
+func (c *ClickhouseClient) observeWideFields(metric wideMetric) {
+	table := metric.metric.table
+	fields := c.wideFields[table]
+	if fields == nil {
+		fields = make(map[string]columnDef)
+		c.wideFields[table] = fields
+	}
+	for key, value := range metric.fields {
+		typ := wideColumnType(value)
+		if typ == "" {
+			continue
+		}
+		if _, ok := fields[key]; !ok {
+			if c.NullableFields {
+				typ = "Nullable(" + typ + ")"
+			}
+			fields[key] = columnDef{typ: typ, comment: fieldComment(key)}
+		}
+	}
+}
+
+// name the columns of the fields of table not named yet, in the order of
+// their keys. A field has the same column in every table.
+func (c *ClickhouseClient) nameWideFields(table string) {
+	fields := c.wideFields[table]
+	var keys []string
+	for key, def := range fields {
+		if def.name == "" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		name, ok := c.fieldColumns[key]
+		if !ok {
+			name = c.fieldNamer.nameFor(fieldComment(key), key)
+			c.fieldColumns[key] = name
+		}
+		def := fields[key]
+		def.name = name
+		fields[key] = def
+	}
+}
+
+// column definitions of the fields of table seen so far, ordered by name
+func (c *ClickhouseClient) wideFieldColumnDefs(table string) []columnDef {
+	defs := make([]columnDef, 0, len(c.wideFields[table]))
+	for _, def := range c.wideFields[table] {
+		defs = append(defs, def)
+	}
+	sort.Slice(defs, func(i, j int) bool { return defs[i].name < defs[j].name })
+	return defs
+}
+
+// create the table of the wide layout with a column per field seen so
+// far
+func (c *ClickhouseClient) createWideTable(table string) error {
+	c.nameWideFields(table)
+	columns := append(c.metricsTableColumns(), c.wideFieldColumnDefs(table)...)
+	return c.createShardedTable(table, columns, c.metricsEngine(c.metricsSortKey()))
+}
+
+// rows of the wide layout, one per metric with its fields in the columns
+// of table. The columns of fields new to the table are added, fields
+// still without a column, e.g. as the user lacks DDL privileges, are
+// dropped. Metrics with a field not converting to the type of its
+// column are counted as failed, like the rows the driver refuses.
+func (c *ClickhouseClient) wideRows(table string, metrics []wideMetric, stats *writeStats) ([]string, []insertRow, []rejectedRow, error) {
+	c.nameWideFields(table)
+	defs := c.wideFields[table]
+	fields := make(map[string]bool)
+	for _, metr := range metrics {
+		for key := range metr.fields {
+			def, ok := defs[key]
+			if !ok || fields[key] {
+				continue
+			}
+			if err := c.addColumn(table, def); err != nil {
+				return nil, nil, nil, err
+			}
+			fields[key] = true
+		}
+	}
+
+	existing := c.knownColumns[table]
+	var keys []string
+	for key, def := range defs {
+		if _, ok := existing[def.name]; ok {
+			keys = append(keys, key)
+		} else if fields[key] && !c.wideDropped[table+"."+key] {
+			log.Printf("W! [outputs.clickhouse] Field %s has no column %s in %s, dropping it", key, def.name, c.qualifiedTable(table))
+			c.wideDropped[table+"."+key] = true
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return defs[keys[i]].name < defs[keys[j]].name })
+
+	columns := []string{"name", c.tagsInsertColumn(), "ts"}
+	for _, key := range keys {
+		columns = append(columns, defs[key].name)
+	}
+
+	rows := make([]insertRow, 0, len(metrics))
+	var rejected []rejectedRow
+	for _, metr := range metrics {
+		tags, _ := json.Marshal(metr.metric.Tags)
+		values := []interface{}{metr.metric.Name, string(tags), c.timestampValue(metr.metric.Ts)}
+		// name + tags + ts
+		size := len(metr.metric.Name) + len(tags) + c.timestampSize()
+		var mismatch error
+		for _, key := range keys {
+			typ := existing[defs[key].name]
+			if strings.HasPrefix(typ, "Nullable(") {
+				// fields the metric lacks are NULL
+				if _, ok := metr.fields[key]; !ok {
+					values = append(values, nil)
+					size++
+					continue
+				}
+				typ = strings.TrimSuffix(strings.TrimPrefix(typ, "Nullable("), ")")
+			}
+			value, ok := wideValue(metr.fields[key], typ)
+			if !ok {
+				mismatch = fmt.Errorf("field %s of %T does not convert to column %s %s", key, metr.fields[key], defs[key].name, typ)
+				break
+			}
+			if s, ok := value.(string); ok {
+				size += len(s)
+			} else {
+				size += 8
+			}
+			values = append(values, value)
+		}
+		if mismatch != nil {
+			log.Printf("W! [outputs.clickhouse] Rejecting %s of %s: %s", metr.metric.Name, c.qualifiedTable(table), mismatch.Error())
+			row := insertRow{metric: metr.metric}
+			stats.addFailed()
+			if c.PermanentErrors == "reject" {
+				stats.rejectSource(row)
+			}
+			rejected = c.sampleRejected(rejected, metr.metric, mismatch)
+			continue
+		}
+		if c.Debug {
+			log.Println("Name:", metr.metric.Name, "Tags:", string(tags), "Fields:", metr.fields, "Ts:", metr.metric.Ts)
+		}
+		rows = append(rows, insertRow{metric: metr.metric, values: values, size: size})
+	}
+	return columns, rows, rejected, nil
+}
@@ -0,0 +1,39 @@
+package clickhouse
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// a daily time window such as 02:00-04:00, which may wrap around midnight
+type timeWindow struct {
+	start time.Duration
+	end   time.Duration
+}
+
+func parseTimeWindow(s string) (*timeWindow, error) {
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid time window %q, expected HH:MM-HH:MM", s)
+	}
+
+	var bounds [2]time.Duration
+	for i, part := range parts {
+		t, err := time.Parse("15:04", strings.TrimSpace(part))
+		if err != nil {
+			return nil, fmt.Errorf("invalid time window %q: %s", s, err.Error())
+		}
+		bounds[i] = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+	return &timeWindow{start: bounds[0], end: bounds[1]}, nil
+}
+
+// report whether t falls into the window
+func (w *timeWindow) contains(t time.Time) bool {
+	offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	if w.start <= w.end {
+		return offset >= w.start && offset < w.end
+	}
+	return offset >= w.start || offset < w.end
+}
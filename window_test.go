@@ -0,0 +1,61 @@
+package clickhouse
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTimeWindow(t *testing.T) {
+	for _, test := range []struct {
+		window string
+		start  time.Duration
+		end    time.Duration
+	}{
+		{"02:00-04:00", 2 * time.Hour, 4 * time.Hour},
+		{" 22:30 - 04:15 ", 22*time.Hour + 30*time.Minute, 4*time.Hour + 15*time.Minute},
+		{"00:00-23:59", 0, 23*time.Hour + 59*time.Minute},
+	} {
+		w, err := parseTimeWindow(test.window)
+		if err != nil || w.start != test.start || w.end != test.end {
+			t.Errorf("expected %q to be %v-%v, got %v, %v", test.window, test.start, test.end, w, err)
+		}
+	}
+
+	for _, window := range []string{"", "02:00", "02:00-04:00-06:00", "2am-4am", "25:00-04:00", "02:60-04:00", "02:00-"} {
+		if w, err := parseTimeWindow(window); err == nil {
+			t.Errorf("expected %q to be rejected, got %v", window, w)
+		}
+	}
+}
+
+func TestTimeWindowContains(t *testing.T) {
+	at := func(hour, minute int) time.Time {
+		return time.Date(2020, 9, 13, hour, minute, 0, 0, time.Local)
+	}
+	for _, test := range []struct {
+		window   string
+		time     time.Time
+		expected bool
+	}{
+		{"02:00-04:00", at(1, 59), false},
+		{"02:00-04:00", at(2, 0), true},
+		{"02:00-04:00", at(3, 59), true},
+		{"02:00-04:00", at(4, 0), false},
+		// wrapping around midnight
+		{"22:00-04:00", at(21, 59), false},
+		{"22:00-04:00", at(22, 0), true},
+		{"22:00-04:00", at(23, 59), true},
+		{"22:00-04:00", at(0, 0), true},
+		{"22:00-04:00", at(3, 59), true},
+		{"22:00-04:00", at(4, 0), false},
+		{"22:00-04:00", at(12, 0), false},
+	} {
+		w, err := parseTimeWindow(test.window)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.contains(test.time) != test.expected {
+			t.Errorf("expected %s in %s to be %v", test.time.Format("15:04"), test.window, test.expected)
+		}
+	}
+}